@@ -6,7 +6,7 @@ package authorizer
 import (
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 
 	"tailscale.com/client/tailscale/apitype"
@@ -21,17 +21,22 @@ const tailsqlCap = "tailscale.com/cap/tailsql"
 // tailnet to check access for query sources.
 // If logf == nil, logs are sent to log.Printf.
 func ACLGrants(logf logger.Logf) func(string, *apitype.WhoIsResponse) error {
-	if logf == nil {
-		logf = log.Printf
-	}
+	return aclGrants(logfAuth(logf))
+}
+
+// ACLGrantsLogger is like ACLGrants, but sends structured logs to lg.
+// If lg == nil, logs are sent to slog.Default().
+func ACLGrantsLogger(lg *slog.Logger) func(string, *apitype.WhoIsResponse) error {
+	return aclGrants(slogAuth(lg))
+}
+
+func aclGrants(logAuth authLogger) func(string, *apitype.WhoIsResponse) error {
 	return func(dataSrc string, who *apitype.WhoIsResponse) (err error) {
 		caller := who.UserProfile.LoginName
 		if who.Node.IsTagged() {
 			caller = who.Node.Name
 		}
-		defer func() {
-			logf("[tailsql] auth src=%q who=%q err=%v", dataSrc, caller, err)
-		}()
+		defer func() { logAuth(dataSrc, caller, err) }()
 		type rule struct {
 			DataSrc []string `json:"src"`
 		}
@@ -4,8 +4,13 @@
 package authorizer_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/tailscale/tailsql/authorizer"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/tailcfg"
@@ -139,3 +144,234 @@ func TestMap(t *testing.T) {
 		}
 	}
 }
+
+func TestPolicy(t *testing.T) {
+	capUser := &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{Name: "laptop.example.ts.net."},
+		UserProfile: &tailcfg.UserProfile{
+			ID: 2, LoginName: "intern@example.com", DisplayName: "Some Intern",
+		},
+		CapMap: tailcfg.PeerCapMap{"example.com/cap/metrics": nil},
+	}
+	p := &authorizer.Policy{
+		Rules: []authorizer.PolicyRule{{
+			Sources: []string{"*"},
+			Deny:    []string{"tag:*"},
+		}, {
+			Sources: []string{"prod*"},
+			Allow:   []string{"*@example.com"},
+			Deny:    []string{"user:intern@example.com"},
+		}, {
+			Sources: []string{"metrics"},
+			Allow:   []string{"cap:example.com/cap/*"},
+		}, {
+			Sources: []string{"bots"},
+			Allow:   []string{"tag:special"},
+		}, {
+			Sources: []string{"laptop*"},
+			Allow:   []string{"node:*.example.ts.net"},
+		}},
+		Default: "allow",
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatalf("Validate: unexpected error: %v", err)
+	}
+	auth := p.Authorize(t.Logf)
+	tests := []struct {
+		src string
+		rsp *apitype.WhoIsResponse
+		ok  bool
+	}{
+		{"other", loggedInUser, true}, // by default
+		{"other", taggedNode, false},  // deny overrides default
+		{"bots", taggedNode, false},   // deny overrides allow
+
+		{"prod", loggedInUser, true},     // allowed by pattern
+		{"prod-eu", loggedInUser, true},  // allowed by pattern
+		{"prod-eu", capUser, false},      // explicitly denied
+		{"metrics", capUser, true},       // allowed by capability
+		{"metrics", loggedInUser, false}, // restricted to the allow list
+		{"laptops", capUser, true},       // allowed by node name
+		{"laptops", loggedInUser, false}, // node name does not match
+	}
+	for _, tc := range tests {
+		err := auth(tc.src, tc.rsp)
+		if tc.ok && err != nil {
+			t.Errorf("Authorize %q: unexpected error: %v", tc.src, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("Authorize %q: got nil, want error", tc.src)
+		}
+	}
+
+	// With no default, callers not named by any rule are denied.
+	p.Default = ""
+	if err := p.Authorize(t.Logf)("other", loggedInUser); err == nil {
+		t.Error("Authorize other with no default: got nil, want error")
+	}
+}
+
+func TestPolicyPatterns(t *testing.T) {
+	tests := []struct {
+		pattern, src string
+		want         bool
+	}{
+		{"main", "main", true},
+		{"main", "mains", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"prod*", "prod", true},
+		{"prod*", "prod-1", true},
+		{"prod*", "dev-prod", false},
+		{"*-db", "users-db", true},
+		{"*-db", "users-db2", false},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "a-b-b-c", true},
+		{"a*b*c", "a-c-b", false},
+		{"**x", "x", true},
+
+		// Many stars must not take exponential time.
+		{strings.Repeat("*a", 30) + "*b", strings.Repeat("a", 100), false},
+		{strings.Repeat("*a", 30) + "*", strings.Repeat("a", 100), true},
+	}
+	for _, tc := range tests {
+		p := &authorizer.Policy{Rules: []authorizer.PolicyRule{
+			{Sources: []string{tc.pattern}, Allow: []string{"*"}},
+		}}
+		if got := p.Authorize(t.Logf)(tc.src, loggedInUser) == nil; got != tc.want {
+			t.Errorf("Match %q against %q: got %v, want %v", tc.pattern, tc.src, got, tc.want)
+		}
+	}
+}
+
+func TestPolicyUnmarshal(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  *authorizer.Policy // nil for an error
+	}{
+		{"Rules", `{"rules": [{"sources": ["main"], "allow": ["*"]}], "default": "deny"}`, &authorizer.Policy{
+			Rules:   []authorizer.PolicyRule{{Sources: []string{"main"}, Allow: []string{"*"}}},
+			Default: "deny",
+		}},
+		{"DefaultOnly", `{"default": "allow"}`, &authorizer.Policy{Default: "allow"}},
+		{"Map", `{"main": ["admin@example.com"], "closed": []}`, &authorizer.Policy{
+			Rules: []authorizer.PolicyRule{
+				{Sources: []string{"*"}, Deny: []string{"tag:*"}},
+				{Sources: []string{"closed"}, Deny: []string{"*"}},
+				{Sources: []string{"main"}, Allow: []string{"user:admin@example.com"}},
+			},
+			Default: "allow",
+		}},
+		{"EmptyMap", `{}`, &authorizer.Policy{
+			Rules:   []authorizer.PolicyRule{{Sources: []string{"*"}, Deny: []string{"tag:*"}}},
+			Default: "allow",
+		}},
+		{"UnknownField", `{"rules": [], "defualt": "allow"}`, nil},
+		{"UnknownRuleField", `{"rules": [{"sources": ["main"], "alow": ["*"]}]}`, nil},
+		{"BadMap", `{"main": "admin@example.com"}`, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got authorizer.Policy
+			err := json.Unmarshal([]byte(tc.input), &got)
+			if tc.want == nil {
+				if err == nil {
+					t.Errorf("Unmarshal: got %+v, want error", got)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("Unmarshal: unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(*tc.want, got); diff != "" {
+				t.Errorf("Unmarshal (-want, +got):\n%s", diff)
+			}
+			if err := got.Validate(); err != nil {
+				t.Errorf("Validate: unexpected error: %v", err)
+			}
+		})
+	}
+
+	// A policy read from a map has the same effect as the map.
+	m := authorizer.Map{"main": {"user@example.com"}, "alt": {"other@example.com"}}
+	mapAuth, policyAuth := m.Authorize(t.Logf), m.Policy().Authorize(t.Logf)
+	for _, src := range []string{"main", "alt", "other"} {
+		for _, who := range []*apitype.WhoIsResponse{loggedInUser, taggedNode} {
+			if got, want := policyAuth(src, who) == nil, mapAuth(src, who) == nil; got != want {
+				t.Errorf("Authorize %q for %q: got %v, want %v", src, who.UserProfile.LoginName, got, want)
+			}
+		}
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		p    authorizer.Policy
+		want string // error text, "" for valid
+	}{
+		{"Empty", authorizer.Policy{}, ""},
+		{"Valid", authorizer.Policy{
+			Rules: []authorizer.PolicyRule{{
+				Sources: []string{"main"},
+				Allow:   []string{"user@example.com", "tag:ops", "node:db*", "cap:example.com/cap/x"},
+			}},
+			Default: "deny",
+		}, ""},
+		{"BadDefault", authorizer.Policy{Default: "maybe"},
+			`invalid default "maybe" (want "allow" or "deny")`},
+		{"NoSources", authorizer.Policy{
+			Rules: []authorizer.PolicyRule{{Allow: []string{"*"}}},
+		}, "rule 1: no sources"},
+		{"EmptySource", authorizer.Policy{
+			Rules: []authorizer.PolicyRule{{Sources: []string{""}, Allow: []string{"*"}}},
+		}, "rule 1: empty source pattern"},
+		{"NoPrincipals", authorizer.Policy{
+			Rules: []authorizer.PolicyRule{
+				{Sources: []string{"main"}, Allow: []string{"*"}},
+				{Name: "oops", Sources: []string{"main"}},
+			},
+		}, `rule 2 ("oops"): no allow or deny principals`},
+		{"BadKind", authorizer.Policy{
+			Rules: []authorizer.PolicyRule{{Sources: []string{"main"}, Deny: []string{"group:eng"}}},
+		}, `rule 1: principal "group:eng": unknown kind "group"`},
+		{"EmptyPattern", authorizer.Policy{
+			Rules: []authorizer.PolicyRule{{Sources: []string{"main"}, Allow: []string{"tag:"}}},
+		}, `rule 1: principal "tag:": empty pattern`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.p.Validate()
+			if tc.want == "" {
+				if err != nil {
+					t.Errorf("Validate: unexpected error: %v", err)
+				}
+			} else if err == nil || err.Error() != tc.want {
+				t.Errorf("Validate: got %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	lg := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	auth := authorizer.ACLGrantsLogger(lg)
+	auth("main", loggedInUser)
+	auth("alt", loggedInUser)
+	authorizer.Map{"main": nil}.AuthorizeLogger(lg)("main", taggedNode)
+
+	want := `level=INFO msg=auth source=main caller=user@example.com allowed=true
+level=INFO msg=auth source=alt caller=user@example.com allowed=false error="not authorized for access to \"alt\""
+level=INFO msg=auth source=main caller=fake.ts.net allowed=false error="tagged nodes cannot query \"main\""
+`
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Errorf("Logs (-want, +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package authorizer
+
+import (
+	"log"
+	"log/slog"
+
+	"tailscale.com/types/logger"
+)
+
+// An authLogger logs the decision to grant or deny (if err != nil) caller
+// access to src.
+type authLogger func(src, caller string, err error)
+
+// logfAuth returns an authLogger that sends logs to logf, or to log.Printf if
+// logf == nil.
+func logfAuth(logf logger.Logf) authLogger {
+	if logf == nil {
+		logf = log.Printf
+	}
+	return func(src, caller string, err error) {
+		logf("[tailsql] auth src=%q who=%q err=%v", src, caller, err)
+	}
+}
+
+// slogAuth returns an authLogger that sends logs to lg, or to slog.Default()
+// if lg == nil.
+func slogAuth(lg *slog.Logger) authLogger {
+	if lg == nil {
+		lg = slog.Default()
+	}
+	return func(src, caller string, err error) {
+		if err != nil {
+			lg.Info("auth", "source", src, "caller", caller, "allowed", false, "error", err)
+		} else {
+			lg.Info("auth", "source", src, "caller", caller, "allowed", true)
+		}
+	}
+}
@@ -6,7 +6,8 @@ package authorizer
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
+	"maps"
 	"slices"
 
 	"tailscale.com/client/tailscale/apitype"
@@ -26,17 +27,43 @@ type Map map[string][]string
 //
 // If logf == nil, logs are sent to log.Printf.
 func (m Map) Authorize(logf logger.Logf) func(string, *apitype.WhoIsResponse) error {
-	if logf == nil {
-		logf = log.Printf
+	return m.authorize(logfAuth(logf))
+}
+
+// AuthorizeLogger is like Authorize, but sends structured logs to lg.
+// If lg == nil, logs are sent to slog.Default().
+func (m Map) AuthorizeLogger(lg *slog.Logger) func(string, *apitype.WhoIsResponse) error {
+	return m.authorize(slogAuth(lg))
+}
+
+// Policy returns an access policy with the same effect as m, provided that
+// the source labels and usernames in m do not contain "*", which a Policy
+// treats as a wildcard.
+func (m Map) Policy() *Policy {
+	p := &Policy{
+		Rules:   []PolicyRule{{Sources: []string{"*"}, Deny: []string{"tag:*"}}},
+		Default: "allow",
 	}
+	for _, src := range slices.Sorted(maps.Keys(m)) {
+		r := PolicyRule{Sources: []string{src}}
+		for _, user := range m[src] {
+			r.Allow = append(r.Allow, "user:"+user)
+		}
+		if len(r.Allow) == 0 {
+			r.Deny = []string{"*"} // no user is permitted
+		}
+		p.Rules = append(p.Rules, r)
+	}
+	return p
+}
+
+func (m Map) authorize(logAuth authLogger) func(string, *apitype.WhoIsResponse) error {
 	return func(src string, who *apitype.WhoIsResponse) (err error) {
 		caller := who.UserProfile.LoginName
 		if who.Node.IsTagged() {
 			caller = who.Node.Name
 		}
-		defer func() {
-			logf("[tailsql] auth src=%q who=%q err=%v", src, caller, err)
-		}()
+		defer func() { logAuth(src, caller, err) }()
 		if who.Node.IsTagged() {
 			return fmt.Errorf("tagged nodes cannot query %q", src)
 		}
@@ -0,0 +1,272 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package authorizer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/types/logger"
+)
+
+// A Policy is a declarative access policy, suitable for use in a JSON or
+// HuJSON configuration file. For example:
+//
+//	{
+//	  "rules": [
+//	    {"sources": ["*"], "deny": ["tag:*"]},
+//	    {"name": "admin", "sources": ["prod*"], "allow": ["*@example.com"], "deny": ["intern@example.com"]},
+//	    {"sources": ["metrics"], "allow": ["tag:monitoring", "cap:example.com/cap/metrics"]},
+//	  ],
+//	  "default": "allow",
+//	}
+//
+// To decide whether a caller may query a source, the policy considers each
+// rule whose Sources match the source:
+//
+//   - If the caller matches the Deny list of any of them, access is denied.
+//   - Otherwise, if the caller matches the Allow list of any of them, access
+//     is granted.
+//   - Otherwise, if any of them has a non-empty Allow list, access is denied:
+//     the source is restricted to the callers those lists name.
+//   - Otherwise, the Default decides.
+//
+// Use [Policy.Validate] to check a policy before use.
+//
+// For compatibility with older configuration files, a policy may also be
+// written as a [Map] from source names to the users allowed to query them,
+// for example {"main": ["admin@example.com"]} (see [Policy.UnmarshalJSON]).
+type Policy struct {
+	// Rules are the access rules of the policy.
+	Rules []PolicyRule `json:"rules"`
+
+	// Default is the decision for callers that no rule for the source names,
+	// either "allow" or "deny". If empty, "deny" is used.
+	Default string `json:"default,omitempty"`
+}
+
+// A PolicyRule grants or denies callers access to a set of sources.
+//
+// Source patterns and principals may contain "*", which matches any sequence
+// of characters, including none. A principal is one of:
+//
+//   - "user:PATTERN" or "PATTERN" matches a logged-in user by login name.
+//   - "tag:PATTERN" matches a tagged node having a tag that matches, for
+//     example "tag:prod*".
+//   - "node:PATTERN" matches the name of the caller's node, without the
+//     trailing dot, for example "node:*.example.ts.net".
+//   - "cap:PATTERN" matches a caller having a peer capability that matches.
+//
+// Users and tags are exclusive: "*" matches all logged-in users but not
+// tagged nodes, which are matched by "tag:*".
+type PolicyRule struct {
+	// Name, if set, identifies the rule in error messages.
+	Name string `json:"name,omitempty"`
+
+	// Sources are the patterns of source names the rule applies to.
+	Sources []string `json:"sources"`
+
+	// Allow lists the principals granted access to the sources.
+	Allow []string `json:"allow,omitempty"`
+
+	// Deny lists the principals denied access to the sources.
+	Deny []string `json:"deny,omitempty"`
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface. An object with a
+// "rules" or "default" field is decoded as a Policy, and other fields, in the
+// policy or its rules, are reported as errors. Any other object is decoded as
+// a Map, and converted as described by [Map.Policy].
+func (p *Policy) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	_, hasRules := fields["rules"]
+	_, hasDefault := fields["default"]
+	if !hasRules && !hasDefault {
+		var m Map
+		if err := json.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("policy has no rules or default, and is not a map of sources to users: %w", err)
+		}
+		*p = *m.Policy()
+		return nil
+	}
+
+	type policy Policy // without this method
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var v policy
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	*p = Policy(v)
+	return nil
+}
+
+// label returns a description of the rule at index i for error messages.
+func (r PolicyRule) label(i int) string {
+	if r.Name != "" {
+		return fmt.Sprintf("rule %d (%q)", i+1, r.Name)
+	}
+	return fmt.Sprintf("rule %d", i+1)
+}
+
+// Validate reports whether p is a valid policy. If not, the error names each
+// offending rule, counting from 1.
+func (p *Policy) Validate() error {
+	var errs []error
+	if p.Default != "" && p.Default != "allow" && p.Default != "deny" {
+		errs = append(errs, fmt.Errorf("invalid default %q (want \"allow\" or \"deny\")", p.Default))
+	}
+	for i, r := range p.Rules {
+		if err := r.checkValid(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.label(i), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r PolicyRule) checkValid() error {
+	if len(r.Sources) == 0 {
+		return errors.New("no sources")
+	}
+	if slices.Contains(r.Sources, "") {
+		return errors.New("empty source pattern")
+	}
+	if len(r.Allow) == 0 && len(r.Deny) == 0 {
+		return errors.New("no allow or deny principals")
+	}
+	for _, p := range slices.Concat(r.Allow, r.Deny) {
+		if _, _, err := parsePrincipal(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parsePrincipal splits a principal into its kind and pattern.
+func parsePrincipal(p string) (kind, pattern string, err error) {
+	kind, pattern, ok := strings.Cut(p, ":")
+	if !ok {
+		kind, pattern = "user", p
+	}
+	switch kind {
+	case "user", "tag", "node", "cap":
+	default:
+		return "", "", fmt.Errorf("principal %q: unknown kind %q", p, kind)
+	}
+	if pattern == "" {
+		return "", "", fmt.Errorf("principal %q: empty pattern", p)
+	}
+	if kind == "tag" {
+		pattern = "tag:" + pattern // node tags include the prefix
+	}
+	return kind, pattern, nil
+}
+
+// matchPrincipal reports whether who matches principal p.
+// Invalid principals match no caller.
+func matchPrincipal(p string, who *apitype.WhoIsResponse) bool {
+	kind, pattern, err := parsePrincipal(p)
+	if err != nil {
+		return false
+	}
+	switch kind {
+	case "user":
+		return !who.Node.IsTagged() && matchGlob(pattern, who.UserProfile.LoginName)
+	case "tag":
+		return slices.ContainsFunc(who.Node.Tags, func(tag string) bool {
+			return matchGlob(pattern, tag)
+		})
+	case "node":
+		return matchGlob(pattern, strings.TrimSuffix(who.Node.Name, "."))
+	case "cap":
+		for c := range who.CapMap {
+			if matchGlob(pattern, string(c)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchGlob reports whether s matches pattern, in which "*" matches any
+// sequence of characters and all other characters match themselves.
+//
+// On a mismatch, only the most recent "*" needs to consume another byte: any
+// match found by retrying an earlier one could be found from the later one.
+// So the cost is at most proportional to len(pattern) * len(s).
+func matchGlob(pattern, s string) bool {
+	var p, i int
+	star, next := -1, 0 // the last "*" seen, and where its match resumes in s
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, i
+			p++
+		case p < len(pattern) && pattern[p] == s[i]:
+			p++
+			i++
+		case star >= 0:
+			next++
+			p, i = star+1, next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// Authorize returns an authorization function suitable for tailsql.Options
+// that enforces p. The policy should be valid (see [Policy.Validate]).
+//
+// If logf == nil, logs are sent to log.Printf.
+func (p *Policy) Authorize(logf logger.Logf) func(string, *apitype.WhoIsResponse) error {
+	return p.authorize(logfAuth(logf))
+}
+
+// AuthorizeLogger is like Authorize, but sends structured logs to lg.
+// If lg == nil, logs are sent to slog.Default().
+func (p *Policy) AuthorizeLogger(lg *slog.Logger) func(string, *apitype.WhoIsResponse) error {
+	return p.authorize(slogAuth(lg))
+}
+
+func (p *Policy) authorize(logAuth authLogger) func(string, *apitype.WhoIsResponse) error {
+	return func(src string, who *apitype.WhoIsResponse) (err error) {
+		caller := who.UserProfile.LoginName
+		if who.Node.IsTagged() {
+			caller = who.Node.Name
+		}
+		defer func() { logAuth(src, caller, err) }()
+
+		matches := func(ps []string) bool {
+			return slices.ContainsFunc(ps, func(p string) bool { return matchPrincipal(p, who) })
+		}
+		var allowed, restricted bool
+		for i, r := range p.Rules {
+			if !slices.ContainsFunc(r.Sources, func(pat string) bool { return matchGlob(pat, src) }) {
+				continue
+			}
+			if matches(r.Deny) {
+				return fmt.Errorf("access to %q denied by %s", src, r.label(i))
+			}
+			allowed = allowed || matches(r.Allow)
+			restricted = restricted || len(r.Allow) != 0
+		}
+		if allowed || (!restricted && p.Default == "allow") {
+			return nil
+		}
+		return fmt.Errorf("not authorized for access to %q", src)
+	}
+}
@@ -7,6 +7,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"expvar"
 	"fmt"
@@ -16,9 +17,12 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/creachadair/command"
 	"github.com/creachadair/flax"
+	"github.com/tailscale/hujson"
+	"github.com/tailscale/tailsql/querycheck"
 	"github.com/tailscale/tailsql/server/tailsql"
 	"github.com/tailscale/tailsql/uirules"
 	"tailscale.com/atomicfile"
@@ -40,6 +44,8 @@ var flags struct {
 	ConfigPath string `flag:"config,Configuration file (HuJSON, required)"`
 	DebugLog   bool   `flag:"debug,Enable very verbose tsnet debug logging"`
 	InitConfig string `flag:"init-config,Generate a basic configuration file in the given path and exit"`
+
+	ReloadInterval time.Duration `flag:"reload-interval,If positive, check the config file for changes at this interval"`
 }
 
 func main() {
@@ -53,6 +59,10 @@ func main() {
 If --local > 0, the service is run on localhost at that port.
 Otherwise, the server starts a Tailscale node at the configured hostname.
 
+The server reloads its --config file when it receives SIGHUP. If
+--reload-interval is positive, it also reloads the file when its modification
+time changes.
+
 When run with --init-config set, %[1]s generates an example configuration file
 with defaults suitable for running a local service and then exits.`,
 
@@ -67,20 +77,11 @@ with defaults suitable for running a local service and then exits.`,
 			}
 
 			// For all the cases below, we need a valid configuration file.
-			data, err := os.ReadFile(flags.ConfigPath)
+			opts, err := loadConfig(flags.ConfigPath)
 			if err != nil {
-				return fmt.Errorf("reading tailsql config: %w", err)
-			}
-			var opts tailsql.Options
-			if err := tailsql.UnmarshalOptions(data, &opts); err != nil {
-				return fmt.Errorf("parsing tailsql config: %w", err)
+				return err
 			}
 			opts.Metrics = expvar.NewMap("tailsql")
-			opts.UIRewriteRules = []tailsql.UIRewriteRule{
-				uirules.FormatSQLSource,
-				uirules.FormatJSONText,
-				uirules.LinkURLText,
-			}
 
 			ctx, cancel := signal.NotifyContext(env.Context(), syscall.SIGINT, syscall.SIGTERM)
 			defer cancel()
@@ -100,11 +101,100 @@ with defaults suitable for running a local service and then exits.`,
 	command.RunOrFail(root.NewEnv(nil), os.Args[1:])
 }
 
+// loadConfig reads and parses the configuration file at path.
+func loadConfig(path string) (tailsql.Options, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return tailsql.Options{}, fmt.Errorf("reading tailsql config: %w", err)
+	}
+	var opts tailsql.Options
+	if err := tailsql.UnmarshalOptions(data, &opts); err != nil {
+		return tailsql.Options{}, fmt.Errorf("parsing tailsql config: %w", err)
+	}
+	opts.UIRewriteRules = []tailsql.UIRewriteRule{
+		uirules.FormatSQLSource,
+		uirules.FormatJSONText,
+		uirules.LinkURLText,
+	}
+
+	// The query check rule, if any, is in the same file. It is applied in
+	// addition to the default checks.
+	var extra struct {
+		QueryCheck *querycheck.Rule `json:"queryCheck"`
+	}
+	if std, err := hujson.Standardize(data); err != nil {
+		return tailsql.Options{}, fmt.Errorf("parsing tailsql config: %w", err)
+	} else if err := json.Unmarshal(std, &extra); err != nil {
+		return tailsql.Options{}, fmt.Errorf("parsing query check rule: %w", err)
+	}
+	if extra.QueryCheck != nil {
+		check, err := extra.QueryCheck.Checker()
+		if err != nil {
+			return tailsql.Options{}, fmt.Errorf("invalid query check rule: %w", err)
+		}
+		opts.CheckQuery = querycheck.All(tailsql.DefaultCheckQuery, check)
+	}
+	return opts, nil
+}
+
+// reloadConfig reloads the configuration of tsql from path whenever the
+// process receives SIGHUP, or, if interval > 0, when the modification time of
+// the file changes. It runs until ctx ends.
+func reloadConfig(ctx context.Context, tsql *tailsql.Server, path string, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var poll <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		poll = t.C
+	}
+	modTime := func() time.Time {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}
+		}
+		return fi.ModTime()
+	}
+
+	last := modTime()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Print("Signal received, reloading config")
+			last = modTime()
+		case <-poll:
+			mt := modTime()
+			if mt.IsZero() || mt.Equal(last) {
+				continue
+			}
+			last = mt
+			log.Print("Config file changed, reloading")
+		}
+
+		opts, err := loadConfig(path)
+		if err != nil {
+			log.Printf("Reloading config: %v", err)
+			continue
+		}
+		if err := tsql.Reload(ctx, opts); err != nil {
+			log.Printf("Reloading config: %v", err)
+		} else {
+			log.Print("Config reloaded")
+		}
+	}
+}
+
 func runLocalService(ctx context.Context, opts tailsql.Options, port int) error {
 	tsql, err := tailsql.NewServer(opts)
 	if err != nil {
 		return fmt.Errorf("creating tailsql server: %w", err)
 	}
+	go reloadConfig(ctx, tsql, flags.ConfigPath, flags.ReloadInterval)
 
 	mux := tsql.NewMux()
 	tsweb.Debugger(mux)
@@ -116,10 +206,22 @@ func runLocalService(ctx context.Context, opts tailsql.Options, port int) error
 	go func() {
 		<-ctx.Done()
 		log.Print("Signal received, stopping")
-		hsrv.Shutdown(context.Background()) // ctx is already terminated
-		tsql.Close()
+
+		// Drain tsql first, so requests that arrive meanwhile are refused
+		// rather than dropped. ctx is already terminated.
+		sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := tsql.Shutdown(sctx); err != nil {
+			log.Printf("Shutting down tailsql: %v", err)
+		}
+		hsrv.Shutdown(sctx)
 	}()
 	log.Printf("Starting local tailsql at http://%s", hsrv.Addr+opts.RoutePrefix)
+	go func() {
+		if waitReady(ctx, tsql) == nil {
+			log.Printf("TailSQL started")
+		}
+	}()
 	if err := hsrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
@@ -159,6 +261,7 @@ func runTailscaleService(ctx context.Context, opts tailsql.Options) error {
 	if err != nil {
 		return fmt.Errorf("creating tailsql server: %w", err)
 	}
+	go reloadConfig(ctx, tsql, flags.ConfigPath, flags.ReloadInterval)
 
 	lst, err := tsNode.Listen("tcp", ":80")
 	if err != nil {
@@ -191,12 +294,43 @@ func runTailscaleService(ctx context.Context, opts tailsql.Options) error {
 	mux := tsql.NewMux()
 	tsweb.Debugger(mux)
 	go http.Serve(lst, mux)
-	log.Printf("TailSQL started")
+	if waitReady(ctx, tsql) == nil {
+		log.Printf("TailSQL started")
+	}
 	<-ctx.Done()
 	log.Print("TailSQL shutting down...")
+	sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := tsql.Shutdown(sctx); err != nil {
+		log.Printf("Shutting down tailsql: %v", err)
+	}
 	return tsNode.Close()
 }
 
+// shutdownTimeout bounds how long the service waits for queries in progress
+// to finish when it is asked to stop.
+const shutdownTimeout = 30 * time.Second
+
+// waitReady waits until tsql is ready to serve queries, or until ctx ends.
+// While it waits, it logs the reasons tsql is not ready when they change.
+func waitReady(ctx context.Context, tsql *tailsql.Server) error {
+	var last string
+	for {
+		err := tsql.Ready(ctx)
+		if err == nil {
+			return nil
+		} else if msg := err.Error(); msg != last {
+			log.Printf("Waiting for readiness: %v", err)
+			last = msg
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
 //go:embed sample.tmpl
 var sampleConfig string
 
@@ -3,6 +3,7 @@ module github.com/tailscale/tailsql
 go 1.26.2
 
 require (
+	filippo.io/age v1.2.1
 	github.com/creachadair/command v0.2.2
 	github.com/creachadair/flax v0.0.5
 	github.com/google/go-cmp v0.7.0
@@ -0,0 +1,405 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package querycheck defines composable query checks for use with the
+// CheckQuery option of the tailsql server package.
+//
+// Each check is a [Checker], a function that accepts or rejects a query and
+// may rewrite it. Use [All] and [Any] to combine checks, and [ForSources] to
+// apply a check only to some data sources. A [Rule] describes a combination
+// of checks in a form that can be read from a HuJSON configuration file.
+//
+// Checks that inspect the text of a query scan it using the SQL dialect of
+// the driver for the source (see [tailsql.Query]). If the dialect of the
+// driver is not known, the query must pass when scanned by the rules of each
+// known dialect (see [sqllex.Dialect.Candidates]). Named queries and
+// meta-queries are defined by the server operator, so their text is not
+// inspected by these checks.
+package querycheck
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/tailscale/tailsql/server/tailsql"
+	"github.com/tailscale/tailsql/sqllex"
+)
+
+// A Checker checks a query presented to the server. If it reports an error,
+// the query is rejected; otherwise the returned query is used in its place.
+// A Checker has the same signature as the CheckQuery field of the server
+// options, and can be used for it directly.
+type Checker = func(tailsql.Query) (tailsql.Query, error)
+
+// All returns a Checker that applies each of cs in order, passing the query
+// returned by each to the next. It fails if any of cs fails. If cs is empty,
+// All accepts all queries unchanged.
+func All(cs ...Checker) Checker {
+	return func(q tailsql.Query) (tailsql.Query, error) {
+		for _, c := range cs {
+			var err error
+			q, err = c(q)
+			if err != nil {
+				return q, err
+			}
+		}
+		return q, nil
+	}
+}
+
+// Any returns a Checker that applies each of cs in order to the original
+// query, and returns the result of the first that succeeds. If all of cs
+// fail, the check fails with their combined errors. If cs is empty, Any
+// rejects all queries.
+func Any(cs ...Checker) Checker {
+	return func(q tailsql.Query) (tailsql.Query, error) {
+		var errs []error
+		for _, c := range cs {
+			out, err := c(q)
+			if err == nil {
+				return out, nil
+			}
+			errs = append(errs, err)
+		}
+		if len(errs) == 0 {
+			return q, errors.New("no checks accept the query")
+		}
+		return q, errors.Join(errs...)
+	}
+}
+
+// ForSources returns a Checker that applies c to queries for a source whose
+// name matches any of the given patterns, and accepts all other queries
+// unchanged. Patterns use the syntax of [path.Match].
+func ForSources(c Checker, patterns ...string) Checker {
+	return func(q tailsql.Query) (tailsql.Query, error) {
+		if matchAny(patterns, q.Source) {
+			return c(q)
+		}
+		return q, nil
+	}
+}
+
+func matchAny(patterns []string, name string) bool {
+	return slices.ContainsFunc(patterns, func(p string) bool {
+		ok, _ := path.Match(p, name)
+		return ok
+	})
+}
+
+// MaxLength returns a Checker that rejects queries whose text is longer than
+// n bytes.
+func MaxLength(n int) Checker {
+	return func(q tailsql.Query) (tailsql.Query, error) {
+		if len(q.Query) > n {
+			return q, fmt.Errorf("query too long (%d > %d bytes)", len(q.Query), n)
+		}
+		return q, nil
+	}
+}
+
+// NamedOnly returns a Checker that accepts only named queries and
+// meta-queries.
+func NamedOnly() Checker {
+	return func(q tailsql.Query) (tailsql.Query, error) {
+		if !isSQL(q) || q.Query == "" {
+			return q, nil
+		}
+		return q, fmt.Errorf("source %q allows only named queries", q.Source)
+	}
+}
+
+// AllowStatements returns a Checker that accepts a query only if each of its
+// statements begins with one of the given keywords, such as "SELECT" or
+// "WITH". Keywords are compared without regard to case.
+func AllowStatements(keywords ...string) Checker {
+	return checkStatements(func(kw string) bool {
+		return slices.ContainsFunc(keywords, func(s string) bool { return strings.EqualFold(s, kw) })
+	})
+}
+
+// DenyStatements returns a Checker that rejects a query if any of its
+// statements begins with one of the given keywords, such as "PRAGMA".
+// Keywords are compared without regard to case.
+func DenyStatements(keywords ...string) Checker {
+	return checkStatements(func(kw string) bool {
+		return !slices.ContainsFunc(keywords, func(s string) bool { return strings.EqualFold(s, kw) })
+	})
+}
+
+func checkStatements(ok func(keyword string) bool) Checker {
+	return forEachStatement(func(stmt []sqllex.Token) error {
+		first := stmt[0]
+		if first.Kind == sqllex.Punct && first.Text == "(" {
+			// A parenthesized query, e.g., (SELECT ...) UNION (SELECT ...).
+			for _, t := range stmt {
+				if t.Kind == sqllex.Word {
+					first = t
+					break
+				}
+			}
+		}
+		if first.Kind != sqllex.Word || !ok(first.Text) {
+			return fmt.Errorf("at %v: statement %q is not allowed", first.Pos, strings.ToUpper(first.Text))
+		}
+		return nil
+	})
+}
+
+// RequireLimit returns a Checker that rejects a query if any of its SELECT
+// statements (including those beginning with WITH or VALUES) lacks a LIMIT
+// or FETCH clause outside of parentheses. Other statements are accepted.
+func RequireLimit() Checker {
+	return forEachStatement(func(stmt []sqllex.Token) error {
+		switch {
+		case stmt[0].Is("SELECT"), stmt[0].Is("WITH"), stmt[0].Is("VALUES"),
+			stmt[0].Kind == sqllex.Punct && stmt[0].Text == "(":
+		default:
+			return nil
+		}
+		depth := 0
+		for _, t := range stmt {
+			switch {
+			case t.Kind == sqllex.Punct && t.Text == "(":
+				depth++
+			case t.Kind == sqllex.Punct && t.Text == ")":
+				depth--
+			case depth == 0 && (t.Is("LIMIT") || t.Is("FETCH")):
+				return nil
+			}
+		}
+		return fmt.Errorf("at %v: query must have a LIMIT clause", stmt[0].Pos)
+	})
+}
+
+// NoSelectStar returns a Checker that rejects a query that selects all
+// columns (SELECT * or SELECT t.*) from a statement that reads any of the
+// given tables. Table names are compared without regard to case, and match
+// either a qualified name (e.g., "main.users") or its last component. The
+// check is approximate: it looks for the tables after FROM and JOIN.
+func NoSelectStar(tables ...string) Checker {
+	banned := func(name string) bool {
+		return slices.ContainsFunc(tables, func(t string) bool {
+			if strings.EqualFold(t, name) {
+				return true
+			}
+			_, last, ok := cutLast(name)
+			return ok && strings.EqualFold(t, last)
+		})
+	}
+	return forEachStatement(func(stmt []sqllex.Token) error {
+		var star *sqllex.Token
+		for i, t := range stmt {
+			if t.Kind != sqllex.Punct || t.Text != "*" || i == 0 {
+				continue
+			}
+			prev := stmt[i-1]
+			if prev.Is("SELECT") || prev.Is("DISTINCT") || prev.Is("ALL") ||
+				(prev.Kind == sqllex.Punct && (prev.Text == "," || prev.Text == ".")) {
+				star = &stmt[i]
+				break
+			}
+		}
+		if star == nil {
+			return nil
+		}
+		for _, name := range tableNames(stmt) {
+			if banned(name) {
+				return fmt.Errorf("at %v: selecting all columns of %q is not allowed", star.Pos, name)
+			}
+		}
+		return nil
+	})
+}
+
+// tableNames returns the names that appear as table references after FROM
+// or JOIN in stmt, or in a comma-separated list following FROM.
+func tableNames(stmt []sqllex.Token) []string {
+	var out []string
+	inFrom := false
+	for i := 0; i < len(stmt); i++ {
+		t := stmt[i]
+		switch {
+		case t.Is("FROM") || t.Is("JOIN"):
+			inFrom = t.Is("FROM")
+		case inFrom && t.Kind == sqllex.Punct && t.Text == ",":
+		case t.Kind == sqllex.Word && isClause(t):
+			inFrom = false
+			continue
+		default:
+			continue
+		}
+		name, n := qualifiedName(stmt[i+1:])
+		if n > 0 {
+			out = append(out, name)
+			i += n
+		}
+	}
+	return out
+}
+
+// isClause reports whether t is a keyword that ends a FROM clause.
+func isClause(t sqllex.Token) bool {
+	for _, kw := range []string{
+		"WHERE", "GROUP", "HAVING", "ORDER", "LIMIT", "UNION", "INTERSECT",
+		"EXCEPT", "WINDOW", "ON", "USING", "SELECT",
+	} {
+		if t.Is(kw) {
+			return true
+		}
+	}
+	return false
+}
+
+// qualifiedName parses a possibly-qualified name, such as a.b."c", from the
+// front of toks. It returns the name with quotes removed and the number of
+// tokens consumed, or 0 if toks does not begin with a name.
+func qualifiedName(toks []sqllex.Token) (string, int) {
+	var parts []string
+	n := 0
+	for n < len(toks) {
+		t := toks[n]
+		if t.Kind != sqllex.Word && t.Kind != sqllex.QuotedIdent {
+			break
+		}
+		parts = append(parts, unquote(t))
+		n++
+		if n < len(toks) && toks[n].Kind == sqllex.Punct && toks[n].Text == "." {
+			n++
+			continue
+		}
+		break
+	}
+	if len(parts) == 0 {
+		return "", 0
+	}
+	return strings.Join(parts, "."), n
+}
+
+func cutLast(name string) (string, string, bool) {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		return name[:i], name[i+1:], true
+	}
+	return "", name, false
+}
+
+// unquote returns the name denoted by a word or quoted identifier.
+func unquote(t sqllex.Token) string {
+	if t.Kind != sqllex.QuotedIdent || len(t.Text) < 2 {
+		return t.Text
+	}
+	q, body := t.Text[0], t.Text[1:len(t.Text)-1]
+	if q == '[' {
+		return body
+	}
+	return strings.ReplaceAll(body, string([]byte{q, q}), string(q))
+}
+
+// DenyFunctions returns a Checker that rejects a query that calls any of the
+// named functions. Names are compared without regard to case.
+func DenyFunctions(names ...string) Checker {
+	return checkFunctions(func(string) []string { return names })
+}
+
+// DangerousFunctions returns a Checker that rejects a query that calls a
+// function known to be dangerous for the driver of the query's source, such
+// as functions that read or write files on the database server, load code,
+// or stall the connection. For a driver whose dialect is not known, it
+// rejects the functions of all the known dialects.
+func DangerousFunctions() Checker {
+	return checkFunctions(func(driver string) []string {
+		if fs, ok := dangerousFuncs[sqllex.ForDriver(driver)]; ok {
+			return fs
+		}
+		var all []string
+		for _, fs := range dangerousFuncs {
+			all = append(all, fs...)
+		}
+		return all
+	})
+}
+
+var dangerousFuncs = map[sqllex.Dialect][]string{
+	sqllex.SQLite: {
+		"load_extension", "readfile", "writefile", "edit", "fsdir", "zipfile",
+		"fts3_tokenizer",
+	},
+	sqllex.PostgreSQL: {
+		"pg_read_file", "pg_read_binary_file", "pg_ls_dir", "pg_stat_file",
+		"pg_ls_logdir", "pg_ls_waldir", "pg_ls_tmpdir", "lo_import", "lo_export",
+		"dblink", "dblink_exec", "dblink_connect", "pg_sleep", "pg_sleep_for",
+		"pg_sleep_until", "pg_terminate_backend", "pg_cancel_backend",
+		"pg_reload_conf", "set_config",
+	},
+	sqllex.MySQL: {
+		"load_file", "sleep", "benchmark", "sys_exec", "sys_eval", "get_lock",
+	},
+}
+
+func checkFunctions(names func(driver string) []string) Checker {
+	return func(q tailsql.Query) (tailsql.Query, error) {
+		if !isSQL(q) {
+			return q, nil
+		}
+		deny := names(q.Driver)
+		for _, d := range sqllex.ForDriver(q.Driver).Candidates() {
+			toks := significant(sqllex.Scan(d, q.Query))
+			for i, t := range toks {
+				if t.Kind != sqllex.Word && t.Kind != sqllex.QuotedIdent {
+					continue
+				} else if i+1 >= len(toks) || toks[i+1].Kind != sqllex.Punct || toks[i+1].Text != "(" {
+					continue // not a call
+				}
+				name := unquote(t)
+				if slices.ContainsFunc(deny, func(s string) bool { return strings.EqualFold(s, name) }) {
+					return q, fmt.Errorf("at %v: function %q is not allowed", t.Pos, name)
+				}
+			}
+		}
+		return q, nil
+	}
+}
+
+// forEachStatement returns a Checker that calls check for each non-empty
+// statement of the query, with comments and whitespace removed, and fails if
+// any call reports an error. Queries that cannot be scanned are rejected. If
+// the dialect of the driver is not known, the query is scanned by the rules
+// of each of its candidate dialects in turn.
+func forEachStatement(check func([]sqllex.Token) error) Checker {
+	return func(q tailsql.Query) (tailsql.Query, error) {
+		if !isSQL(q) {
+			return q, nil
+		}
+		for _, d := range sqllex.ForDriver(q.Driver).Candidates() {
+			toks := sqllex.Scan(d, q.Query)
+			if n := len(toks); n != 0 && toks[n-1].Kind == sqllex.Invalid {
+				return q, fmt.Errorf("at %v: unterminated quote or comment", toks[n-1].Pos)
+			}
+			for _, stmt := range sqllex.Statements(toks) {
+				if err := check(stmt); err != nil {
+					return q, err
+				}
+			}
+		}
+		return q, nil
+	}
+}
+
+func significant(toks []sqllex.Token) []sqllex.Token {
+	out := toks[:0:0]
+	for _, t := range toks {
+		if t.Significant() {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// isSQL reports whether the text of q is SQL to be sent to the database, as
+// opposed to a named query or meta-query.
+func isSQL(q tailsql.Query) bool {
+	return !strings.HasPrefix(q.Query, "named:") && !strings.HasPrefix(q.Query, "meta:")
+}
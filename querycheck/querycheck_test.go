@@ -0,0 +1,200 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package querycheck_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/tailscale/tailsql/querycheck"
+	"github.com/tailscale/tailsql/server/tailsql"
+)
+
+type checkTest struct {
+	src, driver, query string
+	ok                 bool
+}
+
+func runChecks(t *testing.T, c querycheck.Checker, tests []checkTest) {
+	t.Helper()
+	for _, tc := range tests {
+		_, err := c(tailsql.Query{Source: tc.src, Driver: tc.driver, Query: tc.query})
+		if tc.ok && err != nil {
+			t.Errorf("Check %s %q: unexpected error: %v", tc.src, tc.query, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("Check %s %q: unexpectedly passed", tc.src, tc.query)
+		}
+	}
+}
+
+func TestMaxLength(t *testing.T) {
+	runChecks(t, querycheck.MaxLength(10), []checkTest{
+		{"a", "", "", true},
+		{"a", "", "select 1", true},
+		{"a", "", "select 12345", false},
+	})
+}
+
+func TestStatements(t *testing.T) {
+	t.Run("Allow", func(t *testing.T) {
+		runChecks(t, querycheck.AllowStatements("select", "WITH"), []checkTest{
+			{"a", "sqlite", "", true},
+			{"a", "sqlite", "SELECT 1; with x as (select 2) select * from x;", true},
+			{"a", "sqlite", "(select 1) union (select 2)", true},
+			{"a", "sqlite", "select 1; delete from t", false},
+			{"a", "sqlite", "/* select */ pragma table_info(t)", false},
+			{"a", "sqlite", "named:anything", true},
+			{"a", "sqlite", "meta:sources", true},
+		})
+	})
+	t.Run("Deny", func(t *testing.T) {
+		runChecks(t, querycheck.DenyStatements("PRAGMA", "explain"), []checkTest{
+			{"a", "sqlite", "select 'pragma'", true},
+			{"a", "sqlite", "select 1; pragma table_info(t)", false},
+			{"a", "sqlite", "-- comment\n  EXPLAIN select 1", false},
+			{"a", "sqlite", "select 'open", false},
+			{"a", "snowflake", "select [it's] ; pragma x --'", false},
+			{"a", "snowflake", "select `it's`; pragma x --'", false},
+			{"a", "snowflake", "select 'pragma' from t", true},
+		})
+	})
+}
+
+func TestRequireLimit(t *testing.T) {
+	runChecks(t, querycheck.RequireLimit(), []checkTest{
+		{"a", "sqlite", "select * from t limit 5", true},
+		{"a", "sqlite", "select * from t", false},
+		{"a", "sqlite", "select * from (select * from t limit 5)", false},
+		{"a", "sqlite", "with x as (select 1) select * from x limit 1", true},
+		{"a", "postgres", "select * from t fetch first 5 rows only", true},
+		{"a", "sqlite", "select 'limit' from t", false},
+		{"a", "sqlite", "pragma table_info(t)", true},
+	})
+}
+
+func TestNoSelectStar(t *testing.T) {
+	runChecks(t, querycheck.NoSelectStar("users", "main.secrets"), []checkTest{
+		{"a", "sqlite", "select name from users", true},
+		{"a", "sqlite", "select count(*) from users", true},
+		{"a", "sqlite", "select a * b from users", true},
+		{"a", "sqlite", "select * from other", true},
+		{"a", "sqlite", "select * from users", false},
+		{"a", "sqlite", `select * from "USERS" where 1`, false},
+		{"a", "sqlite", "select distinct * from main.users", false},
+		{"a", "sqlite", "select u.* from other o join users u on o.id = u.id", false},
+		{"a", "sqlite", "select o.id, * from other o, users", false},
+		{"a", "sqlite", "select * from main.secrets", false},
+		{"a", "sqlite", "select * from secrets", true},
+	})
+}
+
+func TestNamedOnly(t *testing.T) {
+	c := querycheck.ForSources(querycheck.NamedOnly(), "hr-*")
+	runChecks(t, c, []checkTest{
+		{"hr-main", "", "", true},
+		{"hr-main", "", "named:salaries", true},
+		{"hr-main", "", "select * from salaries", false},
+		{"eng", "", "select * from builds", true},
+	})
+}
+
+func TestFunctions(t *testing.T) {
+	t.Run("Deny", func(t *testing.T) {
+		runChecks(t, querycheck.DenyFunctions("upper"), []checkTest{
+			{"a", "sqlite", "select lower(x) from t", true},
+			{"a", "sqlite", "select 'upper(x)', upper from t", true},
+			{"a", "sqlite", "select UPPER (x) from t", false},
+		})
+	})
+	t.Run("Dangerous", func(t *testing.T) {
+		runChecks(t, querycheck.DangerousFunctions(), []checkTest{
+			{"a", "sqlite", "select load_extension('x')", false},
+			{"a", "sqlite", "select sleep(1)", true},
+			{"a", "postgres", `select pg_catalog."pg_read_file"('/etc/passwd')`, false},
+			{"a", "postgres", "select $$pg_sleep(1)$$", true},
+			{"a", "mysql", "select /*! sleep(10) */ 1", false},
+			{"a", "mysql", "select load_extension('x')", true},
+			{"a", "snowflake", "select pg_sleep(1)", false},
+			{"a", "snowflake", "select [it's], load_file('/etc/passwd') --'", false},
+			{"a", "snowflake", "select `it's`, sleep(10) --'", false},
+		})
+	})
+}
+
+func TestCombinators(t *testing.T) {
+	errBad := errors.New("bad")
+	reject := func(q tailsql.Query) (tailsql.Query, error) { return q, errBad }
+	rewrite := func(q tailsql.Query) (tailsql.Query, error) {
+		q.Query = strings.ToUpper(q.Query)
+		return q, nil
+	}
+
+	t.Run("All", func(t *testing.T) {
+		q, err := querycheck.All(rewrite, querycheck.MaxLength(20))(tailsql.Query{Query: "select 1"})
+		if err != nil || q.Query != "SELECT 1" {
+			t.Errorf("All: got %+v, %v; want rewritten query", q, err)
+		}
+		if _, err := querycheck.All(rewrite, reject)(tailsql.Query{}); !errors.Is(err, errBad) {
+			t.Errorf("All: got %v, want %v", err, errBad)
+		}
+		if _, err := querycheck.All()(tailsql.Query{}); err != nil {
+			t.Errorf("All(): unexpected error: %v", err)
+		}
+	})
+	t.Run("Any", func(t *testing.T) {
+		q, err := querycheck.Any(reject, rewrite)(tailsql.Query{Query: "select 1"})
+		if err != nil || q.Query != "SELECT 1" {
+			t.Errorf("Any: got %+v, %v; want rewritten query", q, err)
+		}
+		if _, err := querycheck.Any(reject, reject)(tailsql.Query{}); !errors.Is(err, errBad) {
+			t.Errorf("Any: got %v, want %v", err, errBad)
+		}
+		if _, err := querycheck.Any()(tailsql.Query{}); err == nil {
+			t.Error("Any(): unexpectedly passed")
+		}
+	})
+}
+
+func TestParseRule(t *testing.T) {
+	c, err := querycheck.ParseRule([]byte(`{
+	  // Applies to all sources.
+	  "maxLength": 100,
+	  "dangerousFunctions": true,
+	  "all": [
+	    {"sources": ["main"], "allowStatements": ["select"], "requireLimit": true},
+	    {"sources": ["hr"], "namedOnly": true},
+	  ],
+	  "any": [
+	    {"requireLimit": true},
+	    {"allowStatements": ["pragma"]},
+	  ],
+	}`))
+	if err != nil {
+		t.Fatalf("ParseRule: unexpected error: %v", err)
+	}
+	runChecks(t, c, []checkTest{
+		{"main", "sqlite", "select * from t limit 1", true},
+		{"main", "sqlite", "select * from t", false},
+		{"main", "sqlite", "select '" + strings.Repeat("x", 100) + "' limit 1", false},
+		{"main", "sqlite", "select load_extension('x') limit 1", false},
+		{"hr", "sqlite", "select 1", false},
+		{"hr", "sqlite", "named:report", true},
+		{"other", "sqlite", "pragma table_info(t)", true},
+		{"other", "sqlite", "select 1 limit 1", true},
+		{"other", "sqlite", "select 1", false},
+	})
+
+	for _, bad := range []string{
+		`{"maxLength": -1}`,
+		`{"sources": ["["]}`,
+		`{"all": [{"any": [{"maxLength": -5}]}]}`,
+		`{"maxLength": "long"}`,
+		`{`,
+	} {
+		if _, err := querycheck.ParseRule([]byte(bad)); err == nil {
+			t.Errorf("ParseRule %s: got nil, want error", bad)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package querycheck
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/tailscale/hujson"
+)
+
+// A Rule describes a combination of checks, in a form that can be read from
+// a HuJSON configuration file. For example:
+//
+//	{
+//	  "maxLength": 4000,
+//	  "all": [
+//	    {"sources": ["main"], "allowStatements": ["SELECT", "WITH"], "requireLimit": true},
+//	    {"sources": ["hr-*"], "namedOnly": true},
+//	    {"dangerousFunctions": true},
+//	  ],
+//	}
+//
+// The checks set in a rule must all succeed for the rule to accept a query.
+// The checks are applied in the order of the fields below.
+type Rule struct {
+	// If non-empty, the rule applies only to queries for sources that match
+	// one of these patterns (see [ForSources]). Queries for other sources are
+	// accepted unchanged.
+	Sources []string `json:"sources,omitempty"`
+
+	MaxLength          int      `json:"maxLength,omitempty"`          // see MaxLength
+	NamedOnly          bool     `json:"namedOnly,omitempty"`          // see NamedOnly
+	AllowStatements    []string `json:"allowStatements,omitempty"`    // see AllowStatements
+	DenyStatements     []string `json:"denyStatements,omitempty"`     // see DenyStatements
+	RequireLimit       bool     `json:"requireLimit,omitempty"`       // see RequireLimit
+	NoSelectStar       []string `json:"noSelectStar,omitempty"`       // see NoSelectStar
+	DenyFunctions      []string `json:"denyFunctions,omitempty"`      // see DenyFunctions
+	DangerousFunctions bool     `json:"dangerousFunctions,omitempty"` // see DangerousFunctions
+
+	All []Rule `json:"all,omitempty"` // all of these rules must accept the query
+	Any []Rule `json:"any,omitempty"` // at least one of these rules must accept the query
+}
+
+// Checker returns a Checker that implements r. It reports an error if r is
+// not valid.
+func (r Rule) Checker() (Checker, error) {
+	for _, p := range r.Sources {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid source pattern %q: %w", p, err)
+		}
+	}
+	if r.MaxLength < 0 {
+		return nil, errors.New("maxLength must not be negative")
+	}
+
+	var cs []Checker
+	if r.MaxLength > 0 {
+		cs = append(cs, MaxLength(r.MaxLength))
+	}
+	if r.NamedOnly {
+		cs = append(cs, NamedOnly())
+	}
+	if len(r.AllowStatements) != 0 {
+		cs = append(cs, AllowStatements(r.AllowStatements...))
+	}
+	if len(r.DenyStatements) != 0 {
+		cs = append(cs, DenyStatements(r.DenyStatements...))
+	}
+	if r.RequireLimit {
+		cs = append(cs, RequireLimit())
+	}
+	if len(r.NoSelectStar) != 0 {
+		cs = append(cs, NoSelectStar(r.NoSelectStar...))
+	}
+	if len(r.DenyFunctions) != 0 {
+		cs = append(cs, DenyFunctions(r.DenyFunctions...))
+	}
+	if r.DangerousFunctions {
+		cs = append(cs, DangerousFunctions())
+	}
+	for i, sub := range r.All {
+		c, err := sub.Checker()
+		if err != nil {
+			return nil, fmt.Errorf("all[%d]: %w", i, err)
+		}
+		cs = append(cs, c)
+	}
+	if len(r.Any) != 0 {
+		var alts []Checker
+		for i, sub := range r.Any {
+			c, err := sub.Checker()
+			if err != nil {
+				return nil, fmt.Errorf("any[%d]: %w", i, err)
+			}
+			alts = append(alts, c)
+		}
+		cs = append(cs, Any(alts...))
+	}
+
+	c := All(cs...)
+	if len(r.Sources) != 0 {
+		c = ForSources(c, r.Sources...)
+	}
+	return c, nil
+}
+
+// ParseRule parses a HuJSON representation of a Rule and returns a Checker
+// that implements it.
+func ParseRule(data []byte) (Checker, error) {
+	data, err := hujson.Standardize(data)
+	if err != nil {
+		return nil, err
+	}
+	var r Rule
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	return r.Checker()
+}
@@ -0,0 +1,75 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tailsql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// DefaultAnnotation is a suggested value for DBSpec.Annotation.
+const DefaultAnnotation = "tailsql user={user} src={src} req={req}"
+
+// annotationVar matches a variable in an annotation format.
+var annotationVar = regexp.MustCompile(`\{[^{}]*\}`)
+
+// annotationVars are the variables that may occur in an annotation format.
+var annotationVars = []string{"{user}", "{node}", "{src}", "{req}"}
+
+// checkAnnotation reports whether format is a valid annotation format.
+func checkAnnotation(format string) error {
+	if strings.Contains(format, "/*") || strings.Contains(format, "*/") {
+		return errors.New("annotation must not contain comment delimiters")
+	}
+	for _, v := range annotationVar.FindAllString(format, -1) {
+		if !slices.Contains(annotationVars, v) {
+			return fmt.Errorf("unknown annotation variable %q", v)
+		}
+	}
+	return nil
+}
+
+// annotateQuery returns query prefixed by a comment describing the query to
+// src by caller, according to format. If format is empty, query is returned
+// unchanged.
+func annotateQuery(ctx context.Context, format, caller, src, query string) string {
+	if format == "" {
+		return query
+	}
+	var node string
+	if who := whoIsFromContext(ctx); who != nil && who.Node != nil {
+		node = who.Node.Name
+	}
+	note := strings.NewReplacer(
+		"{user}", sanitizeAnnotation(caller),
+		"{node}", sanitizeAnnotation(node),
+		"{src}", sanitizeAnnotation(src),
+		"{req}", sanitizeAnnotation(requestIDFromContext(ctx)),
+	).Replace(format)
+	return "/* " + note + " */ " + query
+}
+
+// sanitizeAnnotation returns s with each character that is not safe to
+// include in an SQL comment replaced by "_". Letters, digits, and the
+// punctuation of login and node names are safe; in particular, no "*" or "/"
+// survives, so the comment cannot be closed early. An empty value is
+// reported as "-".
+func sanitizeAnnotation(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return r
+		case strings.ContainsRune("@._-:+", r):
+			return r
+		}
+		return '_'
+	}, s)
+}
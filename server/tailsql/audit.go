@@ -0,0 +1,412 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tailsql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An AuditSink receives a record of the events processed by a server, such
+// as authorization decisions and queries.
+//
+// The server delivers events to each sink asynchronously, in batches, in the
+// order they occurred. Audit is not called concurrently for the same sink. If
+// a sink falls too far behind, the server discards events for that sink
+// rather than delaying queries, and logs how many were discarded. A sink
+// wrapped by [SyncAuditSink] instead receives each event as it occurs.
+//
+// The built-in sinks are [FileAuditSink] and [WebhookAuditSink]. If the
+// server has local state, it is also a synchronous sink that records
+// completed queries in the query log, so that none is omitted.
+type AuditSink interface {
+	Audit(ctx context.Context, events []AuditEvent) error
+}
+
+// SyncAuditSink returns a sink that delivers each event to sink as it is
+// recorded, rather than through a buffer. The request that caused the event
+// waits for delivery, so no events are discarded, but a slow sink delays
+// requests. Audit may be called concurrently.
+func SyncAuditSink(sink AuditSink) AuditSink { return syncSink{sink} }
+
+type syncSink struct{ AuditSink }
+
+// AuditKind identifies the kind of an AuditEvent.
+type AuditKind string
+
+const (
+	AuditAuth       AuditKind = "auth"        // an authorization decision
+	AuditQueryStart AuditKind = "query-start" // a query was sent to a source
+	AuditQueryEnd   AuditKind = "query-end"   // a query finished, successfully or not
+
+	// A query was refused before it was sent to a source, for example by
+	// the query check. The Error field gives the reason.
+	AuditQueryRejected AuditKind = "query-rejected"
+)
+
+// An AuditEvent is a structured record of an event processed by the server.
+type AuditEvent struct {
+	Time   time.Time `json:"time"`
+	Kind   AuditKind `json:"kind"`
+	Caller string    `json:"caller,omitempty"` // the login or node name of the caller, if known
+	Source string    `json:"source,omitempty"` // the source queried or requested
+	Query  string    `json:"query,omitempty"`  // the query, as given by the caller
+
+	// For AuditAuth, whether the caller was denied access to the source.
+	Denied bool `json:"denied,omitempty"`
+
+	// For AuditQueryEnd, the results of the query.
+	Elapsed Duration `json:"elapsed,omitempty"`
+	Rows    int      `json:"rows,omitempty"`   // the number of rows read
+	Bytes   int      `json:"bytes,omitempty"`  // the approximate size of the values read
+	Masked  []string `json:"masked,omitempty"` // the names of masked columns
+
+	// The error that failed the request, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// AuditConfig describes the built-in audit sinks, so that they can be
+// selected in a configuration file.
+type AuditConfig struct {
+	File     string `json:"file,omitempty"`     // path of a JSON-lines file (see FileAuditSink)
+	MaxSize  int64  `json:"maxSize,omitempty"`  // file: size in bytes at which to rotate the file
+	MaxFiles int    `json:"maxFiles,omitempty"` // file: number of rotated files to keep
+	Webhook  string `json:"webhook,omitempty"`  // URL to post events to (see WebhookAuditSink)
+
+	// The number of events to buffer for each sink before discarding events.
+	// If zero or negative, a default of 1024 is used.
+	Buffer int `json:"buffer,omitempty"`
+}
+
+func (c *AuditConfig) sinks() []AuditSink {
+	var out []AuditSink
+	if c.File != "" {
+		out = append(out, &FileAuditSink{
+			Path:     os.ExpandEnv(c.File),
+			MaxSize:  c.MaxSize,
+			MaxFiles: c.MaxFiles,
+		})
+	}
+	if c.Webhook != "" {
+		out = append(out, &WebhookAuditSink{URL: c.Webhook})
+	}
+	return out
+}
+
+// FileAuditSink is an [AuditSink] that appends events to a file as JSON
+// objects, one per line. If MaxSize is positive, the file is rotated before
+// it would exceed that size: The file is renamed with the suffix ".1", any
+// previous ".1" file becomes ".2", and so on, keeping MaxFiles rotated files.
+//
+// The file is opened when the first events are written, and remains open
+// until Close is called.
+type FileAuditSink struct {
+	Path     string
+	MaxSize  int64
+	MaxFiles int // if zero or negative, a default of 5 is used
+
+	mu   sync.Mutex
+	f    *os.File // nil if not open
+	size int64    // current size of f
+}
+
+// Audit implements the [AuditSink] interface.
+func (s *FileAuditSink) Audit(_ context.Context, events []AuditEvent) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f != nil && s.MaxSize > 0 && s.size > 0 && s.size+int64(buf.Len()) > s.MaxSize {
+		if err := s.rotateLocked(); err != nil {
+			return fmt.Errorf("rotate audit log: %w", err)
+		}
+	}
+	if s.f == nil {
+		f, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		s.f, s.size = f, fi.Size()
+	}
+	n, err := s.f.Write(buf.Bytes())
+	s.size += int64(n)
+	return err
+}
+
+// rotateLocked closes the current file and shifts the rotated files.
+// The caller must hold s.mu, and s.f must be open.
+func (s *FileAuditSink) rotateLocked() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	s.f, s.size = nil, 0
+	keep := s.MaxFiles
+	if keep <= 0 {
+		keep = 5
+	}
+	os.Remove(fmt.Sprintf("%s.%d", s.Path, keep))
+	for i := keep - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", s.Path, i), fmt.Sprintf("%s.%d", s.Path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(s.Path, s.Path+".1")
+}
+
+// Close closes the file, if it is open.
+func (s *FileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// WebhookAuditSink is an [AuditSink] that posts each batch of events to URL
+// as a JSON array. Any response status other than 2xx is an error, and the
+// batch is not retried.
+type WebhookAuditSink struct {
+	URL    string
+	Header http.Header  // additional request headers (optional)
+	Client *http.Client // if nil, use http.DefaultClient
+}
+
+// Audit implements the [AuditSink] interface.
+func (s *WebhookAuditSink) Audit(ctx context.Context, events []AuditEvent) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, vals := range s.Header {
+		req.Header[key] = vals
+	}
+	req.Header.Set("Content-Type", "application/json")
+	cli := s.Client
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+	rsp, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	io.Copy(io.Discard, rsp.Body)
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("webhook: %s", rsp.Status)
+	}
+	return nil
+}
+
+const (
+	defaultAuditBuffer = 1024
+	auditBatchSize     = 100              // maximum events per call to Audit
+	auditTimeout       = 30 * time.Second // maximum time for a call to Audit
+)
+
+// An auditor delivers audit events to a collection of sinks.
+type auditor struct {
+	queues []*auditQueue
+	sync   []AuditSink // sinks that receive each event as it is recorded
+	log    *slog.Logger
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// An auditQueue buffers the events for one sink.
+type auditQueue struct {
+	sink    AuditSink
+	events  chan AuditEvent
+	dropped atomic.Int64 // events discarded since last reported
+	done    chan struct{}
+}
+
+// newAuditor starts delivering events to the given sinks, buffering up to
+// buffer events for each. If there are no sinks, it returns nil, which
+// discards all events.
+func newAuditor(sinks []AuditSink, buffer int, lg *slog.Logger) *auditor {
+	if len(sinks) == 0 {
+		return nil
+	}
+	if buffer <= 0 {
+		buffer = defaultAuditBuffer
+	}
+	a := &auditor{log: lg}
+	for _, sink := range sinks {
+		if ss, ok := sink.(syncSink); ok {
+			a.sync = append(a.sync, ss.AuditSink)
+			continue
+		}
+		q := &auditQueue{
+			sink:   sink,
+			events: make(chan AuditEvent, buffer),
+			done:   make(chan struct{}),
+		}
+		go q.run(lg)
+		a.queues = append(a.queues, q)
+	}
+	return a
+}
+
+// record sends e to each sink of a. It blocks only to deliver e to the
+// synchronous sinks (see SyncAuditSink). If a == nil, record does nothing.
+func (a *auditor) record(e AuditEvent) {
+	if a == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return
+	}
+	for _, q := range a.queues {
+		select {
+		case q.events <- e:
+		default:
+			q.dropped.Add(1)
+		}
+	}
+	for _, sink := range a.sync {
+		ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+		err := sink.Audit(ctx, []AuditEvent{e})
+		cancel()
+		if err != nil {
+			a.log.Warn("audit event not recorded", "sink", fmt.Sprintf("%T", sink), "kind", e.Kind, "error", err)
+		}
+	}
+}
+
+// close stops accepting events, and waits until the buffered events have been
+// delivered or ctx ends. It then closes any sinks that implement io.Closer.
+func (a *auditor) close(ctx context.Context) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		for _, q := range a.queues {
+			close(q.events)
+		}
+	}
+	a.mu.Unlock()
+	var errs []error
+	for _, q := range a.queues {
+		select {
+		case <-q.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if c, ok := q.sink.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+	for _, sink := range a.sync {
+		if c, ok := sink.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// run delivers the events of q to its sink until q.events is closed.
+func (q *auditQueue) run(lg *slog.Logger) {
+	defer close(q.done)
+	for e := range q.events {
+		batch := []AuditEvent{e}
+	fill:
+		for len(batch) < auditBatchSize {
+			select {
+			case e, ok := <-q.events:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, e)
+			default:
+				break fill
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+		err := q.sink.Audit(ctx, batch)
+		cancel()
+		if err != nil {
+			lg.Warn("audit events not recorded", "sink", fmt.Sprintf("%T", q.sink), "events", len(batch), "error", err)
+		}
+		if n := q.dropped.Swap(0); n != 0 {
+			lg.Warn("audit events discarded (sink is too slow)", "sink", fmt.Sprintf("%T", q.sink), "events", n)
+		}
+	}
+}
+
+// recordAuth records the decision to grant or deny (if err != nil) caller
+// access to src for query, in the metrics and the audit log.
+func (s *Server) recordAuth(caller, src, query string, err error) {
+	e := AuditEvent{Kind: AuditAuth, Caller: caller, Source: src, Query: query}
+	if err != nil {
+		e.Denied, e.Error = true, err.Error()
+		s.metrics.denied.Add(src, 1)
+	}
+	s.audit.record(e)
+}
+
+// auditRejected records that query by caller to src was refused with err
+// before it was sent to the source, and returns err.
+func (s *Server) auditRejected(caller, src, query string, err error) error {
+	s.audit.record(AuditEvent{
+		Kind: AuditQueryRejected, Caller: caller, Source: src, Query: query, Error: err.Error(),
+	})
+	return err
+}
+
+// auditQueryEnd records the completion of a query by caller to src. The
+// results are in out, unless the query failed with an error other than
+// errTooManyRows.
+func (s *Server) auditQueryEnd(caller, src, query string, out *dbResult, masked []string, err error) {
+	e := AuditEvent{
+		Kind:    AuditQueryEnd,
+		Caller:  caller,
+		Source:  src,
+		Query:   query,
+		Elapsed: Duration(out.Elapsed),
+		Rows:    len(out.Rows),
+		Bytes:   out.Bytes,
+		Masked:  masked,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	s.audit.record(e)
+}
@@ -0,0 +1,69 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tailsql
+
+import (
+	"context"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// CallerInfo describes the caller of a request to the server, and the request
+// itself. The context the server passes to the Query method of a Queryable
+// carries the CallerInfo for the request that sent the query, so that a
+// source implemented in Go can apply its own rules for access to rows, or
+// audit queries itself. See [CallerFromContext].
+type CallerInfo struct {
+	// The identity of the caller, as reported by the LocalClient. If the
+	// server has no LocalClient, these fields are empty.
+	Login    string                 // login name of the user; "" for a tagged node
+	NodeName string                 // name of the calling node
+	Tags     []string               // tags of the calling node, if any
+	CapMap   tailcfg.PeerCapMap     // peer capabilities granted to the caller
+	WhoIs    *apitype.WhoIsResponse // the complete identity, or nil
+
+	// Metadata about the request.
+	RequestID  string // the ID assigned to the request (see X-Request-Id)
+	RemoteAddr string // the network address of the caller
+	Path       string // the API path, for example "/json"
+
+	// The name of the source being queried, if known. For a federated
+	// query, this is the source of the table being read.
+	Source string
+}
+
+// CallerFromContext returns the caller information carried by ctx, and
+// reports whether ctx belongs to a request to the server. The contexts passed
+// to Queryable.Query and to the methods of Hooks carry this information,
+// although the identity of the caller is not yet known when
+// Hooks.RequestReceived is called.
+func CallerFromContext(ctx context.Context) (CallerInfo, bool) {
+	m, ok := requestMetaFromContext(ctx)
+	if !ok {
+		return CallerInfo{}, false
+	}
+	ci := CallerInfo{
+		RequestID:  m.id,
+		RemoteAddr: m.remoteAddr,
+		Path:       m.path,
+	}
+	if h, ok := ctx.Value(dbHandleKey{}).(*dbHandle); ok {
+		ci.Source = h.Source()
+	}
+	if who := whoIsFromContext(ctx); who != nil {
+		ci.WhoIs = who
+		ci.CapMap = who.CapMap
+		if who.Node != nil {
+			ci.NodeName = who.Node.Name
+			ci.Tags = who.Node.Tags
+			if !who.Node.IsTagged() && who.UserProfile != nil {
+				ci.Login = who.UserProfile.LoginName
+			}
+		} else if who.UserProfile != nil {
+			ci.Login = who.UserProfile.LoginName
+		}
+	}
+	return ci, true
+}
@@ -0,0 +1,140 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tailsql
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/tailscale/tailsql/sqllex"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// callerVarPrefix is the prefix of the names of caller variables in the text
+// of named queries.
+const callerVarPrefix = "caller_"
+
+// callerVars are the caller variables a named query may refer to, as
+// ":caller_name", mapped to functions that report their values for a caller.
+// The values are bound to the query as parameters, never substituted into
+// its text.
+var callerVars = map[string]func(who *apitype.WhoIsResponse) any{
+	// The login name of the user, or "" for a tagged node.
+	"caller_login": func(who *apitype.WhoIsResponse) any {
+		if who.UserProfile == nil || (who.Node != nil && who.Node.IsTagged()) {
+			return ""
+		}
+		return who.UserProfile.LoginName
+	},
+	// The numeric ID of the user.
+	"caller_user_id": func(who *apitype.WhoIsResponse) any {
+		if who.UserProfile == nil {
+			return int64(0)
+		}
+		return int64(who.UserProfile.ID)
+	},
+	// The name of the calling node.
+	"caller_node": func(who *apitype.WhoIsResponse) any {
+		if who.Node == nil {
+			return ""
+		}
+		return who.Node.Name
+	},
+	// The tags of the calling node, as a JSON array of strings.
+	"caller_tags": func(who *apitype.WhoIsResponse) any {
+		tags := []string{}
+		if who.Node != nil && who.Node.Tags != nil {
+			tags = who.Node.Tags
+		}
+		data, _ := json.Marshal(tags)
+		return string(data)
+	},
+}
+
+// findCallerVars returns the indexes of the tokens of toks that refer to
+// caller variables, paired with the variable names. A reference is a
+// parameter token such as ":caller_login" (SQLite), or a ":" immediately
+// followed by a word (other dialects, which do not use ":name" parameters).
+func findCallerVars(toks []sqllex.Token) (refs [][2]int, names []string) {
+	for i, tok := range toks {
+		switch {
+		case tok.Kind == sqllex.Param && strings.HasPrefix(tok.Text, ":"+callerVarPrefix):
+			refs = append(refs, [2]int{i, i + 1})
+			names = append(names, tok.Text[1:])
+		case tok.Kind == sqllex.Punct && tok.Text == ":" && i+1 < len(toks) &&
+			toks[i+1].Kind == sqllex.Word && strings.HasPrefix(toks[i+1].Text, callerVarPrefix):
+			refs = append(refs, [2]int{i, i + 2})
+			names = append(names, toks[i+1].Text)
+		}
+	}
+	return refs, names
+}
+
+// usesCallerVars reports whether query, in dialect d, refers to any caller
+// variables.
+func usesCallerVars(d sqllex.Dialect, query string) bool {
+	refs, _ := findCallerVars(sqllex.Scan(d, query))
+	return len(refs) != 0
+}
+
+// bindCallerVars replaces each reference to a caller variable in query, in
+// dialect d, with a positional parameter, and returns the rewritten query
+// along with the values of the parameters for the caller identified by who.
+// If query does not refer to any caller variables, it is returned unchanged.
+func bindCallerVars(d sqllex.Dialect, query string, who *apitype.WhoIsResponse) (string, []any, error) {
+	toks := sqllex.Scan(d, query)
+	refs, names := findCallerVars(toks)
+	if len(refs) == 0 {
+		return query, nil, nil
+	} else if who == nil {
+		return "", nil, statusErrorf(http.StatusForbidden, "query refers to the caller, but the caller is not known")
+	}
+	for _, tok := range toks {
+		if tok.Kind == sqllex.Param && !strings.HasPrefix(tok.Text, ":"+callerVarPrefix) {
+			return "", nil, fmt.Errorf("query mixes caller variables with other parameters (%q)", tok.Text)
+		}
+	}
+
+	var sb strings.Builder
+	var params []any
+	last := 0 // index of the next token to copy
+	for i, ref := range refs {
+		get, ok := callerVars[names[i]]
+		if !ok {
+			return "", nil, fmt.Errorf("unknown caller variable %q", names[i])
+		}
+		for _, tok := range toks[last:ref[0]] {
+			sb.WriteString(tok.Text)
+		}
+		params = append(params, get(who))
+		if d == sqllex.PostgreSQL {
+			fmt.Fprintf(&sb, "$%d", len(params))
+		} else {
+			sb.WriteString("?")
+		}
+		last = ref[1]
+	}
+	for _, tok := range toks[last:] {
+		sb.WriteString(tok.Text)
+	}
+	return sb.String(), params, nil
+}
+
+// allowsCallerQuery reports whether query is a named query of src that refers
+// to caller variables, and src permits such queries by callers who are not
+// otherwise authorized to query it (see DBSpec.AllowCallerQueries).
+func (s *Server) allowsCallerQuery(src, query string) bool {
+	name, ok := strings.CutPrefix(query, "named:")
+	if !ok || !s.settings().callerQueries[src] {
+		return false
+	}
+	h := s.dbHandleForSource(src)
+	if h == nil {
+		return false
+	}
+	text, ok := h.Named()[name]
+	return ok && usesCallerVars(h.Dialect(), text)
+}
@@ -0,0 +1,197 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tailsql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Column name and values reported by a diff query.
+const (
+	diffChangeColumn = "_change"
+
+	diffAdded       = "added"        // the row is only in the second source
+	diffRemoved     = "removed"      // the row is only in the first source
+	diffChangedFrom = "changed-from" // the row from the first source, for a key in both
+	diffChangedTo   = "changed-to"   // the row from the second source, for a key in both
+)
+
+// queryDiff executes q against q.Source and q.Diff, and reports the rows that
+// differ. Each source is queried as usual, subject to its own checks, limits,
+// and timeouts. It is an error if either source has more rows than the row
+// limit, since the results would not be comparable.
+//
+// If q.DiffKey is set, it names the key columns identifying each row. A row
+// whose key occurs in both results with different values is reported as a
+// pair of rows, the first from q.Source and the second from q.Diff. Without
+// key columns, rows are compared as a whole, and are only added or removed.
+func (s *Server) queryDiff(ctx context.Context, caller string, q Query) (*dbResult, error) {
+	if q.Diff == q.Source {
+		return nil, s.auditRejected(caller, q.Source, q.Query, statusErrorf(http.StatusBadRequest, "cannot compare source %q with itself", q.Source))
+	}
+	other := s.dbHandleForSource(q.Diff)
+	if other == nil {
+		return nil, s.auditRejected(caller, q.Diff, q.Query, statusErrorf(http.StatusBadRequest, "unknown source %q", q.Diff))
+	} else if !s.canAccess(ctx, q.Diff) {
+		err := statusErrorf(http.StatusForbidden, "access to source %q denied", q.Diff)
+		s.recordAuth(caller, q.Diff, q.Query, err)
+		return nil, err
+	}
+	oq, err := s.settings().qcheck(Query{Source: q.Diff, Driver: other.Driver(), Query: q.Query})
+	if err != nil {
+		return nil, s.auditRejected(caller, q.Diff, q.Query, statusErrorf(http.StatusBadRequest, "source %q: %w", q.Diff, err))
+	}
+	keyText := q.DiffKey
+	q.Diff, q.DiffKey = "", "" // query the first source as usual
+
+	// Run the query on both sources concurrently.
+	var res [2]*dbResult
+	var errs [2]error
+	var wg sync.WaitGroup
+	for i, sq := range []Query{q, oq} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res[i], errs[i] = s.queryContext(ctx, caller, sq)
+			if errors.Is(errs[i], errTooManyRows) {
+				errs[i] = statusErrorf(http.StatusBadRequest,
+					"source %q returned more than %d rows", sq.Source, s.settings().rowLimit)
+			} else if errs[i] == nil && res[i] == nil {
+				res[i] = new(dbResult) // empty query
+			}
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs[:]...); err != nil {
+		return nil, err
+	}
+	if !slices.Equal(res[0].Columns, res[1].Columns) {
+		return nil, statusErrorf(http.StatusBadRequest, "columns differ: %q has %q, %q has %q",
+			q.Source, res[0].Columns, oq.Source, res[1].Columns)
+	}
+
+	var keys []int
+	if keyText != "" {
+		for _, name := range strings.Split(keyText, ",") {
+			i := slices.Index(res[0].Columns, strings.TrimSpace(name))
+			if i < 0 {
+				return nil, statusErrorf(http.StatusBadRequest, "key column %q not found", name)
+			}
+			keys = append(keys, i)
+		}
+	}
+	out, err := diffResults(res[0], res[1], keys)
+	if err != nil {
+		return nil, statusErrorf(http.StatusBadRequest, "%w", err)
+	}
+	out.Elapsed = max(res[0].Elapsed, res[1].Elapsed)
+	return out, nil
+}
+
+// diffResults compares the rows of a and b, which must have the same columns,
+// and returns a result reporting the differences. If keys is non-empty, it
+// gives the indexes of the key columns.
+func diffResults(a, b *dbResult, keys []int) (*dbResult, error) {
+	out := &dbResult{Columns: append([]string{diffChangeColumn}, a.Columns...)}
+	add := func(change string, row []any, marks []bool) {
+		out.Rows = append(out.Rows, append([]any{change}, row...))
+		out.changes = append(out.changes, change)
+		out.marks = append(out.marks, append([]bool{false}, marks...))
+	}
+
+	if len(keys) == 0 {
+		// Compare whole rows as multisets: A row that occurs more often in a
+		// than in b was removed, and vice versa.
+		count := make(map[string]int)
+		for _, row := range b.Rows {
+			count[rowKey(row, nil)]++
+		}
+		for _, row := range a.Rows {
+			if k := rowKey(row, nil); count[k] > 0 {
+				count[k]--
+			} else {
+				add(diffRemoved, row, nil)
+			}
+		}
+		for _, row := range b.Rows {
+			if k := rowKey(row, nil); count[k] > 0 {
+				count[k]--
+				add(diffAdded, row, nil)
+			}
+		}
+		out.NumRows = len(out.Rows)
+		return out, nil
+	}
+
+	index := func(r *dbResult, src string) (map[string][]any, error) {
+		m := make(map[string][]any, len(r.Rows))
+		for _, row := range r.Rows {
+			k := rowKey(row, keys)
+			if _, ok := m[k]; ok {
+				return nil, fmt.Errorf("duplicate key in %s rows", src)
+			}
+			m[k] = row
+		}
+		return m, nil
+	}
+	am, err := index(a, "first")
+	if err != nil {
+		return nil, err
+	}
+	bm, err := index(b, "second")
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range a.Rows {
+		brow, ok := bm[rowKey(row, keys)]
+		if !ok {
+			add(diffRemoved, row, nil)
+			continue
+		}
+		marks := make([]bool, len(row))
+		var changed bool
+		for i := range row {
+			if valueToString(row[i], "\x00") != valueToString(brow[i], "\x00") {
+				marks[i], changed = true, true
+			}
+		}
+		if changed {
+			add(diffChangedFrom, row, marks)
+			add(diffChangedTo, brow, marks)
+		}
+	}
+	for _, row := range b.Rows {
+		if _, ok := am[rowKey(row, keys)]; !ok {
+			add(diffAdded, row, nil)
+		}
+	}
+	out.NumRows = len(out.Rows)
+	return out, nil
+}
+
+// rowKey returns a string representing the values of the specified columns of
+// row, or all the columns if cols is empty.
+func rowKey(row []any, cols []int) string {
+	var sb strings.Builder
+	add := func(v any) {
+		s := valueToString(v, "\x00") // distinguish NULL from empty
+		fmt.Fprintf(&sb, "%d:%s;", len(s), s)
+	}
+	if len(cols) == 0 {
+		for _, v := range row {
+			add(v)
+		}
+	} else {
+		for _, i := range cols {
+			add(row[i])
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,176 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tailsql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/tailscale/tailsql/authorizer"
+)
+
+// Column names added to the results of a fan-out query.
+const (
+	fanoutSourceColumn = "_source"
+	fanoutErrorColumn  = "_error"
+)
+
+// isSourcePattern reports whether src is a pattern matching multiple sources
+// rather than the name of a single source. A pattern ends in "*", and matches
+// every source with the same prefix (see [authorizer.MatchSource]).
+func isSourcePattern(src string) bool { return strings.HasSuffix(src, "*") }
+
+// queryFanout executes q against every source matching the pattern q.Source
+// that the caller is authorized to query, and concatenates the results with
+// an added column giving the source of each row.
+//
+// An error from one source does not fail the whole query. Instead, the
+// result has an additional column reporting the error, with a row for each
+// source that failed, even if every source failed. The row limit applies to
+// the combined rows of the sources that succeeded; errors are always
+// reported.
+func (s *Server) queryFanout(ctx context.Context, caller string, q Query) (*dbResult, error) {
+	var hs []*dbHandle
+	for _, h := range s.accessibleHandles(ctx) {
+		if authorizer.MatchSource(q.Source, h.Source()) {
+			hs = append(hs, h)
+		}
+	}
+	if len(hs) == 0 {
+		return nil, s.auditRejected(caller, q.Source, q.Query, statusErrorf(http.StatusBadRequest, "no sources match %q", q.Source))
+	}
+
+	cfg := s.settings()
+	start := time.Now()
+	results := make([]*dbResult, len(hs))
+	errs := make([]error, len(hs))
+	sem := make(chan struct{}, cfg.fanoutLimit)
+	var wg sync.WaitGroup
+	for i, h := range hs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i], errs[i] = s.queryShard(ctx, caller, h, q.Query)
+		}()
+	}
+	wg.Wait()
+
+	// The columns of the first successful result define the columns of the
+	// combined result. A source whose columns differ is reported as an error.
+	var cols []string
+	for i, res := range results {
+		if errs[i] != nil || res == nil {
+			continue
+		} else if cols == nil {
+			cols = res.Columns
+		} else if !slices.Equal(cols, res.Columns) {
+			errs[i] = fmt.Errorf("columns %q do not match %q", res.Columns, cols)
+		}
+	}
+	var nerr int
+	for _, err := range errs {
+		if err != nil {
+			nerr++
+		}
+	}
+
+	out := &dbResult{Columns: append([]string{fanoutSourceColumn}, cols...)}
+	if nerr != 0 {
+		out.Columns = append(out.Columns, fanoutErrorColumn)
+	}
+	var tooMany bool
+	for i, h := range hs {
+		if errs[i] != nil {
+			row := make([]any, len(out.Columns))
+			row[0], row[len(row)-1] = h.Source(), errs[i].Error()
+			out.Rows = append(out.Rows, row)
+			out.Failed++
+			continue
+		}
+		res := results[i]
+		if res == nil {
+			continue // the check rewrote the query to be empty
+		}
+		if res.More {
+			tooMany = true
+		}
+		out.Limit = max(out.Limit, res.Limit)
+		for _, r := range res.Rows {
+			if len(out.Rows) == cfg.rowLimit {
+				tooMany = true
+				break
+			}
+			row := append([]any{h.Source()}, r...)
+			if nerr != 0 {
+				row = append(row, nil)
+			}
+			out.Rows = append(out.Rows, row)
+		}
+	}
+	out.NumRows = len(out.Rows)
+	out.Elapsed = time.Since(start)
+	s.logger(ctx).Info("fan-out query",
+		"caller", caller, "source", q.Source, "query_hash", queryHash(q.Query), "sources", len(hs),
+		"failed", nerr, "elapsed", out.Elapsed.Round(time.Millisecond), "rows", len(out.Rows))
+	if tooMany {
+		out.More = true
+		return out, errTooManyRows
+	}
+	return out, nil
+}
+
+// queryShard executes query against h as one part of a fan-out query. The
+// query is checked separately for each source.
+func (s *Server) queryShard(ctx context.Context, caller string, h *dbHandle, query string) (*dbResult, error) {
+	q, err := s.settings().qcheck(Query{Source: h.Source(), Driver: h.Driver(), Query: query})
+	if err != nil {
+		return nil, s.auditRejected(caller, h.Source(), query, err)
+	}
+	res, err := s.queryContext(ctx, caller, q)
+	if errors.Is(err, errTooManyRows) {
+		res.More = true
+	} else if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// A sourcePattern is a source pattern offered in the UI source picker.
+type sourcePattern struct {
+	Pattern string // e.g., "shard*"
+	Count   int    // the number of sources matching the pattern
+}
+
+// sourcePatterns returns a pattern for each group of two or more sources
+// whose names differ only by a numeric suffix, such as "shard1", "shard2".
+func sourcePatterns(hs []*dbHandle) []sourcePattern {
+	var out []sourcePattern
+	seen := make(map[string]bool)
+	for _, h := range hs {
+		prefix := strings.TrimRightFunc(h.Source(), unicode.IsDigit)
+		if prefix == "" || prefix == h.Source() || seen[prefix] {
+			continue
+		}
+		seen[prefix] = true
+		p := sourcePattern{Pattern: prefix + "*"}
+		for _, h := range hs {
+			if authorizer.MatchSource(p.Pattern, h.Source()) {
+				p.Count++
+			}
+		}
+		if p.Count >= 2 {
+			out = append(out, p)
+		}
+	}
+	return out
+}
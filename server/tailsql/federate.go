@@ -0,0 +1,274 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tailsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tailscale/tailsql/sqllex"
+)
+
+// A fedTable is a reference to a table of another source in the text of a
+// federated query, written "from:source.table".
+type fedTable struct {
+	source string // the name of the source
+	table  string // the table name, as written in the query
+	start  int    // offset of the reference in the query
+	end    int    // offset just past the end of the reference
+}
+
+// localName returns the name of the table in the federated database.
+func (t fedTable) localName() string { return t.source + "." + t.table }
+
+// parseFederated returns the table references in query, in order of
+// occurrence. It returns nil if query is not a federated query.
+//
+// A reference has the form "from:source.table", where the table name may be
+// qualified and may be quoted using the rules of the source's database.
+// References inside string literals and comments are ignored.
+func parseFederated(query string) []fedTable {
+	var out []fedTable
+	for _, t := range sqllex.Scan(sqllex.SQLite, query) {
+		if !t.Is("from") {
+			continue
+		}
+		end := t.Pos.Offset + len(t.Text)
+		if len(out) != 0 && end <= out[len(out)-1].end {
+			continue // inside a previous reference
+		}
+		if ref, ok := parseTableRef(query, t.Pos.Offset, end); ok {
+			out = append(out, ref)
+		}
+	}
+	return out
+}
+
+// parseTableRef parses a table reference beginning with the word "from" at
+// query[start:pos].
+func parseTableRef(query string, start, pos int) (fedTable, bool) {
+	if pos >= len(query) || query[pos] != ':' {
+		return fedTable{}, false
+	}
+	pos++
+	srcStart := pos
+	for pos < len(query) && isSourceChar(query[pos]) {
+		pos++
+	}
+	if pos == srcStart || pos >= len(query) || query[pos] != '.' {
+		return fedTable{}, false
+	}
+	src := query[srcStart:pos]
+	tabStart := pos + 1
+	for pos < len(query) && query[pos] == '.' {
+		next := identEnd(query, pos+1)
+		if next < 0 {
+			return fedTable{}, false
+		}
+		pos = next
+	}
+	return fedTable{source: src, table: query[tabStart:pos], start: start, end: pos}, true
+}
+
+func isSourceChar(c byte) bool {
+	return c == '_' || c == '-' || ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// identEnd returns the offset just past the end of the identifier beginning
+// at query[pos], or -1 if there is no identifier there.
+func identEnd(query string, pos int) int {
+	if pos >= len(query) {
+		return -1
+	}
+	switch q := query[pos]; q {
+	case '"', '`', '[':
+		if q == '[' {
+			q = ']'
+		}
+		for i := pos + 1; i < len(query); i++ {
+			if query[i] != q {
+				continue
+			} else if q != ']' && i+1 < len(query) && query[i+1] == q {
+				i++ // doubled quote
+				continue
+			}
+			return i + 1
+		}
+		return -1
+	default:
+		end := pos
+		for end < len(query) && isIdentChar(query[end]) {
+			end++
+		}
+		if end == pos {
+			return -1
+		}
+		return end
+	}
+}
+
+// quoteIdent quotes name as an SQLite identifier.
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// queryFederated executes a federated query whose table references are refs.
+// Each referenced table is read from its source, subject to the same checks,
+// limits, and logging as any other query to that source, and loaded into a
+// temporary in-memory SQLite database. The query is then run against that
+// database, with each reference replaced by the name of its table.
+func (s *Server) queryFederated(ctx context.Context, caller string, q Query, refs []fedTable) (*dbResult, error) {
+	cfg := s.settings()
+	if cfg.qtimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.qtimeout)
+		defer cancel()
+	}
+
+	// Rewrite the query to use the local table names, and collect the
+	// distinct tables to load.
+	var sb strings.Builder
+	var tables []fedTable
+	seen := make(map[string]bool)
+	last := 0
+	for _, ref := range refs {
+		sb.WriteString(q.Query[last:ref.start])
+		sb.WriteString(quoteIdent(ref.localName()))
+		last = ref.end
+		if !seen[ref.localName()] {
+			seen[ref.localName()] = true
+			tables = append(tables, ref)
+		}
+	}
+	sb.WriteString(q.Query[last:])
+	query := sb.String()
+	if err := checkQuerySyntax(sqllex.SQLite, query); err != nil {
+		return nil, s.auditRejected(caller, q.Source, q.Query, statusErrorf(http.StatusBadRequest, "invalid query: %w", err))
+	}
+
+	fdb, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		return nil, fmt.Errorf("open federated database: %w", err)
+	}
+	defer fdb.Close()
+	fdb.SetMaxOpenConns(1) // each connection has its own in-memory database
+
+	var srcs []string
+	for _, t := range tables {
+		res, err := s.fetchTable(ctx, caller, t, cfg.rowLimit)
+		if err != nil {
+			return nil, err
+		}
+		if err := loadTable(ctx, fdb, t.localName(), res); err != nil {
+			return nil, fmt.Errorf("loading %s: %w", t.localName(), err)
+		}
+		srcs = append(srcs, t.source)
+	}
+
+	// For the hooks and audit log, the source of the combined query is the
+	// list of sources it reads.
+	fq := Query{Source: strings.Join(srcs, ","), Driver: "sqlite", Query: q.Query}
+	ctx = s.hooks.QueryStarted(ctx, caller, fq)
+	start := time.Now()
+	defer s.inflight.add(inflightQuery{
+		source: fq.Source, caller: caller, query: q.Query, start: start,
+	})()
+	s.metrics.inflight.Add(1)
+	defer s.metrics.inflight.Add(-1)
+	s.audit.record(AuditEvent{
+		Time: start, Kind: AuditQueryStart, Caller: caller, Source: fq.Source, Query: q.Query,
+	})
+	var out dbResult
+	if pq, ok := pushLimit(sqllex.SQLite, query, cfg.rowLimit+1); ok {
+		query = pq
+		out.Limit = cfg.rowLimit + 1
+	}
+	rows, err := newSQLDB(fdb, "sqlite", SessionOptions{}).Query(ctx, query)
+	if err == nil {
+		defer rows.Close()
+		err = readRows(ctx, rows, cfg.rowLimit, &out, func(n int) {
+			s.hooks.RowsStreamed(ctx, fq, n)
+		})
+	}
+	out.Elapsed = time.Since(start)
+	s.logger(ctx).Info("federated query",
+		"caller", caller, "sources", srcs, "query", q.Query, "query_hash", queryHash(q.Query),
+		"elapsed", out.Elapsed.Round(time.Millisecond), "rows", len(out.Rows), "error", err)
+	s.auditQueryEnd(caller, fq.Source, q.Query, &out, nil, err)
+	s.hooks.QueryFinished(ctx, fq, queryStats(&out, nil, err), err)
+	if err != nil && !errors.Is(err, errTooManyRows) {
+		return nil, err
+	}
+	return &out, err
+}
+
+// fetchTable reads the contents of the table referenced by t from its source,
+// on behalf of the caller. The caller must be authorized to query the source,
+// and the query must pass the server's query check. It is an error if the
+// table has more than limit rows, since a partial table would give wrong
+// results silently.
+func (s *Server) fetchTable(ctx context.Context, caller string, t fedTable, limit int) (*dbResult, error) {
+	tq := "SELECT * FROM " + t.table
+	h := s.dbHandleForSource(t.source)
+	if h == nil {
+		return nil, s.auditRejected(caller, t.source, tq, statusErrorf(http.StatusBadRequest, "unknown source %q", t.source))
+	} else if !s.canAccess(ctx, t.source) {
+		err := statusErrorf(http.StatusForbidden, "access to source %q denied", t.source)
+		s.recordAuth(caller, t.source, tq, err)
+		return nil, err
+	}
+	q, err := s.settings().qcheck(Query{Source: t.source, Driver: h.Driver(), Query: tq})
+	if err != nil {
+		return nil, s.auditRejected(caller, t.source, tq, statusErrorf(http.StatusBadRequest, "source %q: %w", t.source, err))
+	}
+	res, err := s.queryContext(context.WithValue(ctx, tableQueryKey{}, true), caller, q)
+	if errors.Is(err, errTooManyRows) {
+		return nil, statusErrorf(http.StatusBadRequest, "table %s has more than %d rows", t.localName(), limit)
+	} else if err != nil {
+		return nil, fmt.Errorf("source %q: %w", t.source, err)
+	}
+	return res, nil
+}
+
+// loadTable creates a table with the given name in db, and populates it with
+// the contents of res.
+func loadTable(ctx context.Context, db *sql.DB, name string, res *dbResult) error {
+	if len(res.Columns) == 0 {
+		return errors.New("no columns")
+	}
+	cols := make([]string, len(res.Columns))
+	for i, c := range res.Columns {
+		cols[i] = quoteIdent(c)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("CREATE TABLE %s (%s)",
+		quoteIdent(name), strings.Join(cols, ", "))); err != nil {
+		return err
+	}
+	ins, err := tx.PrepareContext(ctx, fmt.Sprintf("INSERT INTO %s VALUES (?%s)",
+		quoteIdent(name), strings.Repeat(", ?", len(cols)-1)))
+	if err != nil {
+		return err
+	}
+	defer ins.Close()
+	for _, row := range res.Rows {
+		if _, err := ins.ExecContext(ctx, row...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,369 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tailsql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/util/httpm"
+)
+
+// HealthStatus summarizes the health of a data source.
+type HealthStatus string
+
+const (
+	// HealthUnknown means the source has not been checked, either because
+	// health checks are disabled or because the source does not support them.
+	HealthUnknown HealthStatus = "unknown"
+
+	// HealthOK means the most recent health check of the source succeeded.
+	HealthOK HealthStatus = "ok"
+
+	// HealthDegraded means the source is open, but the most recent health
+	// check of the source failed.
+	HealthDegraded HealthStatus = "degraded"
+
+	// HealthDown means the source could not be opened. The server retries
+	// opening the source in the background.
+	HealthDown HealthStatus = "down"
+)
+
+// SourceHealth is a report of the health of a data source.
+type SourceHealth struct {
+	Source    string       `json:"source"`
+	Status    HealthStatus `json:"status"`
+	LastError string       `json:"lastError,omitempty"` // from the most recent check
+	Latency   Duration     `json:"latency,omitempty"`   // of the most recent check
+	CheckedAt time.Time    `json:"checkedAt,omitzero"`  // when last checked
+}
+
+// Healthy reports whether h does not indicate a known problem.
+func (h SourceHealth) Healthy() bool {
+	return h.Status == HealthOK || h.Status == HealthUnknown
+}
+
+// Pinger is an optional interface that a Queryable may implement to support
+// health checks. If a Queryable does not implement this interface, its health
+// is reported as unknown.
+type Pinger interface {
+	// PingContext verifies that the database is reachable.
+	PingContext(context.Context) error
+}
+
+// unavailableDB is a placeholder Queryable for a source that could not be
+// opened. Queries against it fail with the error from the last attempt.
+type unavailableDB struct {
+	spec DBSpec // the source definition, for retries
+	err  error  // the error from the most recent attempt
+}
+
+// unavailableConf is the connection settings key for a source that could not
+// be opened. It never matches a real key, so reloading always reopens the
+// source.
+const unavailableConf = "(unavailable)"
+
+// newUnavailableHandle returns a database handle for the source defined by
+// spec, which could not be opened due to err.
+func newUnavailableHandle(spec DBSpec, err error) *dbHandle {
+	h := &dbHandle{
+		src:   spec.Source,
+		conf:  unavailableConf,
+		label: spec.label(),
+		named: spec.Named,
+		db:    unavailableDB{spec: spec, err: err},
+	}
+	h.setHealth(HealthDown, 0, err)
+	return h
+}
+
+func (u unavailableDB) Query(context.Context, string, ...any) (RowSet, error) {
+	return nil, statusErrorf(http.StatusServiceUnavailable, "source %q is unavailable: %w", u.spec.Source, u.err)
+}
+
+func (unavailableDB) Close() error { return nil }
+
+// Health returns a report of the health of h.
+func (h *dbHandle) Health() SourceHealth {
+	if p := h.health.Load(); p != nil {
+		return *p
+	}
+	return SourceHealth{Source: h.src, Status: HealthUnknown}
+}
+
+// setHealth records the result of a health check of h.
+func (h *dbHandle) setHealth(status HealthStatus, latency time.Duration, err error) {
+	sh := &SourceHealth{
+		Source:    h.src,
+		Status:    status,
+		Latency:   Duration(latency),
+		CheckedAt: time.Now(),
+	}
+	if err != nil {
+		sh.LastError = err.Error()
+	}
+	h.health.Store(sh)
+}
+
+// unavailable reports whether h is a placeholder for a source that could not
+// be opened, and if so returns the definition of the source.
+func (h *dbHandle) unavailable() (DBSpec, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	u, ok := h.db.(unavailableDB)
+	return u.spec, ok
+}
+
+// checkHealth pings the database for h, if it supports it, and records the
+// result. If the database does not support pings, or h is unavailable or
+// closed, checkHealth does nothing.
+func (h *dbHandle) checkHealth(ctx context.Context, timeout time.Duration) {
+	var pinged bool
+	var latency time.Duration
+	err := h.WithLock(ctx, func(ctx context.Context, db Queryable) error {
+		p, ok := db.(Pinger)
+		if !ok {
+			return nil
+		}
+		pctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		pinged = true
+		start := time.Now()
+		err := p.PingContext(pctx)
+		latency = time.Since(start)
+		return err
+	})
+	if !pinged {
+		return
+	} else if err != nil {
+		h.setHealth(HealthDegraded, latency, err)
+	} else {
+		h.setHealth(HealthOK, latency, nil)
+	}
+}
+
+// checkHealthLoop checks the health of all the sources in s at the given
+// interval, until s is closed.
+func (s *Server) checkHealthLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		for _, h := range s.getHandles() {
+			h.checkHealth(s.ctx, interval)
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// reconnect tries to open the source for h, a placeholder for a source that
+// could not be opened, with exponential backoff. If it succeeds, the new
+// handle replaces h. It gives up when s is closed, or when h is no longer the
+// current handle for its source, e.g., because it was removed or reloaded.
+func (s *Server) reconnect(h *dbHandle) {
+	const (
+		minRetry = time.Second
+		maxRetry = 5 * time.Minute
+	)
+	opts := Options{Logger: s.log}
+	for wait := minRetry; ; wait = min(2*wait, maxRetry) {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		spec, ok := h.unavailable()
+		if !ok || s.dbs.lookup(spec.Source) != h {
+			return // the handle was updated or removed
+		}
+
+		start := time.Now()
+		u, err := opts.openSource(s.ctx, s.secrets, spec)
+		if err != nil {
+			s.log.Warn("source is still unavailable", "source", spec.Source, "error", err)
+			h.setHealth(HealthDown, time.Since(start), err)
+			continue
+		}
+		if !s.dbs.replaceHandle(h, u) {
+			u.Get().close() // the handle was updated or removed while we worked
+			return
+		}
+		s.log.Info("source is now available", "source", spec.Source)
+		u.Get().setHealth(HealthOK, time.Since(start), nil)
+		s.startSecretWatch([]*dbHandle{u.Get()})
+		h.close()
+		return
+	}
+}
+
+// startReconnect starts a goroutine to reconnect each of the handles in hs
+// that is a placeholder for an unavailable source.
+func (s *Server) startReconnect(hs []*dbHandle) {
+	for _, h := range hs {
+		if _, ok := h.unavailable(); ok {
+			go s.reconnect(h)
+		}
+	}
+}
+
+// sourceStatus is the status of a source reported by /healthz and /readyz.
+// Since those routes do not require authorization, it does not include the
+// errors reported by the source, which may contain connection details.
+type sourceStatus struct {
+	Source string       `json:"source"`
+	Status HealthStatus `json:"status"`
+}
+
+// serveHealthz handles the GET /healthz route, a liveness check.  It does not
+// require authorization, so it reports only the status of each source, not
+// errors.
+//
+// The response has status 200 while the server is running, whatever the
+// health of its sources, and status 503 once it has been closed.
+func (s *Server) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != httpm.GET {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var rsp struct {
+		Status  HealthStatus   `json:"status"`
+		Sources []sourceStatus `json:"sources,omitempty"`
+	}
+	rsp.Status = HealthOK
+	var ndown int
+	for _, h := range s.getHandles() {
+		sh := h.Health()
+		rsp.Sources = append(rsp.Sources, sourceStatus{Source: sh.Source, Status: sh.Status})
+		if sh.Status == HealthDown {
+			ndown++
+		}
+		if !sh.Healthy() {
+			rsp.Status = HealthDegraded
+		}
+	}
+	if ndown != 0 && ndown == len(rsp.Sources) {
+		rsp.Status = HealthDown
+	}
+	code := http.StatusOK
+	if s.ctx.Err() != nil {
+		rsp.Status = HealthDown
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, rsp)
+}
+
+// readyPingTimeout is the maximum time to wait for each source to respond to
+// a ping requested by /readyz.
+const readyPingTimeout = 5 * time.Second
+
+// readyPingMaxAge is how long the result of a health check of a source is
+// reused by /readyz, rather than pinging the source again. Since /readyz does
+// not require authorization, this limits how often callers can make the
+// server ping its sources.
+const readyPingMaxAge = 5 * time.Second
+
+// readiness is the report served by /readyz.
+type readiness struct {
+	Ready      bool           `json:"ready"`
+	Sources    []sourceStatus `json:"sources,omitempty"`
+	LocalState HealthStatus   `json:"localState,omitempty"` // omitted if there is none
+	problems   []string       // the reasons the server is not ready
+}
+
+// readiness reports whether s is ready to serve queries: It is running, all
+// its sources are open and healthy, and its local state database, if any, is
+// writable. If ping is true, readiness first pings each source that supports
+// it and was not checked within readyPingMaxAge, rather than relying on the
+// result of the last health check.
+func (s *Server) readiness(ctx context.Context, ping bool) readiness {
+	var rd readiness
+	if s.ctx.Err() != nil {
+		rd.problems = append(rd.problems, "server is closed")
+	} else if s.reqs.isDraining() {
+		rd.problems = append(rd.problems, "server is shutting down")
+	}
+	hs := s.getHandles()
+	if ping {
+		// Only one caller at a time pings the sources, and callers waiting
+		// for it reuse its results.
+		s.pingMu.Lock()
+		defer s.pingMu.Unlock()
+		var wg sync.WaitGroup
+		for _, h := range hs {
+			if time.Since(h.Health().CheckedAt) < readyPingMaxAge {
+				continue
+			}
+			if _, ok := h.unavailable(); !ok {
+				wg.Add(1)
+				go func() { defer wg.Done(); h.checkHealth(ctx, readyPingTimeout) }()
+			}
+		}
+		wg.Wait()
+	}
+	for _, h := range hs {
+		sh := h.Health()
+		rd.Sources = append(rd.Sources, sourceStatus{Source: sh.Source, Status: sh.Status})
+		if !sh.Healthy() {
+			rd.problems = append(rd.problems, fmt.Sprintf("source %q is %s", sh.Source, sh.Status))
+		}
+	}
+	if s.state != nil {
+		rd.LocalState = HealthOK
+		if err := s.state.checkWritable(ctx); err != nil {
+			rd.LocalState = HealthDown
+			rd.problems = append(rd.problems, "local state is not writable")
+		}
+	}
+	rd.Ready = len(rd.problems) == 0
+	return rd
+}
+
+// Ready reports whether s is ready to serve queries, that is, whether it is
+// running, all its sources are open and healthy, and its local state database,
+// if any, is writable. If not, the error describes the problems.
+func (s *Server) Ready(ctx context.Context) error {
+	if rd := s.readiness(ctx, false); !rd.Ready {
+		return errors.New(strings.Join(rd.problems, "; "))
+	}
+	return nil
+}
+
+// serveReadyz handles the GET /readyz route, a readiness check. Like /healthz,
+// it does not require authorization, and reports only the status of each
+// source. If the ping parameter is set to "1" or "true", each source that
+// supports it is pinged before reporting its status, unless it was checked
+// within the last few seconds (see readyPingMaxAge).
+//
+// The response has status 200 if the server is ready (see Server.Ready), and
+// status 503 otherwise.
+func (s *Server) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != httpm.GET {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ping, _ := strconv.ParseBool(r.FormValue("ping"))
+	rd := s.readiness(r.Context(), ping)
+	code := http.StatusOK
+	if !rd.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, rd)
+}
+
+// writeJSON writes v to w as JSON, with the given HTTP status code.
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
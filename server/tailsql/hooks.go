@@ -0,0 +1,107 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tailsql
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Hooks are callbacks invoked by the server at points in the life of each
+// request, for tracing and custom instrumentation. An implementation should
+// embed [BaseHooks] so that it need only define the methods it uses, and must
+// be safe for concurrent use.
+//
+// The methods that return a context may add values to it. The returned
+// context is used for the rest of the request or query, and so reaches the
+// Queryable.Query method of the source. They must return a context derived
+// from the one they are given.
+//
+// For each API request, the hooks are called in this order:
+//
+//  1. RequestReceived, once, before the caller is identified.
+//  2. Authorized, once, with the caller's identity and the authorization
+//     decision. If the request is denied, no further hooks are called. A
+//     request that is rejected before authorization, for example because
+//     the query check fails, gets no further hooks either.
+//  3. For each query the request sends to a source: QueryStarted, then
+//     RowsStreamed zero or more times, then QueryFinished. These are called
+//     on the same goroutine, and QueryFinished is always called once
+//     QueryStarted has been.
+//
+// A federated, fan-out, or diff request may send several queries, and the
+// hooks for different queries of one request may be called concurrently. A
+// request whose query is empty or a meta-query sends no queries.
+type Hooks interface {
+	// RequestReceived is called when the server receives a request to the UI
+	// or API.
+	RequestReceived(ctx context.Context, r *http.Request) context.Context
+
+	// Authorized is called when the server has decided whether caller may
+	// send q, where caller is "" if the server has no LocalClient.
+	Authorized(ctx context.Context, caller string, q Query, allowed bool) context.Context
+
+	// QueryStarted is called before the server sends q to its source.
+	QueryStarted(ctx context.Context, caller string, q Query) context.Context
+
+	// RowsStreamed is called as rows are read from the source of q, with the
+	// number of rows read so far. It is called after each batch of rows, and
+	// after the last row.
+	RowsStreamed(ctx context.Context, q Query, rows int)
+
+	// QueryFinished is called when q is done, with statistics about its
+	// results, and the error that ended it, if any.
+	QueryFinished(ctx context.Context, q Query, stats QueryStats, err error)
+}
+
+// QueryStats are statistics about the results of a query, reported to
+// [Hooks.QueryFinished].
+type QueryStats struct {
+	Columns []string      // the names of the result columns
+	Rows    int           // the number of rows read
+	More    bool          // whether rows were omitted because of the row limit
+	Limit   int           // the LIMIT added to the query, or 0 if none
+	Masked  []string      // the names of masked columns, if any
+	Elapsed time.Duration // the time taken by the query
+}
+
+// BaseHooks is an implementation of [Hooks] whose methods do nothing. It is
+// intended to be embedded in other implementations.
+type BaseHooks struct{}
+
+// RequestReceived implements part of the [Hooks] interface.
+func (BaseHooks) RequestReceived(ctx context.Context, _ *http.Request) context.Context { return ctx }
+
+// Authorized implements part of the [Hooks] interface.
+func (BaseHooks) Authorized(ctx context.Context, _ string, _ Query, _ bool) context.Context {
+	return ctx
+}
+
+// QueryStarted implements part of the [Hooks] interface.
+func (BaseHooks) QueryStarted(ctx context.Context, _ string, _ Query) context.Context { return ctx }
+
+// RowsStreamed implements part of the [Hooks] interface.
+func (BaseHooks) RowsStreamed(context.Context, Query, int) {}
+
+// QueryFinished implements part of the [Hooks] interface.
+func (BaseHooks) QueryFinished(context.Context, Query, QueryStats, error) {}
+
+// rowsStreamedBatch is the number of rows read between calls to
+// Hooks.RowsStreamed.
+const rowsStreamedBatch = 1000
+
+// queryStats returns the statistics for out, the results of a query that
+// reported err.
+func queryStats(out *dbResult, masked []string, err error) QueryStats {
+	return QueryStats{
+		Columns: out.Columns,
+		Rows:    len(out.Rows),
+		More:    out.More || errors.Is(err, errTooManyRows),
+		Limit:   out.Limit,
+		Masked:  masked,
+		Elapsed: out.Elapsed,
+	}
+}
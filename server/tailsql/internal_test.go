@@ -6,11 +6,15 @@ package tailsql
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/tailscale/tailsql/authorizer"
+	"github.com/tailscale/tailsql/sqllex"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/tailcfg"
 )
@@ -19,40 +23,59 @@ import (
 var (
 	_ Queryable = sqlDB{}
 	_ RowSet    = (*sql.Rows)(nil)
+	_ RowSet    = txRows{}
 )
 
 func TestCheckQuerySyntax(t *testing.T) {
 	tests := []struct {
-		query string
-		ok    bool
+		dialect sqllex.Dialect
+		query   string
+		ok      bool
 	}{
-		{"", true},
-		{"  ", true},
+		{sqllex.SQLite, "", true},
+		{sqllex.SQLite, "  ", true},
 
 		// Basic disallowed stuff.
-		{`ATTACH DATABASE "foo" AS bar;`, false},
-		{`DETACH DATABASE bar;`, false},
-		{`VACUUM`, false},
-		{`VACUUM INTO '/dev/null';`, false},
+		{sqllex.SQLite, `ATTACH DATABASE "foo" AS bar;`, false},
+		{sqllex.SQLite, `DETACH DATABASE bar;`, false},
+		{sqllex.SQLite, `VACUUM`, false},
+		{sqllex.SQLite, `VACUUM INTO '/dev/null';`, false},
 
 		// Things that should not be disallowed despite looking sus.
-		{`SELECT 'ATTACH DATABASE "foo" AS bar;' FROM hell;`, true},
-		{`-- attach database not really
+		{sqllex.SQLite, `SELECT 'ATTACH DATABASE "foo" AS bar;' FROM hell;`, true},
+		{sqllex.SQLite, `-- attach database not really
         select * from a join b using (uid); -- ok  `, true},
-		{`-- vacuum into 'hell'`, true},
+		{sqllex.SQLite, `-- vacuum into 'hell'`, true},
+		{sqllex.SQLite, `/* attach
+           database */ select 1`, true},
+		{sqllex.SQLite, "select `attach`, [vacuum] from t", true},
+		{sqllex.PostgreSQL, `select $$ATTACH$$, $x$ vacuum $x$`, true},
+		{sqllex.PostgreSQL, `/* nested /* attach */ vacuum */ select 1`, true},
 
 		// Things that should be disallowed despite being sneaky.
-		{` -- hide me
+		{sqllex.SQLite, ` -- hide me
         attach -- blah blah
           database "bad" -- you can't see me
         as demon_spawn;`, false},
+		{sqllex.SQLite, `select 1 /* done */; attach 'x' as y`, false},
+		{sqllex.SQLite, `select 'it''s'; vacuum`, false},
+		{sqllex.MySQL, `select /*! attach */ 1`, false},
+		{sqllex.Generic, "select `a` from t; vacuum", false},
+		{sqllex.Generic, `select $$ attach $$`, false},
+		{sqllex.Generic, `select [it's] ; attach 'x' as y --'`, false},
+		{sqllex.Generic, "select `it's`; attach 'x' as y --'", false},
+		{sqllex.Generic, `select 'it''s', "x" from t`, true},
+
+		// Malformed input is rejected.
+		{sqllex.SQLite, `select 'open`, false},
+		{sqllex.PostgreSQL, `select /* open`, false},
 	}
 	for _, tc := range tests {
-		err := checkQuerySyntax(tc.query)
+		err := checkQuerySyntax(tc.dialect, tc.query)
 		if tc.ok && err != nil {
-			t.Errorf("Query %q: unexpected error: %v", tc.query, err)
+			t.Errorf("Query %v %q: unexpected error: %v", tc.dialect, tc.query, err)
 		} else if !tc.ok && err == nil {
-			t.Errorf("Query %q: unexpectedly passed", tc.query)
+			t.Errorf("Query %v %q: unexpectedly passed", tc.dialect, tc.query)
 		}
 	}
 }
@@ -78,16 +101,33 @@ func TestOptions(t *testing.T) {
 			Label:   "Test DB 2",
 			Driver:  "sqlite",
 			KeyFile: "testdata/fake-test.key",
+			PoolOptions: PoolOptions{
+				MaxOpenConns:    4,
+				ConnMaxLifetime: Duration(10 * time.Minute),
+			},
 		}},
 		UILinks: []UILink{
 			{Anchor: "foo", URL: "http://foo"},
 			{Anchor: "bar", URL: "http://bar"},
 		},
+		Access: authorizer.Map{"test1": {"admin@example.com"}}.Policy(),
 	}
 	if diff := cmp.Diff(want, opts); diff != "" {
 		t.Errorf("Parsed options (-want, +got)\n%s", diff)
 	}
-	opts.Authorize = authorizer.ACLGrants(nil)
+	policyAuth := opts.authorize()
+
+	// An invalid access policy is reported by UnmarshalOptions.
+	bad := `{"access": {"rules": [{"sources": ["test1"], "allow": ["*"]}, {"name": "bad", "sources": ["test2"]}]}}`
+	if err := UnmarshalOptions([]byte(bad), new(Options)); err == nil {
+		t.Error("Parse invalid access policy: got nil, want error")
+	} else if !strings.Contains(err.Error(), `rule 2 ("bad")`) {
+		t.Errorf("Parse invalid access policy: got %v, want error naming rule 2", err)
+	}
+	misspelled := `{"access": {"rules": [{"sources": ["test1"], "alow": ["*"]}], "default": "allow"}}`
+	if err := UnmarshalOptions([]byte(misspelled), new(Options)); err == nil {
+		t.Error("Parse access policy with unknown field: got nil, want error")
+	}
 
 	// Test that we can populate options from the config.
 	t.Run("Options", func(t *testing.T) {
@@ -136,22 +176,378 @@ func TestOptions(t *testing.T) {
 				},
 			},
 		}
-		auth := opts.authorize()
+		tagged := &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{Name: "bot.ts.net.", Tags: []string{"tag:bot"}},
+			UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+		}
 
-		// test1 has access only to admin.
-		if err := auth("test1", admin); err != nil {
-			t.Errorf("Authorize admin for test1 failed: %v", err)
+		// The grants and the access policy in the config should agree.
+		for name, auth := range map[string]func(string, *apitype.WhoIsResponse) error{
+			"ACLGrants": authorizer.ACLGrants(nil),
+			"Policy":    policyAuth,
+		} {
+			// test1 has access only to admin.
+			if err := auth("test1", admin); err != nil {
+				t.Errorf("%s: Authorize admin for test1 failed: %v", name, err)
+			}
+			if err := auth("test1", hoiPolloi); err == nil {
+				t.Errorf("%s: Authorize other for test1 should not have succeeded", name)
+			}
+
+			// test2 has acces to any user.
+			if err := auth("test2", admin); err != nil {
+				t.Errorf("%s: Authorize admin for test2 failed: %v", name, err)
+			}
+			if err := auth("test2", hoiPolloi); err != nil {
+				t.Errorf("%s: Authorize other for test2 failed: %v", name, err)
+			}
+
+			// Tagged nodes have no access.
+			if err := auth("test2", tagged); err == nil {
+				t.Errorf("%s: Authorize tagged node for test2 should not have succeeded", name)
+			}
 		}
-		if err := auth("test1", hoiPolloi); err == nil {
-			t.Error("Authorize other for test1 should not have succeeded")
+	})
+}
+
+func TestSessionOptions(t *testing.T) {
+	path := t.TempDir() + "/session.db"
+	db, err := openAndPing(context.Background(), "sqlite", path, PoolOptions{})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`create table t (x integer); insert into t values (1), (2);`); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+
+	// run issues query to q and returns the first column of its results.
+	run := func(q Queryable, query string) ([]string, error) {
+		rs, err := q.Query(context.Background(), query)
+		if err != nil {
+			return nil, err
 		}
+		defer rs.Close()
+		var out []string
+		for rs.Next() {
+			var v string
+			if err := rs.Scan(&v); err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, rs.Err()
+	}
+	count := func() (n int) {
+		if err := db.QueryRow(`select count(*) from t`).Scan(&n); err != nil {
+			t.Fatalf("Count: %v", err)
+		}
+		return n
+	}
 
-		// test2 has acces to any user.
-		if err := auth("test2", admin); err != nil {
-			t.Errorf("Authorize admin for test2 failed: %v", err)
+	t.Run("ReadOnly", func(t *testing.T) {
+		if _, err := run(newSQLDB(db, "sqlite", SessionOptions{}), `delete from t returning x`); err == nil {
+			t.Error("Delete: got nil, want error")
 		}
-		if err := auth("test2", hoiPolloi); err != nil {
-			t.Errorf("Authorize other for test2 failed: %v", err)
+		if n := count(); n != 2 {
+			t.Errorf("Count: got %d, want 2", n)
 		}
 	})
+	t.Run("Rollback", func(t *testing.T) {
+		// Without a driver, there is no query_only setup, but the transaction
+		// is still rolled back. Use a separate pool, since query_only persists
+		// on the connections used above.
+		db2, err := openAndPing(context.Background(), "sqlite", path, PoolOptions{})
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		defer db2.Close()
+		if _, err := run(newSQLDB(db2, "", SessionOptions{}), `delete from t returning x`); err != nil {
+			t.Errorf("Delete: unexpected error: %v", err)
+		}
+		if n := count(); n != 2 {
+			t.Errorf("Count: got %d, want 2", n)
+		}
+	})
+	t.Run("Setup", func(t *testing.T) {
+		q := newSQLDB(db, "sqlite", SessionOptions{Setup: []string{`PRAGMA busy_timeout = 1234`}})
+		got, err := run(q, `PRAGMA busy_timeout`)
+		if err != nil {
+			t.Fatalf("Query: unexpected error: %v", err)
+		}
+		if diff := cmp.Diff([]string{"1234"}, got); diff != "" {
+			t.Errorf("Result (-want, +got):\n%s", diff)
+		}
+	})
+	t.Run("DriverSetup", func(t *testing.T) {
+		tests := []struct {
+			driver  string
+			timeout time.Duration
+			want    []string
+		}{
+			{"sqlite", 0, []string{"PRAGMA query_only = 1"}},
+			{"postgres", 0, nil},
+			{"postgres", 2 * time.Second, []string{"SET LOCAL statement_timeout = 2000"}},
+			// The MySQL setting persists in the session, so it is reset even
+			// when there is no timeout.
+			{"mysql", 0, []string{"SET SESSION max_execution_time = 0"}},
+			{"mysql", 2 * time.Second, []string{"SET SESSION max_execution_time = 2000"}},
+		}
+		for _, tc := range tests {
+			got := SessionOptions{StatementTimeout: Duration(tc.timeout)}.setup(tc.driver)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Setup %s %v (-want, +got):\n%s", tc.driver, tc.timeout, diff)
+			}
+		}
+	})
+	t.Run("Timeout", func(t *testing.T) {
+		q := newSQLDB(db, "sqlite", SessionOptions{StatementTimeout: Duration(50 * time.Millisecond)})
+		start := time.Now()
+		_, err := run(q, `with recursive c(x) as (select 1 union all select x+1 from c) select max(x) from c`)
+		if err == nil {
+			t.Error("Query: got nil, want error")
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("Query took %v, want it to stop after the timeout", d)
+		}
+	})
+	t.Run("Isolation", func(t *testing.T) {
+		for _, name := range []string{"", "read-committed", "Repeatable-Read", "serializable"} {
+			if err := (SessionOptions{Isolation: name}).checkValid(); err != nil {
+				t.Errorf("Isolation %q: unexpected error: %v", name, err)
+			}
+		}
+		if got := (SessionOptions{Isolation: "read-committed"}).txOptions(); got.Isolation != sql.LevelReadCommitted || !got.ReadOnly {
+			t.Errorf("txOptions: got %+v, want read-only read-committed", got)
+		}
+		if err := (SessionOptions{Isolation: "bogus"}).checkValid(); err == nil {
+			t.Error("Isolation bogus: got nil, want error")
+		}
+	})
+}
+
+func TestPushLimit(t *testing.T) {
+	const (
+		lite  = sqllex.SQLite
+		pg    = sqllex.PostgreSQL
+		my    = sqllex.MySQL
+		limit = 11
+	)
+	tests := []struct {
+		dialect sqllex.Dialect
+		query   string
+		want    string // "" means unchanged
+	}{
+		// Queries that are not rewritten.
+		{lite, "", ""},
+		{lite, "pragma table_info(t)", ""},
+		{lite, "select 1; select 2", ""},
+		{lite, "select * from t limit 5", ""},
+		{lite, "select * from t limit 11", ""},
+		{lite, "select * from t for update", ""},
+		{lite, "select 'open", ""},
+		{pg, "with d as (delete from t returning *) delete from u", ""},
+		{my, "select * from t limit 2, 5", ""},
+		{sqllex.Generic, "select * from t", ""},
+		{lite, "select * from t limit ?", ""},
+		{pg, "select * from t offset 5", ""},
+		{pg, "select * from t order by x fetch first 99 rows only;", ""},
+		{my, "select a.id, b.id from a join b on a.x = b.x limit ?", ""},
+
+		// Queries with a limit appended.
+		{lite, "select * from t", "select * from t LIMIT 11"},
+		{lite, "select * from t; -- done", "select * from t LIMIT 11; -- done"},
+		{lite, "select * from t -- no semicolon", "select * from t LIMIT 11 -- no semicolon"},
+		{lite, "select * from (select * from t limit 50)", "select * from (select * from t limit 50) LIMIT 11"},
+		{pg, "with x as (select 1 limit 99) select * from x", "with x as (select 1 limit 99) select * from x LIMIT 11"},
+		{my, "select 1 union select 2", "select 1 union select 2 LIMIT 11"},
+		{my, "select a.id, b.id from a join b on a.x = b.x order by a.id",
+			"select a.id, b.id from a join b on a.x = b.x order by a.id LIMIT 11"},
+
+		// Queries with a limit replaced.
+		{lite, "select * from t limit 500 offset 3", "select * from t limit 11 offset 3"},
+		{my, "select * from t limit 3, 500", "select * from t limit 3, 11"},
+		{pg, "select * from t LIMIT ALL", "select * from t LIMIT 11"},
+	}
+	for _, tc := range tests {
+		got, ok := pushLimit(tc.dialect, tc.query, limit)
+		if tc.want == "" {
+			if ok || got != tc.query {
+				t.Errorf("pushLimit %v %q: got %q, %v; want unchanged", tc.dialect, tc.query, got, ok)
+			}
+		} else if !ok || got != tc.want {
+			t.Errorf("pushLimit %v %q: got %q, %v; want %q", tc.dialect, tc.query, got, ok, tc.want)
+		}
+	}
+}
+
+func TestParseFederated(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string // source|table
+	}{
+		{"", nil},
+		{"select * from users", nil},
+		{"select 'from:main.users'", nil},
+		{"select 1 -- from:main.users", nil},
+		{"select * from from:main.users", []string{"main|users"}},
+		{"select * from from:main.users a join FROM:hr-db.\"Sal\"\"aries\" b", []string{"main|users", `hr-db|"Sal""aries"`}},
+		{"select * from from:pg.public.t, from:pg.[x y]", []string{"pg|public.t", "pg|[x y]"}},
+		{"select * from from:main", nil},
+		{"select * from from:main.", nil},
+	}
+	for _, tc := range tests {
+		var got []string
+		for _, ref := range parseFederated(tc.query) {
+			got = append(got, ref.source+"|"+ref.table)
+			if !strings.HasPrefix(strings.ToLower(tc.query[ref.start:ref.end]), "from:") {
+				t.Errorf("parseFederated %q: bad span %q", tc.query, tc.query[ref.start:ref.end])
+			}
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("parseFederated %q (-want, +got):\n%s", tc.query, diff)
+		}
+	}
+}
+
+func TestBindCallerVars(t *testing.T) {
+	who := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "laptop.ts.net"},
+		UserProfile: &tailcfg.UserProfile{ID: 25, LoginName: "user@example.com"},
+	}
+	tagged := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "server.ts.net", Tags: []string{"tag:prod", "tag:db"}},
+		UserProfile: &tailcfg.UserProfile{ID: 1, LoginName: "tagged-devices"},
+	}
+	tests := []struct {
+		dialect    sqllex.Dialect
+		who        *apitype.WhoIsResponse
+		input      string
+		wantQuery  string
+		wantParams []any
+	}{
+		// Queries without caller variables are not changed.
+		{sqllex.SQLite, nil, `select 1`, `select 1`, nil},
+		{sqllex.PostgreSQL, nil, `select x::text from t`, `select x::text from t`, nil},
+
+		{sqllex.SQLite, who,
+			`select * from devices where owner = :caller_login`,
+			`select * from devices where owner = ?`, []any{"user@example.com"}},
+		{sqllex.SQLite, who,
+			`select ':caller_login', name from t where id = :caller_user_id -- :caller_node`,
+			`select ':caller_login', name from t where id = ? -- :caller_node`, []any{int64(25)}},
+		{sqllex.PostgreSQL, who,
+			`select * from t where owner = :caller_login or node = :caller_node`,
+			`select * from t where owner = $1 or node = $2`, []any{"user@example.com", "laptop.ts.net"}},
+		{sqllex.MySQL, who,
+			`select * from t where node = :caller_node`,
+			`select * from t where node = ?`, []any{"laptop.ts.net"}},
+		{sqllex.Generic, tagged,
+			`select * from t where owner = :caller_login and tags = :caller_tags`,
+			`select * from t where owner = ? and tags = ?`, []any{"", `["tag:prod","tag:db"]`}},
+		{sqllex.SQLite, who,
+			`select * from t where tags = :caller_tags`,
+			`select * from t where tags = ?`, []any{`[]`}},
+	}
+	for _, tc := range tests {
+		query, params, err := bindCallerVars(tc.dialect, tc.input, tc.who)
+		if err != nil {
+			t.Errorf("Bind %v %q: unexpected error: %v", tc.dialect, tc.input, err)
+			continue
+		}
+		if query != tc.wantQuery {
+			t.Errorf("Bind %v %q: got query %q, want %q", tc.dialect, tc.input, query, tc.wantQuery)
+		}
+		if diff := cmp.Diff(tc.wantParams, params); diff != "" {
+			t.Errorf("Bind %v %q: params (-want, +got):\n%s", tc.dialect, tc.input, diff)
+		}
+	}
+
+	for _, bad := range []string{
+		`select * from t where x = :caller_nonesuch`,        // unknown variable
+		`select * from t where x = :caller_login and y = ?`, // other parameters
+	} {
+		if got, _, err := bindCallerVars(sqllex.SQLite, bad, who); err == nil {
+			t.Errorf("Bind %q: got %q, want error", bad, got)
+		}
+	}
+	if got, _, err := bindCallerVars(sqllex.SQLite, `select :caller_login`, nil); err == nil {
+		t.Errorf("Bind without caller: got %q, want error", got)
+	}
+}
+
+func TestAnnotateQuery(t *testing.T) {
+	who := &apitype.WhoIsResponse{Node: &tailcfg.Node{Name: "laptop.ts.net"}}
+	ctx := withRequestMeta(withWhoIs(context.Background(), who), requestMeta{id: "abc123"})
+
+	tests := []struct {
+		format, caller, want string
+	}{
+		{"", "alice@example.com", "select 1"},
+		{DefaultAnnotation, "alice@example.com",
+			"/* tailsql user=alice@example.com src=main req=abc123 */ select 1"},
+		{"app=tailsql node={node}", "", "/* app=tailsql node=laptop.ts.net */ select 1"},
+		{"user={user}", "", "/* user=- */ select 1"},
+
+		// Values cannot close the comment or add text outside it.
+		{"user={user}", "x*/ drop table users; /*", "/* user=x___drop_table_users____ */ select 1"},
+		{"user={user}", "a\nb'c\"d", "/* user=a_b_c_d */ select 1"},
+	}
+	for _, tc := range tests {
+		got := annotateQuery(ctx, tc.format, tc.caller, "main", "select 1")
+		if got != tc.want {
+			t.Errorf("Annotate %q %q: got %q, want %q", tc.format, tc.caller, got, tc.want)
+		}
+	}
+
+	for _, bad := range []string{"x */ y", "/* x", "user={login}"} {
+		if err := checkAnnotation(bad); err == nil {
+			t.Errorf("checkAnnotation %q: got nil, want error", bad)
+		}
+	}
+}
+
+func TestShutdownAbandon(t *testing.T) {
+	defer func(d time.Duration) { shutdownGrace = d }(shutdownGrace)
+	shutdownGrace = 10 * time.Millisecond
+
+	s, err := NewServer(Options{Logf: t.Logf})
+	if err != nil {
+		t.Fatalf("NewServer: unexpected error: %v", err)
+	}
+	db, err := openAndPing(context.Background(), "sqlite", t.TempDir()+"/shutdown.db", PoolOptions{})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	s.SetDB("main", db, nil)
+
+	// Simulate a request whose query ignores cancellation, and so holds its
+	// database handle until it is released.
+	if !s.reqs.begin() {
+		t.Fatal("Request not admitted")
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer s.reqs.end()
+		s.dbs.lookup("main").WithLock(context.Background(), func(context.Context, Queryable) error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(ctx) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Shutdown: got %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Shutdown did not return while a query ignored cancellation")
+	}
 }
@@ -0,0 +1,133 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tailsql
+
+import (
+	"strconv"
+
+	"github.com/tailscale/tailsql/sqllex"
+)
+
+// pushLimit rewrites query, written in dialect d, so that the database stops
+// after at most limit rows. It reports false and returns query unchanged if
+// query is not a single SELECT statement (optionally with a WITH clause), if
+// it already has a limit no larger than limit, or if d is not a dialect for
+// which the rewrite is known to be valid.
+//
+// If the query has no limit, one is appended. If it has a larger literal
+// limit, the limit is replaced. Otherwise, for example if the query has a
+// limit given by a parameter, or uses OFFSET or FETCH without LIMIT, the
+// query is left unchanged. Wrapping such a query in an outer SELECT is not
+// safe in general: MySQL rejects derived tables with duplicate column names,
+// and an outer query need not preserve the inner ORDER BY.
+func pushLimit(d sqllex.Dialect, query string, limit int) (string, bool) {
+	if d == sqllex.Generic || limit <= 0 {
+		return query, false
+	}
+	toks := sqllex.Scan(d, query)
+	for _, t := range toks {
+		if t.Kind == sqllex.Invalid {
+			return query, false
+		}
+	}
+	stmts := sqllex.Statements(toks)
+	if len(stmts) != 1 || !isSelect(stmts[0]) {
+		return query, false
+	}
+	stmt := stmts[0]
+
+	// Find the clauses at the top level of the statement that affect where
+	// or whether a limit may be added.
+	limitPos, fetchPos, offsetPos := -1, -1, -1
+	var depth int
+	for i, t := range stmt {
+		switch {
+		case t.Kind == sqllex.Punct && t.Text == "(":
+			depth++
+		case t.Kind == sqllex.Punct && t.Text == ")":
+			depth--
+		case depth != 0:
+			// skip nested expressions and subqueries
+		case t.Is("limit"):
+			limitPos = i
+		case t.Is("fetch"):
+			fetchPos = i
+		case t.Is("offset"):
+			offsetPos = i
+		case t.Is("for"), t.Is("into"), t.Is("lock"):
+			// Locking and INTO clauses follow the limit, and are not plain
+			// queries anyway.
+			return query, false
+		}
+	}
+
+	last := stmt[len(stmt)-1]
+	end := last.Pos.Offset + len(last.Text)
+
+	switch {
+	case limitPos >= 0:
+		// The count is the literal following LIMIT, or the second of two
+		// literals separated by a comma ("LIMIT offset, count").
+		n := limitPos + 1
+		if n+2 < len(stmt) && stmt[n].Kind == sqllex.Number && stmt[n+1].Text == "," {
+			n += 2
+		}
+		if n >= len(stmt) {
+			return query, false // incomplete; let the database complain
+		}
+		count := stmt[n]
+		if count.Kind == sqllex.Number {
+			if v, err := strconv.Atoi(count.Text); err == nil {
+				if v <= limit {
+					return query, false
+				}
+				pos := count.Pos.Offset
+				return query[:pos] + strconv.Itoa(limit) + query[pos+len(count.Text):], true
+			}
+		} else if count.Is("all") && d == sqllex.PostgreSQL {
+			pos := count.Pos.Offset
+			return query[:pos] + strconv.Itoa(limit) + query[pos+len(count.Text):], true
+		}
+		return query, false
+	case fetchPos >= 0, offsetPos >= 0:
+		return query, false
+	default:
+		return query[:end] + " LIMIT " + strconv.Itoa(limit) + query[end:], true
+	}
+}
+
+// isSelect reports whether stmt is a SELECT statement, possibly with leading
+// parentheses or a WITH clause.
+func isSelect(stmt []sqllex.Token) bool {
+	i := 0
+	for i < len(stmt) && stmt[i].Text == "(" {
+		i++
+	}
+	if i == len(stmt) {
+		return false
+	} else if stmt[i].Is("select") {
+		return true
+	} else if !stmt[i].Is("with") {
+		return false
+	}
+
+	// Skip the common table expressions to find the main statement.
+	var depth int
+	for _, t := range stmt[i+1:] {
+		switch {
+		case t.Kind == sqllex.Punct && t.Text == "(":
+			depth++
+		case t.Kind == sqllex.Punct && t.Text == ")":
+			depth--
+		case depth != 0 || t.Kind != sqllex.Word:
+			// skip
+		case t.Is("select"):
+			return true
+		case t.Is("insert"), t.Is("update"), t.Is("delete"), t.Is("replace"),
+			t.Is("merge"), t.Is("values"):
+			return false
+		}
+	}
+	return false
+}
@@ -35,6 +35,16 @@ var schema = &squibble.Schema{
 					`FROM raw_query_log JOIN queries USING (query_id)`,
 			),
 		},
+		{
+			Source: "bc780f7ed5ce806cd9c413e657c29c0a2b6770b1a2c28ba4ecdd5724a5fbfbdd",
+			Target: "c5cbc042112e708d50b43631bf6c1d6e4dcb10039e97055047dbb6af00378a69",
+			Apply: squibble.Exec(
+				`ALTER TABLE raw_query_log ADD COLUMN masked TEXT NULL`,
+				`DROP VIEW query_log`,
+				`CREATE VIEW query_log AS SELECT author, source, query, timestamp, elapsed, masked `+
+					`FROM raw_query_log JOIN queries USING (query_id)`,
+			),
+		},
 	},
 }
 
@@ -45,6 +55,8 @@ type localState struct {
 	// Shared: Read transaction
 	txmu   sync.RWMutex
 	rw, ro *sql.DB
+
+	self string // if non-empty, the source name of this database
 }
 
 // newLocalState constructs a new LocalState helper for the given database URL.
@@ -56,7 +68,7 @@ func newLocalState(url string) (*localState, error) {
 
 	// Open separate copies of the database for writing query logs vs. serving
 	// queries to the UI.
-	rw, err := openAndPing("sqlite", url)
+	rw, err := openAndPing(context.Background(), "sqlite", url, PoolOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -65,7 +77,7 @@ func newLocalState(url string) (*localState, error) {
 		return nil, fmt.Errorf("initializing schema: %w", err)
 	}
 
-	ro, err := openAndPing("sqlite", urlRO)
+	ro, err := openAndPing(context.Background(), "sqlite", urlRO, PoolOptions{})
 	if err != nil {
 		rw.Close()
 		return nil, err
@@ -78,9 +90,10 @@ func newLocalState(url string) (*localState, error) {
 // The user is the login of the user originating the query, q is the source
 // database and query SQL text.
 // If elapsed > 0, it is recorded as the elapsed execution time.
+// The names of any columns masked in the results are recorded from masked.
 //
 // If s == nil, the query is discarded without error.
-func (s *localState) LogQuery(ctx context.Context, user string, q Query, elapsed time.Duration) error {
+func (s *localState) LogQuery(ctx context.Context, user string, q Query, elapsed time.Duration, masked []string) error {
 	if s == nil {
 		return nil // OK, nothing to do
 	}
@@ -104,8 +117,9 @@ func (s *localState) LogQuery(ctx context.Context, user string, q Query, elapsed
 
 	// Add a log entry referencing the query ID.
 	ecol := sql.NullInt64{Int64: int64(elapsed / time.Microsecond), Valid: elapsed > 0}
-	_, err = tx.Exec(`INSERT INTO raw_query_log (author, source, query_id, elapsed) VALUES (?, ?, ?, ?)`,
-		user, q.Source, queryID, ecol)
+	mcol := sql.NullString{String: strings.Join(masked, ","), Valid: len(masked) != 0}
+	_, err = tx.Exec(`INSERT INTO raw_query_log (author, source, query_id, elapsed, masked) VALUES (?, ?, ?, ?, ?)`,
+		user, q.Source, queryID, ecol, mcol)
 	if err != nil {
 		return fmt.Errorf("update query log: %w", err)
 	}
@@ -113,6 +127,37 @@ func (s *localState) LogQuery(ctx context.Context, user string, q Query, elapsed
 	return tx.Commit()
 }
 
+// Audit implements the AuditSink interface. It records each query that
+// completed successfully in the query log, except queries to the local state
+// database itself.
+func (s *localState) Audit(ctx context.Context, events []AuditEvent) error {
+	var errs []error
+	for _, e := range events {
+		if e.Kind != AuditQueryEnd || e.Error != "" || (s.self != "" && e.Source == s.self) {
+			continue
+		}
+		q := Query{Source: e.Source, Query: e.Query}
+		if err := s.LogQuery(ctx, e.Caller, q, e.Elapsed.Duration(), e.Masked); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkWritable reports whether the query log can be written, by starting a
+// write to it and rolling it back.
+func (s *localState) checkWritable(ctx context.Context) error {
+	s.txmu.Lock()
+	defer s.txmu.Unlock()
+	tx, err := s.rw.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, `DELETE FROM raw_query_log WHERE 0`)
+	return err
+}
+
 // Query satisfies part of the Queryable interface. It supports only read queries.
 func (s *localState) Query(ctx context.Context, query string, params ...any) (RowSet, error) {
 	s.txmu.RLock()
@@ -120,6 +165,9 @@ func (s *localState) Query(ctx context.Context, query string, params ...any) (Ro
 	return s.ro.QueryContext(ctx, query, params...)
 }
 
+// PingContext implements the Pinger interface.
+func (s *localState) PingContext(ctx context.Context) error { return s.ro.PingContext(ctx) }
+
 // Close satisfies part of the Queryable interface.  For this database the
 // implementation is a no-op without error.
 func (*localState) Close() error { return nil }
@@ -0,0 +1,102 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tailsql
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"tailscale.com/types/logger"
+)
+
+// requestIDHeader is the response header that reports the ID the server
+// assigned to a request.
+const requestIDHeader = "X-Request-Id"
+
+type requestMetaKey struct{}
+
+// requestMeta is metadata about an HTTP request, recorded in its context.
+type requestMeta struct {
+	id         string // the ID assigned to the request
+	remoteAddr string // the address of the caller
+	path       string // the path of the request, without the route prefix
+}
+
+// newRequestID returns a new random request ID.
+func newRequestID() string {
+	var buf [8]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+// withRequestMeta returns a child of ctx that records m.
+func withRequestMeta(ctx context.Context, m requestMeta) context.Context {
+	return context.WithValue(ctx, requestMetaKey{}, m)
+}
+
+// requestMetaFromContext returns the metadata recorded in ctx by
+// withRequestMeta, and reports whether there was any.
+func requestMetaFromContext(ctx context.Context) (requestMeta, bool) {
+	m, ok := ctx.Value(requestMetaKey{}).(requestMeta)
+	return m, ok
+}
+
+// requestIDFromContext returns the request ID recorded in ctx, or "" if there
+// is none.
+func requestIDFromContext(ctx context.Context) string {
+	m, _ := requestMetaFromContext(ctx)
+	return m.id
+}
+
+// logger returns the logger of s, with the request ID from ctx, if any.
+func (s *Server) logger(ctx context.Context) *slog.Logger {
+	if id := requestIDFromContext(ctx); id != "" {
+		return s.log.With("request_id", id)
+	}
+	return s.log
+}
+
+// httpError replies to r with the given error message and HTTP code, like
+// http.Error, and includes the ID of the request in the message.
+func httpError(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	if id := requestIDFromContext(r.Context()); id != "" {
+		msg = fmt.Sprintf("%s (request ID %s)", msg, id)
+	}
+	http.Error(w, msg, code)
+}
+
+// queryHash returns a short hash of the text of query, to identify repeated
+// queries in the logs.
+func queryHash(query string) string {
+	h := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(h[:8])
+}
+
+// newLogfLogger returns a structured logger that formats each record as text
+// and sends it to logf.
+func newLogfLogger(logf logger.Logf) *slog.Logger {
+	return slog.New(slog.NewTextHandler(logfWriter(logf), &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{} // logf adds its own timestamp, if any
+			}
+			return a
+		},
+	}))
+}
+
+// logfWriter is an io.Writer that sends each write to a logf function. The
+// slog text handler writes each record with a single call.
+type logfWriter logger.Logf
+
+func (w logfWriter) Write(p []byte) (int, error) {
+	w("[tailsql] %s", bytes.TrimSuffix(p, []byte("\n")))
+	return len(p), nil
+}
@@ -0,0 +1,211 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tailsql
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/tailscale/tailsql/authorizer"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// A MaskRule describes how to mask the values of matching columns in the
+// results of queries, for callers who are not exempt from the rule.
+//
+// Masking is applied to the results of each source before they leave the
+// server by any path, and before they are combined with the results of other
+// sources by a federated, fan-out, or diff query.
+//
+// Rules match the names of the columns in a result, which an ad hoc query can
+// change, for example with "select name as n" or "select upper(name)". So a
+// caller who is subject to any rule for a source may query it only with named
+// queries, and with federated queries, which read whole tables.
+type MaskRule struct {
+	// The source whose results are masked. A name ending in "*" matches all
+	// sources with that prefix, and "*" or "" matches all sources.
+	Source string `json:"source,omitempty"`
+
+	// A pattern matching the names of the columns to mask, in the syntax of
+	// path.Match. Column names are matched without regard to case.
+	Column string `json:"column"`
+
+	// How to mask the values of matching columns.
+	Mode MaskMode `json:"mode"`
+
+	// Callers who are exempt from the rule, and see the original values. Each
+	// entry is a login name, a node name, a tag ("tag:name"), or the name of
+	// a peer capability prefixed by "cap:" (for example,
+	// "cap:example.com/cap/tailsql-pii"). If the server has no LocalClient,
+	// no caller is exempt.
+	Exempt []string `json:"exempt,omitempty"`
+}
+
+// A MaskMode specifies how a MaskRule masks column values. NULL values are
+// not masked by any mode.
+type MaskMode string
+
+const (
+	MaskRedact  MaskMode = "redact"  // replace the value with "[redacted]"
+	MaskPartial MaskMode = "partial" // replace all but the last 4 characters with "*"
+	MaskHash    MaskMode = "hash"    // replace the value with a keyed hash
+	MaskNull    MaskMode = "null"    // replace the value with NULL
+)
+
+// redactedValue is the value reported for a column masked with MaskRedact.
+const redactedValue = "[redacted]"
+
+func (r MaskRule) checkValid() error {
+	if r.Column == "" {
+		return errors.New("missing column pattern")
+	} else if _, err := path.Match(r.Column, ""); err != nil {
+		return fmt.Errorf("invalid column pattern %q: %w", r.Column, err)
+	}
+	switch r.Mode {
+	case MaskRedact, MaskPartial, MaskHash, MaskNull:
+		return nil
+	case "":
+		return errors.New("missing mode")
+	default:
+		return fmt.Errorf("unknown mode %q", r.Mode)
+	}
+}
+
+// matches reports whether r applies to column col of source src.
+func (r MaskRule) matches(src, col string) bool {
+	if r.Source != "" && !authorizer.MatchSource(r.Source, src) {
+		return false
+	}
+	ok, _ := path.Match(strings.ToLower(r.Column), strings.ToLower(col))
+	return ok
+}
+
+// restricts reports whether r masks any columns of source src for the caller
+// identified by who.
+func (r MaskRule) restricts(src string, who *apitype.WhoIsResponse) bool {
+	if r.Source != "" && !authorizer.MatchSource(r.Source, src) {
+		return false
+	}
+	return !r.exempts(who)
+}
+
+// checkMaskedQuery reports an error if the caller identified by who may not
+// send query to src because of the mask rules: Only named queries are allowed
+// on a source for which any rule restricts the caller (see MaskRule).
+func checkMaskedQuery(rules []MaskRule, src, query string, who *apitype.WhoIsResponse) error {
+	if strings.HasPrefix(query, "named:") {
+		return nil
+	}
+	for _, r := range rules {
+		if r.restricts(src, who) {
+			return statusErrorf(http.StatusForbidden, "source %q has masked columns, so only named queries are allowed", src)
+		}
+	}
+	return nil
+}
+
+// A tableQueryKey marks the context of a query generated by the server to
+// read a whole table, whose result columns are the columns of the table. Such
+// a query is allowed on sources with masked columns (see checkMaskedQuery).
+type tableQueryKey struct{}
+
+// isTableQuery reports whether ctx is marked by tableQueryKey.
+func isTableQuery(ctx context.Context) bool {
+	v, _ := ctx.Value(tableQueryKey{}).(bool)
+	return v
+}
+
+// exempts reports whether the caller identified by who is exempt from r.
+func (r MaskRule) exempts(who *apitype.WhoIsResponse) bool {
+	if who == nil {
+		return false
+	}
+	for _, e := range r.Exempt {
+		if capName, ok := strings.CutPrefix(e, "cap:"); ok {
+			if who.CapMap.HasCapability(tailcfg.PeerCapability(capName)) {
+				return true
+			}
+		} else if who.Node != nil && (e == who.Node.Name || slices.Contains(who.Node.Tags, e)) {
+			return true
+		} else if who.UserProfile != nil && (who.Node == nil || !who.Node.IsTagged()) && e == who.UserProfile.LoginName {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMasks validates the mask rules of o.
+func (o Options) checkMasks() error {
+	var errs []error
+	for i, r := range o.Masks {
+		if err := r.checkValid(); err != nil {
+			errs = append(errs, fmt.Errorf("mask rule %d: %w", i+1, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// maskResult masks the values of the columns of out, the results of a query
+// to src, as required by the mask rules for the caller identified by who. For
+// each column, the first rule that matches it applies, unless the caller is
+// exempt from that rule. It returns the names of the masked columns.
+func maskResult(rules []MaskRule, key []byte, src string, who *apitype.WhoIsResponse, out *dbResult) []string {
+	if len(rules) == 0 {
+		return nil
+	}
+	modes := make([]MaskMode, len(out.Columns))
+	var masked []string
+	for i, col := range out.Columns {
+		j := slices.IndexFunc(rules, func(r MaskRule) bool { return r.matches(src, col) })
+		if j >= 0 && !rules[j].exempts(who) {
+			modes[i] = rules[j].Mode
+			masked = append(masked, col)
+		}
+	}
+	if len(masked) == 0 {
+		return nil
+	}
+	for _, row := range out.Rows {
+		for i, mode := range modes {
+			if mode != "" {
+				row[i] = maskValue(mode, key, row[i])
+			}
+		}
+	}
+	return masked
+}
+
+// maskValue returns the value of v masked according to mode. The key is used
+// to compute hashes for MaskHash.
+func maskValue(mode MaskMode, key []byte, v any) any {
+	if v == nil {
+		return nil
+	}
+	switch mode {
+	case MaskRedact:
+		return redactedValue
+	case MaskPartial:
+		rs := []rune(valueToString(v, ""))
+		keep := 0
+		if len(rs) > 4 {
+			keep = 4
+		}
+		return strings.Repeat("*", len(rs)-keep) + string(rs[len(rs)-keep:])
+	case MaskHash:
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(valueToString(v, "")))
+		return hex.EncodeToString(h.Sum(nil))[:16]
+	default:
+		return nil
+	}
+}
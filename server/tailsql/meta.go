@@ -0,0 +1,220 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tailsql
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// A metaQuery is a query about the state of the server, rather than a query
+// to be sent to a database.
+type metaQuery struct {
+	name string
+	help string
+	run  func(s *Server, ctx context.Context) *dbResult // nil for meta:help
+}
+
+// metaQueries are the meta-queries understood by queryMeta, in the order
+// they are listed by "meta:help".
+var metaQueries = []metaQuery{
+	{"meta:help", "List the available meta-queries.", nil},
+	{"meta:named", "List the named queries of each source.", (*Server).metaNamed},
+	{"meta:sources", "List the sources with their drivers and health.", (*Server).metaSources},
+	{"meta:whoami", "Describe the caller and the sources they may query.", (*Server).metaWhoAmI},
+	{"meta:inflight", "List the queries currently running.", (*Server).metaInflight},
+	{"meta:limits", "List the limits applied to queries.", (*Server).metaLimits},
+}
+
+// queryMeta handles meta-queries for internal state. Results about specific
+// sources include only those the caller is authorized to query.
+func (s *Server) queryMeta(ctx context.Context, query string) (*dbResult, error) {
+	for _, mq := range metaQueries {
+		if mq.name == query {
+			var res *dbResult
+			if mq.run == nil {
+				res = metaHelp() // refers to metaQueries, so is not listed there
+			} else {
+				res = mq.run(s, ctx)
+			}
+			res.NumRows = len(res.Rows)
+			return res, nil
+		}
+	}
+	return nil, statusErrorf(http.StatusBadRequest, "unknown meta-query %q (see meta:help)", query)
+}
+
+// canAccess reports whether the caller identified by ctx is authorized to
+// query src.
+func (s *Server) canAccess(ctx context.Context, src string) bool {
+	if s.lc == nil {
+		return true // no authorization checks
+	}
+	who := whoIsFromContext(ctx)
+	return who != nil && s.settings().authorize(src, who) == nil
+}
+
+// accessibleHandles returns the database handles the caller identified by ctx
+// is authorized to query.
+func (s *Server) accessibleHandles(ctx context.Context) []*dbHandle {
+	var out []*dbHandle
+	for _, h := range s.getHandles() {
+		if s.canAccess(ctx, h.Source()) {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+func metaHelp() *dbResult {
+	res := &dbResult{Columns: []string{"query", "description"}}
+	for _, mq := range metaQueries {
+		res.Rows = append(res.Rows, []any{mq.name, mq.help})
+	}
+	return res
+}
+
+func (s *Server) metaNamed(ctx context.Context) *dbResult {
+	res := &dbResult{Columns: []string{"source", "label", "queryName", "sql"}}
+	for _, h := range s.accessibleHandles(ctx) {
+		source, label := h.Source(), h.Label()
+		named := h.Named()
+		names := make([]string, 0, len(named))
+		for name := range named {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			res.Rows = append(res.Rows, []any{source, label, name, named[name]})
+		}
+	}
+	return res
+}
+
+func (s *Server) metaSources(ctx context.Context) *dbResult {
+	res := &dbResult{Columns: []string{"source", "label", "driver", "health", "lastError"}}
+	for _, h := range s.accessibleHandles(ctx) {
+		hs := h.Health()
+		res.Rows = append(res.Rows, []any{h.Source(), h.Label(), h.Driver(), string(hs.Status), hs.LastError})
+	}
+	return res
+}
+
+func (s *Server) metaWhoAmI(ctx context.Context) *dbResult {
+	res := &dbResult{Columns: []string{"login", "node", "tags", "sources"}}
+	var login, node, tags string
+	if who := whoIsFromContext(ctx); who != nil {
+		if who.UserProfile != nil {
+			login = who.UserProfile.LoginName
+		}
+		if who.Node != nil {
+			node = who.Node.Name
+			tags = strings.Join(who.Node.Tags, ",")
+		}
+	}
+	var srcs []string
+	for _, h := range s.accessibleHandles(ctx) {
+		srcs = append(srcs, h.Source())
+	}
+	res.Rows = append(res.Rows, []any{login, node, tags, strings.Join(srcs, ",")})
+	return res
+}
+
+func (s *Server) metaInflight(ctx context.Context) *dbResult {
+	res := &dbResult{Columns: []string{"source", "caller", "query", "started", "elapsed"}}
+	now := time.Now()
+	for _, q := range s.inflight.list() {
+		if !s.canAccess(ctx, q.source) {
+			continue
+		}
+		res.Rows = append(res.Rows, []any{
+			q.source, q.caller, q.query, q.start.UTC().Format(time.RFC3339), now.Sub(q.start).Round(time.Millisecond).String(),
+		})
+	}
+	return res
+}
+
+func (s *Server) metaLimits(ctx context.Context) *dbResult {
+	res := &dbResult{Columns: []string{"setting", "source", "value"}}
+	cfg := s.settings()
+	timeout := "none"
+	if cfg.qtimeout > 0 {
+		timeout = cfg.qtimeout.String()
+	}
+	res.Rows = append(res.Rows,
+		[]any{"queryTimeout", "", timeout},
+		[]any{"rowLimit", "", cfg.rowLimit},
+		[]any{"uiRowLimit", "", cfg.uiRowLimit},
+		[]any{"fanoutLimit", "", cfg.fanoutLimit},
+	)
+	for _, h := range s.accessibleHandles(ctx) {
+		if lim := cfg.pushdownLimit(h); lim > 0 {
+			res.Rows = append(res.Rows, []any{"limitPushdown", h.Source(), lim})
+		}
+	}
+	return res
+}
+
+// inflightSet tracks the queries currently running on a server.
+type inflightSet struct {
+	mu   sync.Mutex
+	next int
+	runs map[int]inflightQuery
+}
+
+// An inflightQuery describes a query in progress.
+type inflightQuery struct {
+	source, caller, query string
+	start                 time.Time
+}
+
+// add records q as in flight, and returns a function that removes it.
+func (f *inflightSet) add(q inflightQuery) func() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.runs == nil {
+		f.runs = make(map[int]inflightQuery)
+	}
+	id := f.next
+	f.next++
+	f.runs[id] = q
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.runs, id)
+	}
+}
+
+// list returns the queries in flight, oldest first.
+func (f *inflightSet) list() []inflightQuery {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]inflightQuery, 0, len(f.runs))
+	for _, q := range f.runs {
+		out = append(out, q)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].start.Before(out[j].start) })
+	return out
+}
+
+type whoIsKey struct{}
+
+// withWhoIs returns a context derived from ctx that carries who, the
+// identity of the caller of a request.
+func withWhoIs(ctx context.Context, who *apitype.WhoIsResponse) context.Context {
+	return context.WithValue(ctx, whoIsKey{}, who)
+}
+
+// whoIsFromContext returns the identity of the caller recorded in ctx by
+// withWhoIs, or nil if there is none.
+func whoIsFromContext(ctx context.Context) *apitype.WhoIsResponse {
+	who, _ := ctx.Value(whoIsKey{}).(*apitype.WhoIsResponse)
+	return who
+}
@@ -4,37 +4,180 @@
 package tailsql
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"expvar"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
 
 	"tailscale.com/metrics"
 )
 
-var (
-	apiRequestCount      = &metrics.LabelMap{Label: "type"}
-	htmlRequestCount     = new(expvar.Int)
-	csvRequestCount      = new(expvar.Int)
-	jsonRequestCount     = new(expvar.Int)
-	metaRequestCount     = new(expvar.Int)
-	apiErrorCount        = &metrics.LabelMap{Label: "type"}
-	authErrorCount       = new(expvar.Int)
-	badRequestErrorCount = new(expvar.Int)
-	internalErrorCount   = new(expvar.Int)
-	queryErrorCount      = new(expvar.Int)
-)
+// serverMetrics are the metrics of a Server. The names of the variables
+// published by add follow the conventions of tsweb's varz handler, which
+// renders them in Prometheus format.
+type serverMetrics struct {
+	requests *metrics.LabelMap // API requests by format
+	errors   *metrics.LabelMap // API errors by type
+
+	queries     *metrics.LabelMap // queries by source
+	queryErrors *metrics.LabelMap // failed queries by source
+	timeouts    *metrics.LabelMap // queries that exceeded the timeout, by source
+	truncated   *metrics.LabelMap // queries that exceeded the row limit, by source
+	denied      *metrics.LabelMap // authorization denials by source
+	rows        *metrics.LabelMap // rows read by source
+	bytes       *metrics.LabelMap // approximate bytes read by source
+	inflight    expvar.Int        // queries in progress
+	duration    *durationHistogram
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		requests:    &metrics.LabelMap{Label: "type"},
+		errors:      &metrics.LabelMap{Label: "type"},
+		queries:     &metrics.LabelMap{Label: "source"},
+		queryErrors: &metrics.LabelMap{Label: "source"},
+		timeouts:    &metrics.LabelMap{Label: "source"},
+		truncated:   &metrics.LabelMap{Label: "source"},
+		denied:      &metrics.LabelMap{Label: "source"},
+		rows:        &metrics.LabelMap{Label: "source"},
+		bytes:       &metrics.LabelMap{Label: "source"},
+		duration:    newDurationHistogram("source", durationBuckets),
+	}
+}
+
+// durationBuckets are the upper bounds of the query duration histogram
+// buckets, in seconds.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+func (s *Server) addMetrics(m *expvar.Map) {
+	sm := s.metrics
+	m.Set("counter_api_request", sm.requests)
+	m.Set("counter_api_error", sm.errors)
+	m.Set("counter_query", sm.queries)
+	m.Set("counter_query_error", sm.queryErrors)
+	m.Set("counter_query_timeout", sm.timeouts)
+	m.Set("counter_query_truncated", sm.truncated)
+	m.Set("counter_auth_denied", sm.denied)
+	m.Set("counter_query_rows", sm.rows)
+	m.Set("counter_query_bytes", sm.bytes)
+	m.Set("gauge_query_inflight", &sm.inflight)
+	m.Set("query_duration_seconds", sm.duration)
+	m.Set("db_pool_stats", expvar.Func(func() any { return s.poolStats() }))
+}
+
+// recordQuery records the completion of a query to src that read rows rows
+// and nbytes bytes in elapsed time. If the query failed, err is its error,
+// and ctx is the query context, to tell whether it timed out.
+func (m *serverMetrics) recordQuery(ctx context.Context, src string, elapsed time.Duration, rows, nbytes int, err error) {
+	m.queries.Add(src, 1)
+	m.duration.observe(src, elapsed.Seconds())
+	m.rows.Add(src, int64(rows))
+	m.bytes.Add(src, int64(nbytes))
+	switch {
+	case err == nil:
+	case errors.Is(err, errTooManyRows):
+		m.truncated.Add(src, 1)
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		m.timeouts.Add(src, 1)
+		m.queryErrors.Add(src, 1)
+	default:
+		m.queryErrors.Add(src, 1)
+	}
+}
 
-func init() {
-	apiRequestCount.Set("html", htmlRequestCount)
-	apiRequestCount.Set("csv", csvRequestCount)
-	apiRequestCount.Set("json", jsonRequestCount)
-	apiRequestCount.Set("meta", metaRequestCount)
+// poolStats returns a map from source names to connection pool statistics,
+// for each source of s whose database is managed by database/sql.
+func (s *Server) poolStats() map[string]sql.DBStats {
+	stats := make(map[string]sql.DBStats)
+	for _, h := range s.getHandles() {
+		if st, ok := h.poolStats(); ok {
+			stats[h.Source()] = st
+		}
+	}
+	return stats
+}
+
+// A durationHistogram is a histogram of observed values, with a separate set
+// of buckets for each value of a label. It implements the WritePrometheus
+// method recognized by tsweb's varz handler, and its String method reports
+// the counts and sums as JSON for expvar.
+type durationHistogram struct {
+	label   string
+	buckets []float64 // upper bounds, in increasing order
+
+	mu   sync.Mutex
+	vals map[string]*histogramData // label value → data
+}
+
+type histogramData struct {
+	counts []int64 // non-cumulative count for each bucket, plus +Inf
+	sum    float64
+	count  int64
+}
+
+func newDurationHistogram(label string, buckets []float64) *durationHistogram {
+	return &durationHistogram{label: label, buckets: buckets, vals: make(map[string]*histogramData)}
+}
+
+// observe records the value v for the given label value.
+func (h *durationHistogram) observe(key string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	d, ok := h.vals[key]
+	if !ok {
+		d = &histogramData{counts: make([]int64, len(h.buckets)+1)}
+		h.vals[key] = d
+	}
+	i, _ := slices.BinarySearch(h.buckets, v)
+	d.counts[i]++
+	d.sum += v
+	d.count++
+}
 
-	apiErrorCount.Set("auth", authErrorCount)
-	apiErrorCount.Set("bad_request", badRequestErrorCount)
-	apiErrorCount.Set("internal", internalErrorCount)
-	apiErrorCount.Set("query", queryErrorCount)
+// WritePrometheus writes h to w in Prometheus text format, as a histogram
+// with the given name.
+func (h *durationHistogram) WritePrometheus(w io.Writer, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	keys := make([]string, 0, len(h.vals))
+	for key := range h.vals {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		d := h.vals[key]
+		var cum int64
+		for i, le := range h.buckets {
+			cum += d.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=%q} %d\n", name, h.label, key,
+				strconv.FormatFloat(le, 'g', -1, 64), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", name, h.label, key, d.count)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %v\n", name, h.label, key, d.sum)
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", name, h.label, key, d.count)
+	}
 }
 
-func addMetrics(m *expvar.Map) {
-	m.Set("counter_api_request", apiRequestCount)
-	m.Set("counter_api_error", apiErrorCount)
+// String implements the expvar.Var interface.
+func (h *durationHistogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	type entry struct {
+		Count int64   `json:"count"`
+		Sum   float64 `json:"sum"`
+	}
+	out := make(map[string]entry, len(h.vals))
+	for key, d := range h.vals {
+		out[key] = entry{Count: d.count, Sum: d.sum}
+	}
+	data, _ := json.Marshal(out)
+	return string(data)
 }
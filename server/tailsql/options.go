@@ -4,13 +4,19 @@
 package tailsql
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"expvar"
 	"fmt"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"regexp"
 	"strings"
@@ -20,6 +26,8 @@ import (
 
 	"github.com/tailscale/hujson"
 	"github.com/tailscale/setec/client/setec"
+	"github.com/tailscale/tailsql/authorizer"
+	"github.com/tailscale/tailsql/sqllex"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/types/logger"
 )
@@ -63,6 +71,44 @@ type Options struct {
 	// The maximum timeout for a database query (0 means no timeout).
 	QueryTimeout Duration `json:"queryTimeout,omitempty"`
 
+	// If true, a source that cannot be opened when the server starts does not
+	// cause NewServer to fail. Instead, the source is reported as down, and the
+	// server keeps trying to open it in the background.
+	AllowUnavailable bool `json:"allowUnavailable,omitempty"`
+
+	// If positive, check the health of each source at this interval. Only
+	// sources whose database implements the Pinger interface are checked.
+	HealthCheckInterval Duration `json:"healthCheckInterval,omitempty"`
+
+	// The maximum number of rows to fetch from the database for a single query.
+	// If zero or negative, a default limit of 10000 rows is used.
+	RowLimit int `json:"rowLimit,omitempty"`
+
+	// The maximum number of rows to render for a single query in the UI.
+	// If zero or negative, a default limit of 500 rows is used.
+	UIRowLimit int `json:"uiRowLimit,omitempty"`
+
+	// The maximum number of sources to query concurrently for a query whose
+	// source is a pattern, such as "shard*".  If zero or negative, a default
+	// limit of 4 is used.
+	FanoutLimit int `json:"fanoutLimit,omitempty"`
+
+	// If set, record audit events using the built-in sinks it describes, in
+	// addition to AuditSinks.
+	Audit *AuditConfig `json:"audit,omitempty"`
+
+	// Rules for masking the values of sensitive columns in query results,
+	// depending on the caller. For each column, the first matching rule
+	// applies. See MaskRule.
+	Masks []MaskRule `json:"masks,omitempty"`
+
+	// The name of a secret whose value is the key for hashing masked values
+	// (see MaskHash), fetched from the secret provider when the server
+	// starts. If neither this nor MaskKey is set, a random key is chosen when
+	// the server starts, so that hashed values differ between runs of the
+	// server.
+	MaskKeySecret string `json:"maskKeySecret,omitempty"`
+
 	// The fields below are not encoded for storage.
 
 	// A connection to tailscaled for authorization checks. If nil, no
@@ -70,7 +116,12 @@ type Options struct {
 	LocalClient LocalClient `json:"-"`
 
 	// If non-nil, the server will add metrics to this map. The caller is
-	// responsible for ensuring the map is published.
+	// responsible for ensuring the map is published. The metrics belong to
+	// this server, and are named following the conventions of the tsweb varz
+	// handler, which renders them in Prometheus format. They include request
+	// and error counts, per-source query counts, errors, timeouts,
+	// truncations, rows, bytes, and authorization denials, a gauge of
+	// queries in progress, and a per-source histogram of query durations.
 	Metrics *expvar.Map `json:"-"`
 
 	// If non-nil and a LocalClient is available, Authorize is called for each
@@ -81,13 +132,34 @@ type Options struct {
 	// to accept any logged-in user, rejecting tagged nodes.
 	//
 	// If no LocalClient is available, this field is ignored, no authorization
-	// checks are performed, and all requests are accepted.
+	// checks are performed, and all requests are accepted. It is also ignored
+	// if Access is set.
 	Authorize func(src string, info *apitype.WhoIsResponse) error `json:"-"`
 
-	// If non-nil, use this store to fetch secret values. This is required if
-	// any of the sources specifies a named secret for its connection string.
+	// If set, a declarative access policy for the sources, which is used
+	// instead of Authorize. The policy logs its decisions to the logger set in
+	// the options. Unlike the Authorize callback, it can be set in a config
+	// file, so that Reload can change it.
+	Access *authorizer.Policy `json:"access,omitempty"`
+
+	// If non-empty, the key for hashing masked values (see MaskHash). This
+	// takes precedence over MaskKeySecret.
+	MaskKey []byte `json:"-"`
+
+	// If non-nil, use this store to fetch secret values. A secret provider is
+	// required if any of the sources specifies a named secret for its
+	// connection string. This is ignored if SecretProvider or Secrets is set.
 	SecretStore *setec.Store `json:"-"`
 
+	// If non-nil, use this provider to fetch secret values. This takes
+	// precedence over Secrets and SecretStore.
+	SecretProvider SecretProvider `json:"-"`
+
+	// If set, fetch secret values from the built-in provider it describes.
+	// This is ignored if SecretProvider is set, and takes precedence over
+	// SecretStore.
+	Secrets *SecretConfig `json:"secrets,omitempty"`
+
 	// Optional rules to apply when rendering text for presentation in the UI.
 	// After generating the value string, each rule is matched in order, and the
 	// first match (if any) is applied to rewrite the output. The value returned
@@ -97,11 +169,65 @@ type Options struct {
 	// If non-nil, call this function with each query presented to the API.  If
 	// the function reports an error, the query fails; otherwise the returned
 	// query state is used to service the query.  If nil, DefaultCheckQuery is
-	// used.
+	// used. The querycheck package provides composable checks.
+	//
+	// If the request does not name a source, the Source of the query is the
+	// default source when the function is called.
 	CheckQuery func(Query) (Query, error) `json:"-"`
 
-	// If non-nil, send logs to this logger. If nil, use log.Printf.
+	// If non-nil, send structured logs to this logger. Each log about a
+	// request includes its request ID, and logs about queries include the
+	// caller, source, query hash, elapsed time, rows read, and error.
+	Logger *slog.Logger `json:"-"`
+
+	// If Logger is nil and Logf is non-nil, format logs as text and send them
+	// to this function. If both are nil, use log.Printf.
 	Logf logger.Logf `json:"-"`
+
+	// If non-nil, call these hooks at points in the life of each request
+	// (see Hooks).
+	Hooks Hooks `json:"-"`
+
+	// Additional sinks to receive audit events (see AuditSink). When the
+	// server is closed, any of these that implement io.Closer are closed.
+	AuditSinks []AuditSink `json:"-"`
+}
+
+// secretProvider returns the secret provider specified by options, or nil if
+// none is specified.
+func (o Options) secretProvider() (SecretProvider, error) {
+	switch {
+	case o.SecretProvider != nil:
+		return o.SecretProvider, nil
+	case o.Secrets != nil:
+		return o.Secrets.provider()
+	case o.SecretStore != nil:
+		return SetecSecrets{Store: o.SecretStore}, nil
+	}
+	return nil, nil
+}
+
+// auditor starts delivery of audit events to the sinks specified by o, and to
+// state if it is not nil.
+func (o Options) auditor(state *localState) *auditor {
+	sinks := append([]AuditSink(nil), o.AuditSinks...)
+	var buffer int
+	if o.Audit != nil {
+		sinks = append(sinks, o.Audit.sinks()...)
+		buffer = o.Audit.Buffer
+	}
+	if state != nil {
+		sinks = append(sinks, SyncAuditSink(state))
+	}
+	return newAuditor(sinks, buffer, o.logger())
+}
+
+// hooks returns the hooks specified by options, or hooks that do nothing.
+func (o Options) hooks() Hooks {
+	if o.Hooks == nil {
+		return BaseHooks{}
+	}
+	return o.Hooks
 }
 
 // checkQuery returns the query check function specified by options, or a
@@ -114,94 +240,110 @@ func (o Options) checkQuery() func(Query) (Query, error) {
 }
 
 // openSources opens database handles to each of the sources defined by o.
-// Sources that require secrets will get them from store.
+// Sources that require secrets will get them from secrets.
+//
+// If a source cannot be opened and o.AllowUnavailable is true, its handle is
+// a placeholder reporting the source as down; otherwise openSources fails.
+//
 // Precondition: All the sources of o have already been validated.
-func (o Options) openSources(ctx context.Context, store *setec.Store) ([]*setec.Updater[*dbHandle], error) {
+func (o Options) openSources(ctx context.Context, secrets SecretProvider) ([]*setec.Updater[*dbHandle], error) {
 	if len(o.Sources) == 0 {
 		return nil, nil
 	}
 
 	srcs := make([]*setec.Updater[*dbHandle], len(o.Sources))
 	for i, spec := range o.Sources {
-		if spec.Label == "" {
-			spec.Label = "(unidentified database)"
-		}
-
-		// Case 1: A programmatic source.
-		if spec.DB != nil {
-			srcs[i] = setec.StaticUpdater(&dbHandle{
-				src:   spec.Source,
-				label: spec.Label,
-				named: spec.Named,
-				db:    spec.DB,
-			})
-			continue
-		}
-
-		// Case 2: A database managed by database/sql, with a secret from setec.
-		if spec.Secret != "" {
-			// We actually only maintain a single value, that is updated in-place.
-			h := &dbHandle{src: spec.Source, label: spec.Label, named: spec.Named}
-			u, err := setec.NewUpdater(ctx, store, spec.Secret, func(secret []byte) (*dbHandle, error) {
-				db, err := openAndPing(spec.Driver, string(secret))
-				if err != nil {
-					return nil, err
-				}
-				o.logf()("[tailsql] opened new connection for source %q", spec.Source)
-				h.mu.Lock()
-				defer h.mu.Unlock()
-				if h.db != nil {
-					h.db.Close() // close the active handle
-				}
-				if up := h.checkUpdate(); up != nil {
-					up.newDB.Close() // close a previous pending update
-				}
-				h.db = sqlDB{DB: db}
-				return h, nil
-			})
-			if err != nil {
+		u, err := o.openSource(ctx, secrets, spec)
+		if err != nil {
+			if !o.AllowUnavailable {
 				return nil, err
 			}
-			srcs[i] = u
-			continue
+			o.logger().Warn("source is unavailable", "source", spec.Source, "error", err)
+			u = setec.StaticUpdater(newUnavailableHandle(spec, err))
 		}
+		srcs[i] = u
+	}
+	return srcs, nil
+}
 
-		// Case 3: A database managed by database/sql, with a fixed URL.
-		var connString string
-		switch {
-		case spec.URL != "":
-			connString = spec.URL
-		case spec.KeyFile != "":
-			data, err := os.ReadFile(os.ExpandEnv(spec.KeyFile))
-			if err != nil {
-				return nil, fmt.Errorf("read key file for %q: %w", spec.Source, err)
-			}
-			connString = strings.TrimSpace(string(data))
-		default:
-			panic("unexpected: no connection source is defined after validation")
-		}
+// openSource opens a database handle for the source defined by spec.
+// If spec requires a secret, it is fetched from secrets.
+// Precondition: spec has already been validated.
+func (o Options) openSource(ctx context.Context, secrets SecretProvider, spec DBSpec) (*setec.Updater[*dbHandle], error) {
+	spec.Label = spec.label()
+
+	// Case 1: A programmatic source.
+	if spec.DB != nil {
+		return setec.StaticUpdater(&dbHandle{
+			src:   spec.Source,
+			conf:  programmaticConf,
+			label: spec.Label,
+			named: spec.Named,
+			db:    spec.DB,
+		}), nil
+	}
 
-		// Open and ping the database to ensure it is approximately usable.
-		db, err := openAndPing(spec.Driver, connString)
+	// Case 2: A database managed by database/sql, with a secret. When the
+	// secret changes, the handle is updated in place (see watchSecret).
+	if spec.Secret != "" {
+		if secrets == nil {
+			return nil, errors.New("named secret but no secret provider")
+		}
+		get, err := secrets.Secret(ctx, spec.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("secret %q: %w", spec.Secret, err)
+		}
+		value := get()
+		db, err := openAndPing(ctx, spec.Driver, string(value), spec.PoolOptions)
 		if err != nil {
 			return nil, err
 		}
-		srcs[i] = setec.StaticUpdater(&dbHandle{
+		return setec.StaticUpdater(&dbHandle{
 			src:    spec.Source,
 			driver: spec.Driver,
+			conf:   spec.connKey(""),
 			label:  spec.Label,
 			named:  spec.Named,
-			db:     sqlDB{DB: db},
-		})
+			db:     newSQLDB(db, spec.Driver, spec.SessionOptions),
+			secret: &secretWatch{
+				get:     get,
+				driver:  spec.Driver,
+				pool:    spec.PoolOptions,
+				session: spec.SessionOptions,
+				log:     o.logger(),
+				last:    value,
+			},
+		}), nil
 	}
-	return srcs, nil
+
+	// Case 3: A database managed by database/sql, with a fixed URL.
+	connString, err := spec.connString()
+	if err != nil {
+		return nil, err
+	}
+
+	// Open and ping the database to ensure it is approximately usable.
+	db, err := openAndPing(ctx, spec.Driver, connString, spec.PoolOptions)
+	if err != nil {
+		return nil, err
+	}
+	return setec.StaticUpdater(&dbHandle{
+		src:    spec.Source,
+		driver: spec.Driver,
+		conf:   spec.connKey(connString),
+		label:  spec.Label,
+		named:  spec.Named,
+		db:     newSQLDB(db, spec.Driver, spec.SessionOptions),
+	}), nil
 }
 
-func openAndPing(driver, connString string) (*sql.DB, error) {
+func openAndPing(ctx context.Context, driver, connString string, pool PoolOptions) (*sql.DB, error) {
 	db, err := sql.Open(driver, connString)
 	if err != nil {
 		return nil, fmt.Errorf("open %s: %w", driver, err)
-	} else if err := db.PingContext(context.Background()); err != nil {
+	}
+	pool.apply(db)
+	if err := db.PingContext(ctx); err != nil {
 		db.Close()
 		return nil, fmt.Errorf("ping %s: %w", driver, err)
 	}
@@ -209,26 +351,119 @@ func openAndPing(driver, connString string) (*sql.DB, error) {
 }
 
 // CheckSources validates the sources of o. If this succeeds, it also returns a
-// slice of any secret names required by the specified sources, if any.
+// slice of any secret names required by the specified sources and the mask
+// key, if any.
 func (o Options) CheckSources() ([]string, error) {
 	var secrets []string
+	seen := make(map[string]bool)
+	if o.LocalState != "" && o.LocalSource != "" {
+		seen[o.LocalSource] = true
+	}
 	for i := range o.Sources {
 		if err := o.Sources[i].checkValid(); err != nil {
 			return nil, err
 		}
+		src := o.Sources[i].Source
+		if seen[src] {
+			return nil, fmt.Errorf("duplicate source name %q", src)
+		}
+		seen[src] = true
 		if s := o.Sources[i].Secret; s != "" {
 			secrets = append(secrets, s)
 		}
 	}
+	if len(o.MaskKey) == 0 && o.MaskKeySecret != "" {
+		secrets = append(secrets, o.MaskKeySecret)
+	}
 	return secrets, nil
 }
 
+// maskKey returns the key for hashing masked values: MaskKey if set,
+// otherwise the value of MaskKeySecret from secrets, otherwise a random key.
+func (o Options) maskKey(ctx context.Context, secrets SecretProvider) ([]byte, error) {
+	switch {
+	case len(o.MaskKey) != 0:
+		return bytes.Clone(o.MaskKey), nil
+	case o.MaskKeySecret != "":
+		if secrets == nil {
+			return nil, errors.New("named secret but no secret provider")
+		}
+		get, err := secrets.Secret(ctx, o.MaskKeySecret)
+		if err != nil {
+			return nil, fmt.Errorf("secret %q: %w", o.MaskKeySecret, err)
+		}
+		key := bytes.TrimSpace(get())
+		if len(key) == 0 {
+			return nil, fmt.Errorf("secret %q is empty", o.MaskKeySecret)
+		}
+		return key, nil
+	default:
+		key := make([]byte, 32)
+		rand.Read(key)
+		return key, nil
+	}
+}
+
 func (o Options) localState() (*localState, error) {
 	if o.LocalState == "" {
 		return nil, nil
 	}
 	url := os.ExpandEnv(o.LocalState)
-	return newLocalState(url)
+	st, err := newLocalState(url)
+	if err != nil {
+		return nil, err
+	}
+	st.self = o.LocalSource
+	return st, nil
+}
+
+// settings returns the reloadable server settings defined by o.
+func (o Options) settings() serverSettings {
+	const (
+		defaultRowLimit    = 10000
+		defaultUIRowLimit  = 500
+		defaultFanoutLimit = 4
+	)
+	cfg := serverSettings{
+		links:       o.UILinks,
+		qtimeout:    o.QueryTimeout.Duration(),
+		rowLimit:    o.RowLimit,
+		uiRowLimit:  o.UIRowLimit,
+		fanoutLimit: o.FanoutLimit,
+		masks:       o.Masks,
+		authorize:   o.authorize(),
+		qcheck:      o.checkQuery(),
+	}
+	for _, spec := range o.Sources {
+		if spec.NoLimitPushdown {
+			if cfg.noPushdown == nil {
+				cfg.noPushdown = make(map[string]bool)
+			}
+			cfg.noPushdown[spec.Source] = true
+		}
+		if spec.Annotation != "" {
+			if cfg.annotations == nil {
+				cfg.annotations = make(map[string]string)
+			}
+			cfg.annotations[spec.Source] = spec.Annotation
+		}
+		if spec.AllowCallerQueries {
+			if cfg.callerQueries == nil {
+				cfg.callerQueries = make(map[string]bool)
+			}
+			cfg.callerQueries[spec.Source] = true
+		}
+	}
+	if cfg.rowLimit <= 0 {
+		cfg.rowLimit = defaultRowLimit
+	}
+	if cfg.uiRowLimit <= 0 {
+		cfg.uiRowLimit = defaultUIRowLimit
+	}
+	if cfg.fanoutLimit <= 0 {
+		cfg.fanoutLimit = defaultFanoutLimit
+	}
+	return cfg
 }
 
 func (o Options) routePrefix() string {
@@ -240,27 +475,33 @@ func (o Options) routePrefix() string {
 	return ""
 }
 
-func (o Options) logf() logger.Logf {
-	if o.Logf == nil {
-		return log.Printf
+// logger returns the structured logger specified by o.
+func (o Options) logger() *slog.Logger {
+	if o.Logger != nil {
+		return o.Logger
+	} else if o.Logf != nil {
+		return newLogfLogger(o.Logf)
 	}
-	return o.Logf
+	return newLogfLogger(log.Printf)
 }
 
-// authorize returns an authorization callback based on the Access field of o.
+// authorize returns an authorization callback based on the Access and
+// Authorize fields of o.
 func (o Options) authorize() func(src string, who *apitype.WhoIsResponse) error {
-	if o.Authorize != nil {
+	if o.Access != nil {
+		return o.Access.AuthorizeLogger(o.logger())
+	} else if o.Authorize != nil {
 		return o.Authorize
 	}
 
-	logf := o.logf()
+	lg := o.logger()
 	return func(dataSrc string, who *apitype.WhoIsResponse) (err error) {
 		caller := who.UserProfile.LoginName
 		if who.Node.IsTagged() {
 			caller = who.Node.Name
 		}
 		defer func() {
-			logf("[tailsql] auth src=%q who=%q err=%v", dataSrc, caller, err)
+			lg.Info("auth", "source", dataSrc, "caller", caller, "allowed", err == nil, "error", err)
 		}()
 		if who.Node.IsTagged() {
 			return errors.New("tagged node is not authorized")
@@ -331,8 +572,10 @@ func (u UIRewriteRule) CheckApply(column, input string) (bool, any) {
 // updated with a new underlying database. The Swap method ensures the new
 // value is exchanged without races.
 type dbHandle struct {
-	src    string
-	driver string
+	src string
+
+	// The most recent health report for the handle, if any.
+	health atomic.Pointer[SourceHealth]
 
 	// If not nil, the value of this field is a database update that arrived
 	// while the handle was busy running a query. The concrete type is *dbUpdate
@@ -341,11 +584,21 @@ type dbHandle struct {
 
 	// mu protects the fields below.
 	// Hold shared to read the label and issue queries against db.
-	// Hold exclusive to replace or close db or to update label.
-	mu    sync.RWMutex
-	label string
-	db    Queryable
-	named map[string]string
+	// Hold exclusive to replace or close db or to update its metadata.
+	mu     sync.RWMutex
+	label  string
+	driver string
+	db     Queryable
+	named  map[string]string
+
+	// If non-empty, conf identifies the connection settings from which the
+	// handle was opened (see DBSpec.connKey). It is empty for handles that are
+	// not defined by the server options, such as those added by SetSource.
+	conf string
+
+	// If non-nil, the handle was opened from a secret, and is reopened when
+	// the secret changes.
+	secret *secretWatch
 }
 
 // checkUpdate returns nil if there is no pending update, otherwise it swaps
@@ -372,8 +625,13 @@ func (h *dbHandle) tryUpdate() {
 func (h *dbHandle) applyUpdateLocked(up *dbUpdate) {
 	h.label = up.label
 	h.named = up.named
-	h.db.Close()
-	h.db = up.newDB
+	if up.newDB != nil {
+		h.driver = up.driver // "" if not known
+		h.conf = up.conf
+		h.db.Close()
+		h.db = up.newDB
+		h.health.Store(nil) // health of the old database no longer applies
+	}
 }
 
 // Source returns the source name defined for h.
@@ -386,6 +644,68 @@ func (h *dbHandle) Label() string {
 	return h.label
 }
 
+// setPool applies p to the database for h, if it is managed by database/sql.
+func (h *dbHandle) setPool(p PoolOptions) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if db, ok := h.db.(sqlDB); ok {
+		p.apply(db.DB)
+	}
+}
+
+// setSession replaces the session settings for the database of h, if it is
+// managed by database/sql. The new settings apply to subsequent queries.
+func (h *dbHandle) setSession(o SessionOptions) {
+	h.mu.RLock()
+	if db, ok := h.db.(sqlDB); ok && db.session != nil {
+		db.session.Store(&o)
+	}
+	h.mu.RUnlock()
+
+	// Update the settings for connections opened when the secret rotates.
+	// Note checkSecret holds w.mu while it acquires h.mu, so we must not
+	// hold h.mu here.
+	if w := h.secret; w != nil {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.session = o
+	}
+}
+
+// poolStats reports connection pool statistics for the database of h, and
+// whether h has a database managed by database/sql.
+func (h *dbHandle) poolStats() (sql.DBStats, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if db, ok := h.db.(sqlDB); ok {
+		return db.Stats(), true
+	}
+	return sql.DBStats{}, false
+}
+
+// Conf returns the connection settings key for h, or "" if h is not defined
+// by the server options.
+func (h *dbHandle) Conf() string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.conf
+}
+
+// Driver returns the database/sql driver name for h, or "" if it is unknown.
+func (h *dbHandle) Driver() string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.driver
+}
+
+// Dialect returns the SQL dialect of the database for h, based on its driver.
+// If the driver is not known, it returns sqllex.Generic.
+func (h *dbHandle) Dialect() sqllex.Dialect {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return sqllex.ForDriver(h.driver)
+}
+
 // Named returns the named queries for h, nil if there are none.
 func (h *dbHandle) Named() map[string]string {
 	h.mu.RLock()
@@ -402,7 +722,8 @@ func (h *dbHandle) WithLock(ctx context.Context, f func(context.Context, Queryab
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 	if h.db == nil {
-		return errors.New("handle is closed")
+		// The source was removed after the caller found the handle.
+		return statusErrorf(http.StatusBadRequest, "source %q: %w", h.src, errHandleClosed)
 	}
 
 	// We hold the lock here not to exclude concurrent connections, which are
@@ -418,6 +739,9 @@ func (h *dbHandle) WithLock(ctx context.Context, f func(context.Context, Queryab
 
 type dbHandleKey struct{}
 
+// errHandleClosed is reported for operations on a closed database handle.
+var errHandleClosed = errors.New("handle is closed")
+
 // lookupNamedQuery reports whether the database handle associated with ctx has
 // a named query with the given name, and if so returns the text of the query.
 // If ctx does not have a database handle, it returns ("", false) always.  The
@@ -439,39 +763,67 @@ func (h *dbHandle) swap(newDB Queryable, newOpts *DBOptions) {
 	if newDB == nil {
 		panic("new database is nil")
 	}
-
-	up := &dbUpdate{
+	if err := h.post(&dbUpdate{
 		newDB: newDB,
 		label: newOpts.label(),
 		named: newOpts.namedQueries(),
+	}); err != nil {
+		panic(err)
 	}
+}
 
+// post applies up to h if h is not busy, or records it as a pending update to
+// be applied once the queries in flight have finished. If h is closed, post
+// closes the database in up (if any) and reports errHandleClosed.
+func (h *dbHandle) post(up *dbUpdate) error {
 	// If the handle is not busy, do the swap now.
 	if h.mu.TryLock() {
 		defer h.mu.Unlock()
 		if h.db == nil {
-			panic("handle is closed")
+			if up.newDB != nil {
+				up.newDB.Close()
+			}
+			return errHandleClosed
 		}
 		h.applyUpdateLocked(up)
-		return
+		return nil
 	}
 
 	// Reaching here, the handle is busy on a query. Record an update to be
 	// plumbed in later. It's possible we already had a pending update -- if
-	// that happens close out the old one.
-	if old := h.update.Swap(up); old != nil {
-		if up := old.(*dbUpdate); up != nil {
-			up.newDB.Close()
+	// that happens, close out the old one. If the new update does not carry a
+	// database, keep the database from the old one.
+	for {
+		cur := h.update.Load()
+		old, _ := cur.(*dbUpdate)
+		next := up
+		if old != nil && old.newDB != nil && up.newDB == nil {
+			next = &dbUpdate{
+				newDB:  old.newDB,
+				driver: old.driver,
+				conf:   old.conf,
+				label:  up.label,
+				named:  up.named,
+			}
+		}
+		if h.update.CompareAndSwap(cur, next) {
+			if old != nil && old.newDB != nil && old.newDB != next.newDB {
+				old.newDB.Close()
+			}
+			return nil
 		}
 	}
 }
 
 // A dbUpdate is an open database handle, label, and set of named queries that
-// are ready to be installed in a database handle.
+// are ready to be installed in a database handle. If newDB == nil, the update
+// replaces only the label and named queries.
 type dbUpdate struct {
-	newDB Queryable
-	label string
-	named map[string]string
+	newDB  Queryable
+	driver string
+	conf   string
+	label  string
+	named  map[string]string
 }
 
 // close closes the handle, calling Close on the underlying database and
@@ -480,6 +832,9 @@ type dbUpdate struct {
 func (h *dbHandle) close() error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
+	if up := h.checkUpdate(); up != nil && up.newDB != nil {
+		up.newDB.Close() // discard a pending update
+	}
 	if h.db != nil {
 		err := h.db.Close()
 		h.db = nil
@@ -489,12 +844,27 @@ func (h *dbHandle) close() error {
 }
 
 // UnmarshalOptions unmarshals a HuJSON Config value into opts.
+// If the config includes an access policy, UnmarshalOptions reports an error
+// if the policy is invalid.
 func UnmarshalOptions(data []byte, opts *Options) error {
 	data, err := hujson.Standardize(data)
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(data, &opts)
+	if err := json.Unmarshal(data, &opts); err != nil {
+		return err
+	}
+	return opts.checkAccess()
+}
+
+// checkAccess reports an error if o has an invalid access policy.
+func (o Options) checkAccess() error {
+	if o.Access != nil {
+		if err := o.Access.Validate(); err != nil {
+			return fmt.Errorf("access policy: %w", err)
+		}
+	}
+	return nil
 }
 
 // Duration is a wrapper for a time.Duration that allows it to marshal more
@@ -533,9 +903,9 @@ func (d *Duration) UnmarshalText(data []byte) error {
 //   - If KeyFile is set, it names the location of a file containing the
 //     connection string.  If set, KeyFile is expanded by os.ExpandEnv.
 //
-//   - Otherwise, Secret is the name of a secret to fetch from the secrets
-//     service, whose value is the connection string. This requires that a
-//     secrets server be configured in the options.
+//   - Otherwise, Secret is the name of a secret whose value is the connection
+//     string. This requires that a secret provider be configured in the
+//     options (see [SecretProvider]).
 type DBSpec struct {
 	Source string `json:"source"`           // UI slug (required)
 	Label  string `json:"label,omitempty"`  // descriptive label
@@ -544,6 +914,45 @@ type DBSpec struct {
 	// Named is an optional map of named SQL queries the database should expose.
 	Named map[string]string `json:"named,omitempty"`
 
+	// By default, the server adds a LIMIT to SELECT queries for a SQLite,
+	// PostgreSQL, or MySQL source, so that the database can stop early
+	// instead of producing rows the server will not read. If true, queries
+	// for this source are sent to the database as written.
+	NoLimitPushdown bool `json:"noLimitPushdown,omitempty"`
+
+	// If true, a caller whom Authorize denies access to this source may still
+	// run those of its named queries that refer to caller variables, such as
+	// ":caller_login", which limit the results to rows about the caller.
+	// Other queries by such a caller are denied as usual.
+	AllowCallerQueries bool `json:"allowCallerQueries,omitempty"`
+
+	// If set, prefix each query sent to this source with a comment formatted
+	// by replacing the variables {user} (the caller), {node} (the caller's
+	// node name), {src} (the source), and {req} (the request ID) in this
+	// string, so that the database's own logs can attribute queries to
+	// callers. For example, DefaultAnnotation produces a comment like:
+	//
+	//	/* tailsql user=alice@example.com src=main req=4f8a1c2e9b7d3a60 */
+	//
+	// Characters in the values other than letters, digits, and "@._-:+" are
+	// replaced with "_". The query log records the query without the comment.
+	Annotation string `json:"annotation,omitempty"`
+
+	// Connection pool settings for a database managed by database/sql.
+	// These are ignored for programmatic data sources.
+	PoolOptions
+
+	// Transaction and session settings for a database managed by
+	// database/sql. These are ignored for programmatic data sources.
+	SessionOptions
+
+	// If positive, check the files for this source at this interval, and
+	// reopen the database when they change. This applies to the KeyFile, if
+	// set, and to the database file of a SQLite source. A SQLite database is
+	// reopened only when the file is replaced (e.g., by renaming a new
+	// snapshot into place), not when it is modified.
+	WatchInterval Duration `json:"watchInterval,omitempty"`
+
 	// Exactly one of the fields below must be set.
 
 	URL     string    `json:"url,omitempty"`     // path or connection URL
@@ -552,6 +961,47 @@ type DBSpec struct {
 	DB      Queryable `json:"-"`                 // programmatic data source
 }
 
+// programmaticConf is the connection settings key for programmatic sources.
+const programmaticConf = "(programmatic)"
+
+func (d *DBSpec) label() string {
+	if d.Label == "" {
+		return "(unidentified database)"
+	}
+	return d.Label
+}
+
+// connString returns the connection string for a database/sql source with a
+// fixed URL or key file.
+func (d *DBSpec) connString() (string, error) {
+	switch {
+	case d.URL != "":
+		return d.URL, nil
+	case d.KeyFile != "":
+		data, err := os.ReadFile(os.ExpandEnv(d.KeyFile))
+		if err != nil {
+			return "", fmt.Errorf("read key file for %q: %w", d.Source, err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	default:
+		panic("unexpected: no connection source is defined after validation")
+	}
+}
+
+// connKey returns a string identifying the connection settings of d, given
+// its resolved connection string (if any). Two specs with the same key refer
+// to the same database. The key does not expose the connection string.
+func (d *DBSpec) connKey(connString string) string {
+	switch {
+	case d.DB != nil:
+		return programmaticConf
+	case d.Secret != "":
+		return "secret:" + d.Driver + ":" + d.Secret
+	}
+	sum := sha256.Sum256([]byte(connString))
+	return "conn:" + d.Driver + ":" + hex.EncodeToString(sum[:])
+}
+
 func (d *DBSpec) countFields() (n int) {
 	for _, s := range []string{d.URL, d.KeyFile, d.Secret} {
 		if s != "" {
@@ -565,11 +1015,16 @@ func (d *DBSpec) checkValid() error {
 	if d.Source == "" {
 		return errors.New("missing source name")
 	}
+	if err := checkAnnotation(d.Annotation); err != nil {
+		return err
+	}
 
 	// Case 1: A programmatic data source.
 	if d.DB != nil {
 		if d.countFields() != 0 {
 			return errors.New("no connection string is allowed when DB is set")
+		} else if d.WatchInterval > 0 {
+			return errors.New("watchInterval is not allowed when DB is set")
 		}
 		return nil
 	}
@@ -580,6 +1035,12 @@ func (d *DBSpec) checkValid() error {
 	} else if d.countFields() != 1 {
 		return errors.New("exactly one connection source must be set")
 	}
+	if err := d.SessionOptions.checkValid(); err != nil {
+		return err
+	}
+	if d.WatchInterval > 0 && d.KeyFile == "" && sqliteFilePath(d.Driver, d.URL) == "" {
+		return errors.New("watchInterval requires a key file or a SQLite database file")
+	}
 	return nil
 }
 
@@ -597,6 +1058,14 @@ type DBOptions struct {
 	// query when the underlying schema changes while preserving the semantics
 	// the user observes.
 	NamedQueries map[string]string
+
+	// Connection pool settings, applied to the database by SetDB.
+	// These are ignored by SetSource.
+	PoolOptions
+
+	// Transaction and session settings, applied to queries for a database
+	// added by SetDB. These are ignored by SetSource.
+	SessionOptions
 }
 
 func (o *DBOptions) label() string {
@@ -613,10 +1082,71 @@ func (o *DBOptions) namedQueries() map[string]string {
 	return o.NamedQueries
 }
 
+func (o *DBOptions) poolOptions() PoolOptions {
+	if o == nil {
+		return PoolOptions{}
+	}
+	return o.PoolOptions
+}
+
+func (o *DBOptions) sessionOptions() SessionOptions {
+	if o == nil {
+		return SessionOptions{}
+	}
+	return o.SessionOptions
+}
+
+// PoolOptions are connection pool settings for a database managed by the
+// [database/sql] package. A zero value for any field leaves the default from
+// database/sql in place.
+type PoolOptions struct {
+	// The maximum number of open connections to the database.
+	MaxOpenConns int `json:"maxOpenConns,omitempty"`
+
+	// The maximum number of idle connections to retain. If negative, no idle
+	// connections are retained.
+	MaxIdleConns int `json:"maxIdleConns,omitempty"`
+
+	// The maximum amount of time a connection may be reused.
+	ConnMaxLifetime Duration `json:"connMaxLifetime,omitempty"`
+
+	// The maximum amount of time a connection may be idle before closing.
+	ConnMaxIdleTime Duration `json:"connMaxIdleTime,omitempty"`
+}
+
+// apply applies the non-zero settings of p to db.
+func (p PoolOptions) apply(db *sql.DB) {
+	if p.MaxOpenConns != 0 {
+		db.SetMaxOpenConns(p.MaxOpenConns)
+	}
+	if p.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(p.MaxIdleConns) // negative means none
+	}
+	if p.ConnMaxLifetime != 0 {
+		db.SetConnMaxLifetime(p.ConnMaxLifetime.Duration())
+	}
+	if p.ConnMaxIdleTime != 0 {
+		db.SetConnMaxIdleTime(p.ConnMaxIdleTime.Duration())
+	}
+}
+
 // A Query carries the parameters of a query presented to the API.
 type Query struct {
 	Source string // the data source requested
 	Query  string // the text of the query
+
+	// Driver is the name of the database/sql driver for Source, if known.
+	// It is filled in by the server before the query is checked, and is
+	// empty for programmatic sources and sources added by SetDB.
+	Driver string
+
+	// If non-empty, the query is also run against this source, and the
+	// server reports how its results differ from those of Source.
+	Diff string
+
+	// For a diff query, an optional comma-separated list of the names of
+	// key columns that identify each row.
+	DiffKey string
 }
 
 // DefaultCheckQuery is the default query check function used if another is not
@@ -635,7 +1165,8 @@ func DefaultCheckQuery(q Query) (Query, error) {
 // Queryable is the interface used to issue SQL queries to a database.
 type Queryable interface {
 	// Query issues the specified SQL query in a transaction and returns the
-	// matching result set, if any.
+	// matching result set, if any. When the server sends a query on behalf of
+	// a caller, ctx carries the caller's identity (see CallerFromContext).
 	Query(ctx context.Context, sql string, params ...any) (RowSet, error)
 
 	// Close closes the database.
@@ -664,9 +1195,3 @@ type RowSet interface {
 	// pointed to by its arguments.
 	Scan(...any) error
 }
-
-type sqlDB struct{ *sql.DB }
-
-func (s sqlDB) Query(ctx context.Context, query string, params ...any) (RowSet, error) {
-	return s.DB.QueryContext(ctx, query, params...)
-}
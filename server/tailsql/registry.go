@@ -0,0 +1,132 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tailsql
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/tailscale/setec/client/setec"
+)
+
+// A registry is an ordered collection of database handles, indexed by source
+// name. The first handle in order is the default source.  A registry is safe
+// for concurrent use by multiple goroutines.
+//
+// Removing a handle from the registry does not close it. Handles returned by
+// the registry may still be in use by queries after they are removed, so the
+// caller that removes a handle is responsible for closing it; closing waits
+// for in-flight queries to finish (see dbHandle.close).
+type registry struct {
+	mu  sync.Mutex
+	dbs []*setec.Updater[*dbHandle]
+}
+
+// handles returns a snapshot of the current handles in r, in order.  Any
+// pending updates for handles that are not busy are applied.  The caller may
+// retain and modify the returned slice.
+func (r *registry) handles() []*dbHandle {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]*dbHandle, len(r.dbs))
+
+	// Check for pending updates.
+	for i, u := range r.dbs {
+		out[i] = u.Get()
+		out[i].tryUpdate()
+	}
+	return out
+}
+
+// lookup returns the handle for src in r, or nil if there is none.
+func (r *registry) lookup(src string) *dbHandle {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i := r.indexLocked(src); i >= 0 {
+		h := r.dbs[i].Get()
+		h.tryUpdate()
+		return h
+	}
+	return nil
+}
+
+// add adds u to the end of r, and reports true.  If r already has a handle for
+// the source of u, add reports false without modifying r.
+func (r *registry) add(u *setec.Updater[*dbHandle]) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.indexLocked(u.Get().Source()) >= 0 {
+		return false
+	}
+	r.dbs = append(r.dbs, u)
+	return true
+}
+
+// set swaps db and opts into the existing handle for source and reports true,
+// or if there is no handle for source adds a new one and reports false.
+func (r *registry) set(source string, db Queryable, opts *DBOptions) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i := r.indexLocked(source); i >= 0 {
+		r.dbs[i].Get().swap(db, opts)
+		return true
+	}
+	r.dbs = append(r.dbs, setec.StaticUpdater(&dbHandle{
+		db:    db,
+		src:   source,
+		label: opts.label(),
+		named: opts.namedQueries(),
+	}))
+	return false
+}
+
+// replace replaces the handle for the source of u with u, in the same
+// position, and returns the handle it replaced. If r has no handle for that
+// source, replace returns nil without modifying r.
+func (r *registry) replace(u *setec.Updater[*dbHandle]) *dbHandle {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i := r.indexLocked(u.Get().Source()); i >= 0 {
+		old := r.dbs[i].Get()
+		r.dbs[i] = u
+		return old
+	}
+	return nil
+}
+
+// replaceHandle replaces old with u, in the same position, and reports true.
+// If old is not the current handle for its source, replaceHandle reports false
+// without modifying r.
+func (r *registry) replaceHandle(old *dbHandle, u *setec.Updater[*dbHandle]) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i := r.indexLocked(old.Source()); i >= 0 && r.dbs[i].Get() == old {
+		r.dbs[i] = u
+		return true
+	}
+	return false
+}
+
+// remove removes the handle for src from r and returns it, or returns nil if r
+// has no handle for src.
+func (r *registry) remove(src string) *dbHandle {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i := r.indexLocked(src); i >= 0 {
+		old := r.dbs[i].Get()
+		r.dbs = slices.Delete(r.dbs, i, i+1)
+		return old
+	}
+	return nil
+}
+
+func (r *registry) indexLocked(src string) int {
+	for i, u := range r.dbs {
+		if u.Get().Source() == src {
+			return i
+		}
+	}
+	return -1
+}
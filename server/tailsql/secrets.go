@@ -0,0 +1,380 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tailsql
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/tailscale/setec/client/setec"
+)
+
+// A SecretProvider supplies the values of named secrets, such as the
+// connection strings of data sources that set DBSpec.Secret.
+//
+// Secret returns a function that reports the current value of the named
+// secret, or an error if the secret is not available. The server calls the
+// function periodically, in the background, to check whether the secret has
+// rotated, so it should not block, and may report a stale value. When the
+// value changes, the server opens a new connection and swaps it in to the
+// handle for the source once the queries in flight have finished.
+//
+// The built-in providers are [SetecSecrets], [EnvSecrets], [FileSecrets],
+// [CommandSecrets], and [AgeSecrets].
+type SecretProvider interface {
+	Secret(ctx context.Context, name string) (func() []byte, error)
+}
+
+// SetecSecrets is a [SecretProvider] that fetches secrets from a setec store.
+// If the store does not have lookups enabled, each secret must be declared
+// when the store is created (see [Options.CheckSources]).
+type SetecSecrets struct {
+	Store *setec.Store
+}
+
+// Secret implements the [SecretProvider] interface.
+func (s SetecSecrets) Secret(ctx context.Context, name string) (func() []byte, error) {
+	return s.Store.LookupSecret(ctx, name)
+}
+
+// EnvSecrets is a [SecretProvider] that reads secrets from environment
+// variables. The value of a secret is the value of the variable whose name is
+// the secret name with Prefix prepended. A variable that is unset or empty is
+// reported as unavailable.
+type EnvSecrets struct {
+	Prefix string
+}
+
+// Secret implements the [SecretProvider] interface.
+func (e EnvSecrets) Secret(_ context.Context, name string) (func() []byte, error) {
+	key := e.Prefix + name
+	v := os.Getenv(key)
+	if v == "" {
+		return nil, fmt.Errorf("environment variable %q is not set", key)
+	}
+	var mu sync.Mutex
+	last := []byte(v)
+	return func() []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		if v := os.Getenv(key); v != "" && v != string(last) {
+			last = []byte(v) // keep the previous value if the variable is unset
+		}
+		return last
+	}, nil
+}
+
+// FileSecrets is a [SecretProvider] that reads secrets from files. The value
+// of a secret is the contents of the file named by the secret, with leading
+// and trailing whitespace removed. If Dir is set, secret names are relative
+// paths within that directory; otherwise they are paths to files.
+//
+// The files are checked for changes each time the value is requested.
+type FileSecrets struct {
+	Dir string
+}
+
+// Secret implements the [SecretProvider] interface.
+func (f FileSecrets) Secret(_ context.Context, name string) (func() []byte, error) {
+	path, err := secretPath(f.Dir, name)
+	if err != nil {
+		return nil, err
+	}
+	return newFileSecret(path, func(data []byte) ([]byte, error) { return data, nil })
+}
+
+// AgeSecrets is a [SecretProvider] that reads secrets from files encrypted
+// with [age]. The value of a secret is the decrypted contents of the file
+// named by the secret, with leading and trailing whitespace removed. The file
+// may be binary or armored. Secret names are interpreted as for
+// [FileSecrets].
+//
+// [age]: https://age-encryption.org
+type AgeSecrets struct {
+	Dir        string
+	Identities []age.Identity // used to decrypt (required)
+}
+
+// Secret implements the [SecretProvider] interface.
+func (a AgeSecrets) Secret(_ context.Context, name string) (func() []byte, error) {
+	if len(a.Identities) == 0 {
+		return nil, errors.New("no age identities")
+	}
+	path, err := secretPath(a.Dir, name)
+	if err != nil {
+		return nil, err
+	}
+	return newFileSecret(path, a.decrypt)
+}
+
+func (a AgeSecrets) decrypt(data []byte) ([]byte, error) {
+	var src io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(armor.Header)) {
+		src = armor.NewReader(bytes.NewReader(bytes.TrimSpace(data)))
+	}
+	r, err := age.Decrypt(src, a.Identities...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// CommandSecrets is a [SecretProvider] that reads secrets from the standard
+// output of a command. The value of a secret is the output of running Command
+// with the secret name appended to its arguments, with leading and trailing
+// whitespace removed.
+//
+// If Refresh > 0, the command is run again in the background when the value
+// is requested and the previous run is older than Refresh. Otherwise the
+// command is run only once per secret.
+type CommandSecrets struct {
+	Command []string // program and arguments (required)
+	Refresh time.Duration
+}
+
+// Secret implements the [SecretProvider] interface.
+func (c CommandSecrets) Secret(ctx context.Context, name string) (func() []byte, error) {
+	if len(c.Command) == 0 {
+		return nil, errors.New("no secret command")
+	}
+	value, err := c.run(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if c.Refresh <= 0 {
+		return func() []byte { return value }, nil
+	}
+
+	var mu sync.Mutex
+	last, running := time.Now(), false
+	return func() []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		if !running && time.Since(last) >= c.Refresh {
+			running = true
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+				defer cancel()
+				v, err := c.run(ctx, name)
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err == nil {
+					value = v // on error, keep the previous value
+				}
+				last, running = time.Now(), false
+			}()
+		}
+		return value
+	}, nil
+}
+
+func (c CommandSecrets) run(ctx context.Context, name string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.Command[0], append(c.Command[1:], name)...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("secret command: %w: %s", err, msg)
+		}
+		return nil, fmt.Errorf("secret command: %w", err)
+	}
+	out = bytes.TrimSpace(out)
+	if len(out) == 0 {
+		return nil, fmt.Errorf("secret command: empty output for %q", name)
+	}
+	return out, nil
+}
+
+// secretPath returns the path of the file for the named secret relative to
+// dir, if set.
+func secretPath(dir, name string) (string, error) {
+	if dir == "" {
+		return os.ExpandEnv(name), nil
+	} else if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("invalid secret name %q", name)
+	}
+	return filepath.Join(os.ExpandEnv(dir), name), nil
+}
+
+// newFileSecret returns a function that reports the contents of path,
+// transformed by decode and trimmed of whitespace. The file is read again
+// when it changes; if it cannot be read or decoded, the previous value is
+// kept.
+func newFileSecret(path string, decode func([]byte) ([]byte, error)) (func() []byte, error) {
+	read := func() ([]byte, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		value, err := decode(data)
+		if err != nil {
+			return nil, fmt.Errorf("decode %q: %w", path, err)
+		}
+		value = bytes.TrimSpace(value)
+		if len(value) == 0 {
+			return nil, fmt.Errorf("secret file %q is empty", path)
+		}
+		return value, nil
+	}
+	state := statFile(path)
+	value, err := read()
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	return func() []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		if cur := statFile(path); cur.modified(state) {
+			state = cur
+			if v, err := read(); err == nil {
+				value = v
+			}
+		}
+		return value
+	}, nil
+}
+
+// SecretConfig describes one of the built-in secret providers, so that it can
+// be selected in a configuration file.
+type SecretConfig struct {
+	// Provider is the name of the provider: "env", "file", "command", or
+	// "age".
+	Provider string `json:"provider"`
+
+	Prefix       string   `json:"prefix,omitempty"`       // env: prefix for variable names
+	Dir          string   `json:"dir,omitempty"`          // file, age: directory of secret files
+	Command      []string `json:"command,omitempty"`      // command: program and arguments
+	Refresh      Duration `json:"refresh,omitempty"`      // command: how often to re-run
+	IdentityFile string   `json:"identityFile,omitempty"` // age: file of age identities
+}
+
+func (c *SecretConfig) provider() (SecretProvider, error) {
+	switch c.Provider {
+	case "env":
+		return EnvSecrets{Prefix: c.Prefix}, nil
+	case "file":
+		return FileSecrets{Dir: c.Dir}, nil
+	case "command":
+		if len(c.Command) == 0 {
+			return nil, errors.New("command provider requires a command")
+		}
+		return CommandSecrets{Command: c.Command, Refresh: c.Refresh.Duration()}, nil
+	case "age":
+		if c.IdentityFile == "" {
+			return nil, errors.New("age provider requires an identity file")
+		}
+		f, err := os.Open(os.ExpandEnv(c.IdentityFile))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		ids, err := age.ParseIdentities(f)
+		if err != nil {
+			return nil, fmt.Errorf("parse identity file: %w", err)
+		}
+		return AgeSecrets{Dir: c.Dir, Identities: ids}, nil
+	default:
+		return nil, fmt.Errorf("unknown secret provider %q", c.Provider)
+	}
+}
+
+// A secretWatch tracks the secret from which a database handle was opened, so
+// that the handle can be reopened when the secret rotates.
+type secretWatch struct {
+	get     func() []byte
+	driver  string
+	pool    PoolOptions
+	session SessionOptions
+	log     *slog.Logger
+
+	mu   sync.Mutex
+	last []byte // the most recent value seen
+}
+
+const (
+	secretCheckInterval = time.Second      // how often to check for a rotated secret
+	secretOpenTimeout   = 30 * time.Second // maximum time to open a rotated secret
+)
+
+// checkSecret checks whether the secret for h has changed since it was last
+// checked. If so, it opens a new connection with the new value and posts it
+// as an update to h. It reports an error only if h has been closed.
+func (h *dbHandle) checkSecret(ctx context.Context) error {
+	w := h.secret
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	v := w.get()
+	if bytes.Equal(v, w.last) {
+		return nil
+	}
+	w.last = v // even if the open fails, do not retry the same value
+
+	octx, cancel := context.WithTimeout(ctx, secretOpenTimeout)
+	defer cancel()
+	db, err := openAndPing(octx, w.driver, string(v), w.pool)
+	if err != nil {
+		w.log.Warn("updating source failed, keeping old value", "source", h.src, "error", err)
+		return nil
+	}
+	if err := h.post(&dbUpdate{
+		newDB:  newSQLDB(db, w.driver, w.session),
+		driver: w.driver,
+		conf:   h.Conf(),
+		label:  h.Label(),
+		named:  h.Named(),
+	}); err != nil {
+		return err
+	}
+	w.log.Info("opened new connection", "source", h.src)
+	return nil
+}
+
+// watchSecret checks periodically whether the secret for h has rotated, and
+// if so swaps a new connection in to h. It runs until s is closed, or until h
+// is no longer the current handle for its source, e.g., because it was
+// removed or reloaded. Checks run outside the request path, so a slow secret
+// provider or database does not delay queries.
+func (s *Server) watchSecret(h *dbHandle) {
+	t := time.NewTicker(secretCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-t.C:
+		}
+		if s.dbs.lookup(h.Source()) != h {
+			return // the handle was replaced or removed
+		}
+		if err := h.checkSecret(s.ctx); err != nil {
+			return // the handle was closed
+		}
+	}
+}
+
+// startSecretWatch starts a goroutine to watch the secret for each of the
+// handles in hs that was opened from a secret.
+func (s *Server) startSecretWatch(hs []*dbHandle) {
+	for _, h := range hs {
+		if h.secret != nil {
+			go s.watchSecret(h)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tailsql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/tailscale/tailsql/sqllex"
+)
+
+// SessionOptions are settings for the transactions in which queries are
+// issued to a database managed by the [database/sql] package. Each query runs
+// in its own read-only transaction, which is always rolled back.
+type SessionOptions struct {
+	// The isolation level for query transactions, for example
+	// "read-committed", "repeatable-read", or "serializable". If empty, the
+	// driver's default level is used. Not all drivers support all levels.
+	Isolation string `json:"isolation,omitempty"`
+
+	// If positive, the maximum time a query may run, including the time to
+	// read its results. For PostgreSQL and MySQL sources, the timeout is also
+	// set in the database session, so that the database itself stops the
+	// query.
+	StatementTimeout Duration `json:"statementTimeout,omitempty"`
+
+	// Statements to execute at the start of each query transaction, after
+	// the built-in setup for the driver.
+	Setup []string `json:"setup,omitempty"`
+}
+
+// checkValid reports an error if o contains invalid settings.
+func (o SessionOptions) checkValid() error {
+	if _, err := isolationLevel(o.Isolation); err != nil {
+		return err
+	} else if o.StatementTimeout < 0 {
+		return fmt.Errorf("invalid statement timeout %v", o.StatementTimeout)
+	}
+	return nil
+}
+
+// txOptions returns the transaction options for a query session.
+func (o SessionOptions) txOptions() *sql.TxOptions {
+	level, _ := isolationLevel(o.Isolation) // checked by checkValid
+	return &sql.TxOptions{Isolation: level, ReadOnly: true}
+}
+
+// setup returns the statements to execute at the start of each transaction
+// for a database using the specified driver. The driver may be empty if it is
+// not known.
+func (o SessionOptions) setup(driver string) []string {
+	var out []string
+	ms := o.StatementTimeout.Duration().Milliseconds()
+	switch sqllex.ForDriver(driver) {
+	case sqllex.SQLite:
+		// The SQLite driver does not enforce read-only transactions.
+		out = append(out, "PRAGMA query_only = 1")
+	case sqllex.PostgreSQL:
+		if ms > 0 {
+			out = append(out, fmt.Sprintf("SET LOCAL statement_timeout = %d", ms))
+		}
+	case sqllex.MySQL:
+		// MySQL has no transaction-local setting, so the session value
+		// outlives the transaction on a pooled connection. Set it every
+		// time, so that a timeout removed or lowered by a reload does not
+		// linger; zero means no limit.
+		out = append(out, fmt.Sprintf("SET SESSION max_execution_time = %d", ms))
+	}
+	return append(out, o.Setup...)
+}
+
+// isolationLevel parses the name of a transaction isolation level.  The empty
+// string denotes the driver's default level.
+func isolationLevel(name string) (sql.IsolationLevel, error) {
+	if name == "" {
+		return sql.LevelDefault, nil
+	}
+	for lvl := sql.LevelReadUncommitted; lvl <= sql.LevelLinearizable; lvl++ {
+		if strings.EqualFold(name, strings.ReplaceAll(lvl.String(), " ", "-")) {
+			return lvl, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown isolation level %q", name)
+}
+
+// sqlDB is a Queryable for a database managed by database/sql.
+type sqlDB struct {
+	*sql.DB
+	driver  string                          // may be empty if unknown
+	session *atomic.Pointer[SessionOptions] // nil means defaults
+}
+
+// newSQLDB constructs a Queryable for db with the given driver and session
+// settings.
+func newSQLDB(db *sql.DB, driver string, sess SessionOptions) sqlDB {
+	p := new(atomic.Pointer[SessionOptions])
+	p.Store(&sess)
+	return sqlDB{DB: db, driver: driver, session: p}
+}
+
+func (s sqlDB) options() SessionOptions {
+	if s.session == nil {
+		return SessionOptions{}
+	}
+	return *s.session.Load()
+}
+
+// Query satisfies part of the Queryable interface. It runs query in a
+// read-only transaction, which is rolled back when the rows are closed.
+func (s sqlDB) Query(ctx context.Context, query string, params ...any) (_ RowSet, err error) {
+	opts := s.options()
+	cancel := context.CancelFunc(func() {})
+	if d := opts.StatementTimeout.Duration(); d > 0 {
+		ctx, cancel = context.WithTimeout(ctx, d)
+	}
+	tx, err := s.DB.BeginTx(ctx, opts.txOptions())
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			cancel()
+		}
+	}()
+	for _, stmt := range opts.setup(s.driver) {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return nil, fmt.Errorf("session setup: %w", err)
+		}
+	}
+	rows, err := tx.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	return txRows{Rows: rows, tx: tx, cancel: cancel}, nil
+}
+
+// txRows is a RowSet that rolls back its transaction when closed.
+type txRows struct {
+	*sql.Rows
+	tx     *sql.Tx
+	cancel context.CancelFunc
+}
+
+func (r txRows) Close() error {
+	err := r.Rows.Close()
+	r.tx.Rollback()
+	r.cancel()
+	return err
+}
@@ -0,0 +1,158 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tailsql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// shutdownGrace is the time Shutdown waits for requests to finish after it
+// has canceled them. It is a variable so that tests can shorten it.
+var shutdownGrace = 5 * time.Second
+
+// A requestTracker counts the API requests in progress, and stops admitting
+// new requests once it starts draining.
+type requestTracker struct {
+	mu       sync.Mutex
+	active   int
+	draining bool
+	idle     chan struct{} // closed when draining and active == 0
+}
+
+// begin reports whether a new request may proceed, and if so counts it as
+// active. The caller must call end when the request is done.
+func (t *requestTracker) begin() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	t.active++
+	return true
+}
+
+// end records that a request admitted by begin is done.
+func (t *requestTracker) end() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active--
+	if t.draining && t.active == 0 {
+		close(t.idle)
+	}
+}
+
+// drain stops admitting new requests, and returns a channel that is closed
+// when the active requests are done.
+func (t *requestTracker) drain() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.draining {
+		t.draining = true
+		t.idle = make(chan struct{})
+		if t.active == 0 {
+			close(t.idle)
+		}
+	}
+	return t.idle
+}
+
+// isDraining reports whether t has stopped admitting requests.
+func (t *requestTracker) isDraining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// Shutdown shuts down s gracefully. It stops accepting new requests, which
+// are refused with status 503, and waits for the requests in progress to
+// finish. If ctx ends first, Shutdown cancels the queries still running and
+// waits briefly for them to stop. It then delivers the remaining audit
+// events, and closes the database handles, like Close.
+//
+// If some queries still have not stopped after the grace period, for example
+// because their database ignores cancellation, Shutdown does not wait for
+// them: their database handles are closed in the background once they
+// return, and their audit events are discarded.
+//
+// If ctx ends before the requests in progress have finished, Shutdown reports
+// the error from ctx along with any error from closing s.
+func (s *Server) Shutdown(ctx context.Context) error {
+	idle := s.reqs.drain()
+	how := closeIdle
+	var errs []error
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		s.log.Warn("shutdown: canceling queries in progress", "queries", len(s.inflight.list()))
+		s.stop()
+		select {
+		case <-idle:
+		case <-time.After(shutdownGrace):
+			s.log.Warn("shutdown: queries did not stop after cancellation", "queries", len(s.inflight.list()))
+			how = closeAbandon
+		}
+		errs = append(errs, ctx.Err())
+	}
+	errs = append(errs, s.shutdown(how))
+	return errors.Join(errs...)
+}
+
+// closeMode says how shutdown orders closing the database handles and
+// delivering the remaining audit events.
+type closeMode int
+
+const (
+	// Close the handles, which waits for running queries to finish and record
+	// their events, then deliver the events.
+	closeWait closeMode = iota
+
+	// Deliver the events, then close the handles. This is appropriate when no
+	// queries are running.
+	closeIdle
+
+	// Deliver the events, then close the handles without waiting for the
+	// queries still running, which may never return.
+	closeAbandon
+)
+
+// shutdown stops the background work of s and releases its resources, as
+// specified by how. Only the first call has any effect.
+func (s *Server) shutdown(how closeMode) error {
+	s.closeOnce.Do(func() {
+		s.stop() // stop background work
+		var errs []error
+		flush := func() {
+			ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+			defer cancel()
+			if err := s.audit.close(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("audit: %w", err))
+			}
+		}
+		if how != closeWait {
+			flush()
+		}
+		for _, db := range s.getHandles() {
+			if how == closeAbandon {
+				// Closing the handle waits for the queries using it, so do
+				// that in the background.
+				go func() {
+					if err := db.close(); err != nil {
+						s.log.Warn("shutdown: closing source", "source", db.Source(), "error", err)
+					}
+				}()
+				continue
+			}
+			errs = append(errs, db.close())
+		}
+		if how == closeWait {
+			flush()
+		}
+		s.closeErr = errors.Join(errs...)
+	})
+	return s.closeErr
+}
@@ -17,12 +17,13 @@ CREATE TABLE IF NOT EXISTS raw_query_log (
      REFERENCES queries (query_id),
   timestamp TIMESTAMP NOT NULL
      DEFAULT (strftime('%Y-%m-%dT%H:%M:%f', 'now')),
-  elapsed INTEGER NULL     -- microseconds
+  elapsed INTEGER NULL,    -- microseconds
+  masked TEXT NULL         -- comma-separated names of masked columns, if any
 );
 
 -- A joined view of the query log.
 CREATE VIEW IF NOT EXISTS query_log AS
-  SELECT author, source, query, timestamp, elapsed
+  SELECT author, source, query, timestamp, elapsed, masked
     FROM raw_query_log JOIN queries
    USING (query_id)
 ;
@@ -17,6 +17,9 @@
 //     defined when the server is set up. If src is omitted, the first database
 //     is used as a default.
 //
+//   - The diff and key parameters compare the results of the query on two
+//     sources. See "Comparing Sources" below.
+//
 //   - "/" serves output as HTML for the UI. In this format the query (q) may
 //     be empty (no output will be displayed).
 //
@@ -27,7 +30,19 @@
 //     the column names, the remaining lines the rows. In this format the query
 //     (q) must be non-empty.
 //
-//   - "/meta" serves a JSON blob of metadata about available data sources.
+//   - "/meta" serves a JSON blob of metadata about available data sources,
+//     including their health and the LIMIT added to their queries, if any.
+//
+//   - "/healthz" is a liveness check. It serves a JSON summary of the health
+//     of each data source, with status 200 while the server is running.
+//
+//   - "/readyz" is a readiness check. It serves a JSON summary like /healthz,
+//     with status 200 if every source is open and healthy and the local state
+//     (if any) is writable, and otherwise status 503. If the ping parameter
+//     is "1", it first pings each source not checked in the last few seconds.
+//
+// The /healthz and /readyz endpoints do not require authorization, and do not
+// report errors or connection details.
 //
 // Calls to the /json endpoint must set the Sec-Tailsql header to "1". This
 // prevents browser scripts from directing queries to this endpoint.
@@ -46,10 +61,72 @@
 // users to make semantically stable queries without relying on a specific
 // schema format.
 //
+// A named query may refer to the caller with the variables ":caller_login",
+// ":caller_user_id", ":caller_node", and ":caller_tags", whose values are
+// bound as query parameters. If DBSpec.AllowCallerQueries is set, a caller
+// who is not authorized to query a source may still run such named queries.
+//
+// # Row Limits
+//
+// The server reads at most RowLimit rows for a query. For SQLite, PostgreSQL,
+// and MySQL sources, it also adds a LIMIT of one more than that to a SELECT
+// query that does not already have a smaller limit, so that the database can
+// stop early. Set NoLimitPushdown in the DBSpec to disable this for a source.
+//
+// # Federated Queries
+//
+// A query that refers to a table as "from:source.table" is a federated query.
+// The server reads each referenced table from its source, as if by the query
+// "SELECT * FROM table", into a temporary in-memory SQLite database, and then
+// runs the query there with each reference replaced by the name of its table:
+//
+//	SELECT u.name, count(*) FROM from:main.users u
+//	JOIN from:billing.invoices i ON i.user_id = u.id
+//	GROUP BY u.name
+//
+// The caller must be authorized to query each source, and each table is
+// checked, logged, and subject to the row limit as a query to its own source.
+// A table with more rows than the row limit is an error, rather than being
+// silently truncated.
+//
+// # Fan-Out Queries
+//
+// If the source (src) of a query ends in "*", such as "shard*", the query is
+// run against every source with that prefix that the caller is authorized to
+// query, at most FanoutLimit at a time. The results are concatenated, with a
+// "_source" column giving the source of each row. If some sources fail, the
+// results have an "_error" column and a row reporting each failure, rather
+// than failing the whole query. The row limit applies to the combined rows.
+//
+// # Column Masking
+//
+// The Masks option lists rules for masking the values of sensitive columns,
+// by redacting, partially masking, hashing, or replacing them with NULL,
+// unless the caller is exempt. Masking is applied to the results of each
+// source as they are read, so masked values do not reach any output format,
+// nor a federated, fan-out, or diff query. Since rules match the names of
+// result columns, a caller subject to a rule for a source may send it only
+// named and federated queries. See MaskRule.
+//
+// # Comparing Sources
+//
+// If the diff parameter names a second source, the query is run against both
+// sources, and the result reports the rows that differ, with a "_change"
+// column whose value is "added", "removed", "changed-from", or "changed-to".
+// The key parameter optionally gives a comma-separated list of key columns:
+// rows with the same key in both results are reported as a changed pair.
+// Without it, rows are compared as a whole. The caller must be authorized to
+// query both sources, and each is queried subject to the usual checks and
+// limits. A source with more rows than the row limit is an error.
+//
 // # Meta Queries
 //
-// The query processor treats a query "meta:named" as a meta-query to report
-// the names and content of all named queries, regardless of source.
+// The query processor treats a query of the form "meta:<name>" as a
+// meta-query about the state of the server, regardless of source. For
+// example, "meta:named" reports the names and content of the named queries,
+// and "meta:sources" reports the available sources and their health. The
+// query "meta:help" lists all the meta-queries. The results of a meta-query
+// include only the sources the caller is authorized to query.
 package tailsql
 
 import (
@@ -62,6 +139,7 @@ import (
 	"fmt"
 	"html/template"
 	"io"
+	"log/slog"
 	"net/http"
 	"strings"
 	"sync"
@@ -69,8 +147,8 @@ import (
 	"unicode/utf8"
 
 	"github.com/tailscale/setec/client/setec"
+	"github.com/tailscale/tailsql/sqllex"
 	"tailscale.com/client/tailscale/apitype"
-	"tailscale.com/types/logger"
 	"tailscale.com/util/httpm"
 )
 
@@ -108,34 +186,87 @@ func requestHasSecureHeader(r *http.Request) bool {
 
 // Server is a server for the tailsql API.
 type Server struct {
-	lc        LocalClient
-	state     *localState // local state database (for query logs)
-	self      string      // if non-empty, the local state source label
-	links     []UILink
-	prefix    string
-	rules     []UIRewriteRule
-	authorize func(string, *apitype.WhoIsResponse) error
-	qcheck    func(Query) (Query, error)
-	qtimeout  time.Duration
-	logf      logger.Logf
-
-	mu  sync.Mutex
-	dbs []*setec.Updater[*dbHandle]
+	lc      LocalClient
+	prefix  string
+	rules   []UIRewriteRule
+	secrets SecretProvider // for sources added by Reload (may be nil)
+	maskKey []byte         // for hashing masked values (see MaskHash)
+	state   *localState    // local state database (may be nil)
+	audit   *auditor       // audit event delivery (nil if no sinks)
+	metrics *serverMetrics
+	hooks   Hooks
+	log     *slog.Logger
+
+	ctx  context.Context // canceled when the server is closed
+	stop context.CancelFunc
+
+	reloadMu sync.Mutex  // serializes calls to Reload
+	pingMu   sync.Mutex  // serializes pings requested by /readyz
+	dbs      registry    // the available data sources
+	inflight inflightSet // the queries currently running
+	reqs     requestTracker
+
+	closeOnce sync.Once
+	closeErr  error // the result of closing, once closed
+
+	mu       sync.Mutex
+	cfg      serverSettings
+	watchers map[string]context.CancelFunc // source name → stop watching
+}
+
+// serverSettings are the settings of a Server that can be updated by Reload.
+type serverSettings struct {
+	links         []UILink
+	qtimeout      time.Duration     // 0 means no timeout
+	rowLimit      int               // maximum rows to fetch per query
+	uiRowLimit    int               // maximum rows to render in the UI
+	fanoutLimit   int               // maximum sources to query concurrently
+	noPushdown    map[string]bool   // sources with LIMIT push-down disabled
+	callerQueries map[string]bool   // sources allowing caller-scoped named queries
+	annotations   map[string]string // source → query annotation format
+	masks         []MaskRule        // column masking rules
+
+	authorize func(string, *apitype.WhoIsResponse) error // access check (see Options.Access)
+	qcheck    func(Query) (Query, error)                 // query check (see Options.CheckQuery)
+}
+
+// pushdownLimit returns the LIMIT to add to queries for h, or 0 if queries
+// for h are not rewritten (see DBSpec.NoLimitPushdown). The limit is one more
+// than the row limit, so that the server can tell when rows were omitted.
+func (c serverSettings) pushdownLimit(h *dbHandle) int {
+	if c.noPushdown[h.Source()] || h.Dialect() == sqllex.Generic {
+		return 0
+	}
+	return c.rowLimit + 1
 }
 
 // NewServer constructs a new server with the given Options.
 func NewServer(opts Options) (*Server, error) {
 	// Check the validity of the sources, and get any secret names they require
-	// from the secrets service. If there are any, we also require that a
-	// secrets service URL is configured.
+	// from the secret provider. If there are any, we also require that a
+	// secret provider is configured.
 	sec, err := opts.CheckSources()
 	if err != nil {
 		return nil, fmt.Errorf("checking sources: %w", err)
-	} else if len(sec) != 0 && opts.SecretStore == nil {
-		return nil, fmt.Errorf("have %d named secrets but no secret store", len(sec))
+	}
+	if err := opts.checkMasks(); err != nil {
+		return nil, fmt.Errorf("checking masks: %w", err)
+	}
+	if err := opts.checkAccess(); err != nil {
+		return nil, err
+	}
+	secrets, err := opts.secretProvider()
+	if err != nil {
+		return nil, fmt.Errorf("secret provider: %w", err)
+	} else if len(sec) != 0 && secrets == nil {
+		return nil, fmt.Errorf("have %d named secrets but no secret provider", len(sec))
 	}
 
-	dbs, err := opts.openSources(context.Background(), opts.SecretStore)
+	maskKey, err := opts.maskKey(context.Background(), secrets)
+	if err != nil {
+		return nil, fmt.Errorf("mask key: %w", err)
+	}
+	dbs, err := opts.openSources(context.Background(), secrets)
 	if err != nil {
 		return nil, fmt.Errorf("opening sources: %w", err)
 	}
@@ -145,37 +276,56 @@ func NewServer(opts Options) (*Server, error) {
 	}
 	if state != nil && opts.LocalSource != "" {
 		dbs = append(dbs, setec.StaticUpdater(&dbHandle{
-			src:   opts.LocalSource,
-			label: "tailsql local state",
-			db:    state,
+			src:    opts.LocalSource,
+			label:  "tailsql local state",
+			driver: "sqlite",
+			db:     state,
 			named: map[string]string{
 				"schema": `select * from sqlite_schema`,
 			},
 		}))
 	}
 
+	ctx, stop := context.WithCancel(context.Background())
+	s := &Server{
+		lc:      opts.LocalClient,
+		prefix:  opts.routePrefix(),
+		rules:   opts.UIRewriteRules,
+		secrets: secrets,
+		maskKey: maskKey,
+		state:   state,
+		audit:   opts.auditor(state),
+		metrics: newServerMetrics(),
+		hooks:   opts.hooks(),
+		log:     opts.logger(),
+		cfg:     opts.settings(),
+		ctx:     ctx,
+		stop:    stop,
+	}
+	for _, u := range dbs {
+		s.dbs.add(u) // OK, source names were checked above
+	}
 	if opts.Metrics != nil {
-		addMetrics(opts.Metrics)
-	}
-	return &Server{
-		lc:        opts.LocalClient,
-		state:     state,
-		self:      opts.LocalSource,
-		links:     opts.UILinks,
-		prefix:    opts.routePrefix(),
-		rules:     opts.UIRewriteRules,
-		authorize: opts.authorize(),
-		qcheck:    opts.checkQuery(),
-		qtimeout:  opts.QueryTimeout.Duration(),
-		logf:      opts.logf(),
-		dbs:       dbs,
-	}, nil
+		s.addMetrics(opts.Metrics)
+	}
+	s.startReconnect(s.getHandles())
+	s.startSecretWatch(s.getHandles())
+	for _, spec := range opts.Sources {
+		s.startWatch(spec.Source, &spec)
+	}
+	if d := opts.HealthCheckInterval.Duration(); d > 0 {
+		go s.checkHealthLoop(d)
+	}
+	return s, nil
 }
 
 // SetDB adds or replaces the database associated with the specified source in
-// s with the given open db and options. See [Server.SetSource].
+// s with the given open db and options. The connection pool settings from opts,
+// if any, are applied to db, and each query runs in a read-only transaction
+// with the session settings from opts. See [Server.SetSource].
 func (s *Server) SetDB(source string, db *sql.DB, opts *DBOptions) bool {
-	return s.SetSource(source, sqlDB{DB: db}, opts)
+	opts.poolOptions().apply(db)
+	return s.SetSource(source, newSQLDB(db, "", opts.sessionOptions()), opts)
 }
 
 // SetSource adds or replaces the database associated with the specified source
@@ -190,39 +340,251 @@ func (s *Server) SetSource(source string, db Queryable, opts *DBOptions) bool {
 	if db == nil {
 		panic("new database is nil")
 	}
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	return s.dbs.set(source, db, opts)
+}
 
-	for _, u := range s.dbs {
-		if src := u.Get(); src.Source() == source {
-			src.swap(db, opts)
-			return true
-		}
+// RemoveSource removes the specified source from s, and reports whether it
+// was present. Once RemoveSource begins, new queries for the source will fail
+// as if it does not exist. Queries already in flight are allowed to finish,
+// and then the database handle is closed. RemoveSource does not return until
+// the handle has been closed.
+func (s *Server) RemoveSource(source string) bool {
+	h := s.dbs.remove(source)
+	if h == nil {
+		return false
 	}
-	s.dbs = append(s.dbs, setec.StaticUpdater(&dbHandle{
-		db:    db,
-		src:   source,
-		label: opts.label(),
-		named: opts.namedQueries(),
-	}))
-	return false
+	s.startWatch(source, nil)
+	if err := h.close(); err != nil {
+		s.log.Warn("closing source failed", "source", source, "error", err)
+	}
+	return true
 }
 
-// Close closes all the database handles held by s and returns the join of
-// their errors.
-func (s *Server) Close() error {
-	dbs := s.getHandles()
-	errs := make([]error, len(dbs))
-	for i, db := range dbs {
-		errs[i] = db.close()
+// Sources returns descriptions of the data sources currently available from
+// s, in order. The first source is the default for queries that do not specify
+// one. The connection settings of the sources are not reported.
+func (s *Server) Sources() []DBSpec {
+	var out []DBSpec
+	for _, h := range s.getHandles() {
+		out = append(out, DBSpec{
+			Source: h.Source(),
+			Label:  h.Label(),
+			Named:  h.Named(),
+
+			// N.B. Don't report the URL or the KeyFile location.
+		})
+	}
+	return out
+}
+
+// Reload updates the configuration of s to match opts. It is intended to
+// allow a running server to pick up changes to its configuration file.
+//
+// Sources listed in opts that s does not already have are opened and added.
+// Sources whose connection settings have changed are reopened, and the new
+// connection replaces the old one once its in-flight queries have finished.
+// Sources that were defined by the options but are no longer listed in opts
+// are removed and closed. Sources added by SetSource or SetDB, and the local
+// state source, are not affected. File watchers (see DBSpec.WatchInterval) are
+// restarted to match the new settings. Labels, named queries, UI links, the
+// query timeout, row limits, mask rules, the access policy or Authorize
+// callback, and the query check are updated to match opts. If
+// opts.CheckQuery is nil, DefaultCheckQuery is used.
+//
+// Settings that cannot change while the server is running, such as the route
+// prefix, local state, and other callbacks, are ignored. If opts does not specify a
+// secret provider, the provider from the original options is used for new
+// secrets.
+//
+// If a source cannot be opened or updated, it keeps its previous state (if
+// any), and Reload reports an error for it after applying all other changes.
+func (s *Server) Reload(ctx context.Context, opts Options) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	var errs []error
+	secrets, err := opts.secretProvider()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("secret provider: %w", err))
+	}
+	if secrets == nil {
+		secrets = s.secrets
+	}
+
+	cur := make(map[string]*dbHandle)
+	for _, h := range s.getHandles() {
+		cur[h.Source()] = h
+	}
+
+	var added []*setec.Updater[*dbHandle]
+	watch := make(map[string]DBSpec) // sources to (re)start watching
+	replaced := make(map[string]*setec.Updater[*dbHandle])
+	listed := make(map[string]bool)
+	for _, spec := range opts.Sources {
+		listed[spec.Source] = true // even if invalid, so we do not remove it
+		if err := spec.checkValid(); err != nil {
+			errs = append(errs, fmt.Errorf("source %q: %w", spec.Source, err))
+			continue
+		} else if spec.Secret != "" && secrets == nil {
+			errs = append(errs, fmt.Errorf("source %q: named secret but no secret provider", spec.Source))
+			continue
+		}
+
+		h, ok := cur[spec.Source]
+		if !ok {
+			u, err := opts.openSource(ctx, secrets, spec)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("open source %q: %w", spec.Source, err))
+				if !opts.AllowUnavailable {
+					continue
+				}
+				u = setec.StaticUpdater(newUnavailableHandle(spec, err))
+			}
+			s.log.Info("reload: added source", "source", spec.Source)
+			added = append(added, u)
+			watch[spec.Source] = spec
+			continue
+		}
+		u, err := s.reloadSource(ctx, opts, secrets, h, spec)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("update source %q: %w", spec.Source, err))
+			continue
+		} else if u != nil {
+			replaced[spec.Source] = u
+		}
+		watch[spec.Source] = spec
+	}
+
+	var closing []*dbHandle
+	for _, u := range replaced {
+		if old := s.dbs.replace(u); old != nil {
+			closing = append(closing, old)
+			s.startSecretWatch([]*dbHandle{u.Get()})
+		} else {
+			closing = append(closing, u.Get()) // removed concurrently
+		}
+	}
+	for _, h := range s.getHandles() {
+		if h.Conf() != "" && !listed[h.Source()] {
+			if old := s.dbs.remove(h.Source()); old != nil {
+				s.log.Info("reload: removed source", "source", h.Source())
+				s.startWatch(h.Source(), nil)
+				closing = append(closing, old)
+			}
+		}
+	}
+	for _, u := range added {
+		if !s.dbs.add(u) {
+			errs = append(errs, fmt.Errorf("source %q was added concurrently", u.Get().Source()))
+			delete(watch, u.Get().Source())
+			closing = append(closing, u.Get())
+		} else {
+			s.startReconnect([]*dbHandle{u.Get()})
+			s.startSecretWatch([]*dbHandle{u.Get()})
+		}
+	}
+	for src, spec := range watch {
+		s.startWatch(src, &spec)
+	}
+
+	// If the mask rules or the access policy are not valid, keep the previous
+	// ones rather than exposing the columns or sources they protect.
+	cfg := opts.settings()
+	if err := opts.checkMasks(); err != nil {
+		errs = append(errs, fmt.Errorf("checking masks: %w", err))
+		cfg.masks = s.settings().masks
+	}
+	if err := opts.checkAccess(); err != nil {
+		errs = append(errs, err)
+		cfg.authorize = s.settings().authorize
+	}
+	s.mu.Lock()
+	s.cfg = cfg
+	s.mu.Unlock()
+
+	// Closing a handle waits for its in-flight queries to finish, so do not
+	// block the caller for that.
+	for _, h := range closing {
+		go func() {
+			if err := h.close(); err != nil {
+				s.log.Warn("closing source failed", "source", h.Source(), "error", err)
+			}
+		}()
 	}
 	return errors.Join(errs...)
 }
 
+// reloadSource updates h to match spec. If the existing handle can be updated
+// in place, it does so and returns nil; otherwise it returns a new updater to
+// replace h.
+func (s *Server) reloadSource(ctx context.Context, opts Options, secrets SecretProvider, h *dbHandle, spec DBSpec) (*setec.Updater[*dbHandle], error) {
+	conf := h.Conf()
+	if conf == "" {
+		return nil, errors.New("source is not defined by the configuration")
+	}
+	up := &dbUpdate{label: spec.label(), named: spec.Named}
+
+	// A programmatic source cannot be compared with its previous value, so
+	// update only its metadata.
+	if spec.DB != nil {
+		return nil, h.post(up)
+	}
+
+	var connString string
+	if spec.Secret == "" {
+		var err error
+		connString, err = spec.connString()
+		if err != nil {
+			return nil, err
+		}
+	}
+	newConf := spec.connKey(connString)
+	if newConf == conf {
+		// Connection settings are unchanged, but pool and session settings
+		// may differ.
+		h.setPool(spec.PoolOptions)
+		h.setSession(spec.SessionOptions)
+		return nil, h.post(up)
+	}
+
+	// If neither the old nor the new settings use a secret, swap in a new
+	// connection on the existing handle. Otherwise, replace the handle.
+	// A handle for an unavailable source is always replaced.
+	if spec.Secret == "" && conf != programmaticConf && conf != unavailableConf && !strings.HasPrefix(conf, "secret:") {
+		db, err := openAndPing(ctx, spec.Driver, connString, spec.PoolOptions)
+		if err != nil {
+			return nil, err
+		}
+		up.newDB = newSQLDB(db, spec.Driver, spec.SessionOptions)
+		up.driver = spec.Driver
+		up.conf = newConf
+		if err := h.post(up); err != nil {
+			return nil, err
+		}
+		s.log.Info("reload: reopened source", "source", spec.Source)
+		return nil, nil
+	}
+	u, err := opts.openSource(ctx, secrets, spec)
+	if err != nil {
+		return nil, err
+	}
+	s.log.Info("reload: replaced source", "source", spec.Source)
+	return u, nil
+}
+
+// Close closes all the database handles held by s and returns the join of
+// their errors. Requests in progress are canceled, and each handle is closed
+// once the queries using it have stopped. To let requests in progress finish,
+// use Shutdown instead. Calls after the first Close or Shutdown have no
+// effect, and report the same error.
+func (s *Server) Close() error { return s.shutdown(closeWait) }
+
 // NewMux constructs an HTTP router for the service.
 func (s *Server) NewMux() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.Handle(s.prefix+"/", http.StripPrefix(s.prefix, http.HandlerFunc(s.serveUI)))
+	mux.HandleFunc(s.prefix+"/healthz", s.serveHealthz)
+	mux.HandleFunc(s.prefix+"/readyz", s.serveReadyz)
 
 	// N.B. We have to strip the prefix back off for the static files, since the
 	// embedded FS thinks it is rooted at "/".
@@ -231,47 +593,74 @@ func (s *Server) NewMux() *http.ServeMux {
 }
 
 func (s *Server) serveUI(w http.ResponseWriter, r *http.Request) {
+	// Assign an ID to the request, to be reported in its logs and in any
+	// error response.
+	id := newRequestID()
+	w.Header().Set(requestIDHeader, id)
+	r = r.WithContext(withRequestMeta(r.Context(), requestMeta{
+		id: id, remoteAddr: r.RemoteAddr, path: r.URL.Path,
+	}))
 	if r.Method != httpm.GET {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		httpError(w, r, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	q, err := s.qcheck(Query{
-		Source: r.FormValue("src"),
-		Query:  strings.TrimSpace(r.FormValue("q")),
-	})
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if !s.reqs.begin() {
+		httpError(w, r, "server is shutting down", http.StatusServiceUnavailable)
 		return
 	}
+	defer s.reqs.end()
+
+	// Cancel the request if the server is closed while it is in progress.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	defer context.AfterFunc(s.ctx, cancel)()
+	r = r.WithContext(s.hooks.RequestReceived(ctx, r))
+	q := Query{
+		Source:  r.FormValue("src"),
+		Query:   strings.TrimSpace(r.FormValue("q")),
+		Diff:    r.FormValue("diff"),
+		DiffKey: r.FormValue("key"),
+	}
 	if q.Source == "" {
 		dbs := s.getHandles()
 		if len(dbs) != 0 {
 			q.Source = dbs[0].Source() // default to the first source
 		}
 	}
+	if h := s.dbHandleForSource(q.Source); h != nil {
+		q.Driver = h.Driver()
+	}
+	q, err := s.settings().qcheck(q)
+	if err != nil {
+		s.auditRejected(s.lookupCaller(r), q.Source, q.Query, err)
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	caller, isAuthorized := s.checkAuth(w, r, q.Source, q.Query)
+	caller, who, isAuthorized := s.checkAuth(w, r, q.Source, q.Query)
+	ctx = s.hooks.Authorized(withWhoIs(r.Context(), who), caller, q, isAuthorized)
 	if !isAuthorized {
-		authErrorCount.Add(1)
+		s.metrics.errors.Add("auth", 1)
 		return
 	}
+	r = r.WithContext(ctx)
 
 	switch r.URL.Path {
 	case "/":
-		htmlRequestCount.Add(1)
+		s.metrics.requests.Add("html", 1)
 		err = s.serveUIInternal(w, r, caller, q)
 	case "/csv":
-		csvRequestCount.Add(1)
+		s.metrics.requests.Add("csv", 1)
 		err = s.serveCSVInternal(w, r, caller, q)
 	case "/json":
-		jsonRequestCount.Add(1)
+		s.metrics.requests.Add("json", 1)
 		err = s.serveJSONInternal(w, r, caller, q)
 	case "/meta":
-		metaRequestCount.Add(1)
+		s.metrics.requests.Add("meta", 1)
 		err = s.serveMetaInternal(w, r)
 	default:
-		badRequestErrorCount.Add(1)
-		http.Error(w, "not found", http.StatusNotFound)
+		s.metrics.errors.Add("bad_request", 1)
+		httpError(w, r, "not found", http.StatusNotFound)
 		return
 	}
 	if err != nil {
@@ -280,11 +669,11 @@ func (s *Server) serveUI(w http.ResponseWriter, r *http.Request) {
 			http.Redirect(w, r, r.URL.String(), code)
 			return
 		} else if code >= 400 && code < 500 {
-			badRequestErrorCount.Add(1)
+			s.metrics.errors.Add("bad_request", 1)
 		} else {
-			internalErrorCount.Add(1)
+			s.metrics.errors.Add("internal", 1)
 		}
-		http.Error(w, err.Error(), errorCode(err))
+		httpError(w, r, err.Error(), errorCode(err))
 		return
 	}
 }
@@ -302,29 +691,34 @@ func (s *Server) serveUIInternal(w http.ResponseWriter, r *http.Request, caller
 	}
 
 	w.Header().Set("Content-Type", "text/html")
+	cfg := s.settings()
+	hs := s.getHandles()
 	data := &uiData{
 		Query:       q.Query,
 		Source:      q.Source,
-		Sources:     s.getHandles(),
-		Links:       s.links,
+		Diff:        q.Diff,
+		DiffKey:     q.DiffKey,
+		Sources:     hs,
+		Patterns:    sourcePatterns(hs),
+		Links:       cfg.links,
 		RoutePrefix: s.prefix,
 	}
 	out, err := s.queryContext(r.Context(), caller, q)
 	if errors.Is(err, errTooManyRows) {
 		out.More = true
 	} else if err != nil {
-		queryErrorCount.Add(1)
+		s.metrics.errors.Add("query", 1)
 		msg := err.Error()
 		data.Error = &msg
+		data.RequestID = requestIDFromContext(r.Context())
 		return ui.Execute(w, data)
 	}
 
 	// Don't send too many rows to the UI, the DOM only has one gerbil on its
 	// wheel. Note we leave NumRows alone, so it can be used to report the real
 	// number of results the query returned.
-	const maxUIRows = 500
-	if out != nil && out.NumRows > maxUIRows {
-		out.Rows = out.Rows[:maxUIRows]
+	if out != nil && out.NumRows > cfg.uiRowLimit {
+		out.Rows = out.Rows[:cfg.uiRowLimit]
 		out.Trunc = true
 	}
 	data.Output = out.uiOutput("(null)", s.rules)
@@ -346,7 +740,7 @@ func (s *Server) serveCSVInternal(w http.ResponseWriter, r *http.Request, caller
 	if errors.Is(err, errTooManyRows) {
 		// fall through to serve what we got
 	} else if err != nil {
-		queryErrorCount.Add(1)
+		s.metrics.errors.Add("query", 1)
 		return err
 	}
 
@@ -369,7 +763,7 @@ func (s *Server) serveJSONInternal(w http.ResponseWriter, r *http.Request, calle
 
 	out, err := s.queryContextJSON(r.Context(), caller, q)
 	if err != nil {
-		queryErrorCount.Add(1)
+		s.metrics.errors.Add("query", 1)
 		return err
 	}
 
@@ -387,19 +781,30 @@ func (s *Server) serveJSONInternal(w http.ResponseWriter, r *http.Request, calle
 // serveMetaInternal handles the GET /meta route.
 func (s *Server) serveMetaInternal(w http.ResponseWriter, r *http.Request) error {
 	w.Header().Set("Content-Type", "application/json")
-	opts := &Options{UILinks: s.links, QueryTimeout: Duration(s.qtimeout)}
+	cfg := s.settings()
+	opts := &Options{
+		Sources:      s.Sources(),
+		UILinks:      cfg.links,
+		QueryTimeout: Duration(cfg.qtimeout),
+		RowLimit:     cfg.rowLimit,
+		UIRowLimit:   cfg.uiRowLimit,
+		FanoutLimit:  cfg.fanoutLimit,
+	}
+	var health []SourceHealth
+	pushdown := make(map[string]int)
 	for _, h := range s.getHandles() {
-		opts.Sources = append(opts.Sources, DBSpec{
-			Source: h.Source(),
-			Label:  h.Label(),
-			Named:  h.Named(),
-
-			// N.B. Don't report the URL or the KeyFile location.
-		})
+		health = append(health, h.Health())
+		if lim := cfg.pushdownLimit(h); lim > 0 {
+			pushdown[h.Source()] = lim
+		}
 	}
 	return json.NewEncoder(w).Encode(struct {
-		Meta *Options `json:"meta"`
-	}{Meta: opts})
+		Meta   *Options       `json:"meta"`
+		Health []SourceHealth `json:"health,omitempty"`
+
+		// Sources whose SELECT queries may have a LIMIT added, and the limit.
+		LimitPushdown map[string]int `json:"limitPushdown,omitempty"`
+	}{Meta: opts, Health: health, LimitPushdown: pushdown})
 }
 
 // errTooManyRows is a sentinel error reported by queryContextAny when a
@@ -423,114 +828,179 @@ func (s *Server) queryContext(ctx context.Context, caller string, q Query) (*dbR
 		return s.queryMeta(ctx, q.Query)
 	}
 
+	// A query that refers to tables as "from:source.table" is a federated
+	// query, which combines data from those sources regardless of q.Source.
+	if refs := parseFederated(q.Query); len(refs) != 0 {
+		return s.queryFederated(ctx, caller, q, refs)
+	}
+
+	// A query with a second source compares the results of the two.
+	if q.Diff != "" {
+		return s.queryDiff(ctx, caller, q)
+	}
+
+	// A source pattern such as "shard*" fans the query out to each matching
+	// source.
+	if isSourcePattern(q.Source) {
+		return s.queryFanout(ctx, caller, q)
+	}
+
 	h := s.dbHandleForSource(q.Source)
 	if h == nil {
-		return nil, statusErrorf(http.StatusBadRequest, "unknown source %q", q.Source)
+		return nil, s.auditRejected(caller, q.Source, q.Query, statusErrorf(http.StatusBadRequest, "unknown source %q", q.Source))
 	}
 	// Verify that the query does not contain statements we should not ask the
 	// database to execute.
-	if err := checkQuerySyntax(q.Query); err != nil {
-		return nil, statusErrorf(http.StatusBadRequest, "invalid query: %w", err)
+	if err := checkQuerySyntax(h.Dialect(), q.Query); err != nil {
+		return nil, s.auditRejected(caller, q.Source, q.Query, statusErrorf(http.StatusBadRequest, "invalid query: %w", err))
 	}
 
-	const maxRowsPerQuery = 10000
-
-	if s.qtimeout > 0 {
+	cfg := s.settings()
+	if !isTableQuery(ctx) {
+		if err := checkMaskedQuery(cfg.masks, q.Source, q.Query, whoIsFromContext(ctx)); err != nil {
+			return nil, s.auditRejected(caller, q.Source, q.Query, err)
+		}
+	}
+	if cfg.qtimeout > 0 {
 		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, s.qtimeout)
+		ctx, cancel = context.WithTimeout(ctx, cfg.qtimeout)
 		defer cancel()
 	}
 
-	return runQuery(ctx, h,
+	var started bool // whether the query reached the database handle
+	res, err := runQuery(ctx, h,
 		func(fctx context.Context, db Queryable) (_ *dbResult, err error) {
+			started = true
+			hq := q // as given, for the hooks
+			fctx = s.hooks.QueryStarted(fctx, caller, hq)
 			start := time.Now()
+			defer s.inflight.add(inflightQuery{
+				source: q.Source, caller: caller, query: q.Query, start: start,
+			})()
+			s.metrics.inflight.Add(1)
+			defer s.metrics.inflight.Add(-1)
+			s.audit.record(AuditEvent{
+				Time: start, Kind: AuditQueryStart, Caller: caller, Source: q.Source, Query: q.Query,
+			})
 			var out dbResult
+			var masked []string // columns masked for the caller
 			defer func() {
 				out.Elapsed = time.Since(start)
-				s.logf("[tailsql] query who=%q src=%q query=%q elapsed=%v err=%v",
-					caller, q.Source, q.Query, out.Elapsed.Round(time.Millisecond), err)
-
-				// Record successful queries in the persistent log.  But don't log
-				// queries to the state database itself.
-				if err == nil && q.Source != s.self {
-					serr := s.state.LogQuery(ctx, caller, q, out.Elapsed)
-					if serr != nil {
-						s.logf("[tailsql] WARNING: Error logging query: %v", serr)
-					}
+				attrs := []any{
+					"caller", caller, "source", q.Source, "query", q.Query, "query_hash", queryHash(q.Query),
+					"elapsed", out.Elapsed.Round(time.Millisecond), "rows", len(out.Rows), "error", err,
 				}
+				if len(masked) != 0 {
+					attrs = append(attrs, "masked", masked)
+				}
+				s.logger(ctx).Info("query", attrs...)
+
+				// Record the query in the metrics and the audit log, including
+				// the persistent query log if there is one.
+				s.metrics.recordQuery(fctx, q.Source, out.Elapsed, len(out.Rows), out.Bytes, err)
+				s.auditQueryEnd(caller, q.Source, q.Query, &out, masked, err)
+				s.hooks.QueryFinished(fctx, hq, queryStats(&out, masked, err), err)
 			}()
 
-			// Check for a named query.
+			// Check for a named query, and bind the values of any caller
+			// variables it refers to as parameters.
+			var params []any
 			if name, ok := strings.CutPrefix(q.Query, "named:"); ok {
 				real, ok := lookupNamedQuery(fctx, name)
 				if !ok {
 					return nil, statusErrorf(http.StatusBadRequest, "named query %q not recognized", name)
 				}
-				s.logf("[tailsql] resolved named query %q to %#q", name, real)
+				s.logger(ctx).Info("resolved named query", "name", name, "query", real)
+				real, params, err = bindCallerVars(h.Dialect(), real, whoIsFromContext(ctx))
+				if err != nil {
+					return nil, fmt.Errorf("named query %q: %w", name, err)
+				}
 				q.Query = real
 			}
 
-			rows, err := db.Query(fctx, q.Query)
-			if err != nil {
-				return nil, err
+			// Add a limit so the database can stop early, if possible, and
+			// the annotation for the source, if any.  Note that q is logged
+			// as given, without either.
+			query := q.Query
+			if lim := cfg.pushdownLimit(h); lim > 0 {
+				if pq, ok := pushLimit(h.Dialect(), query, lim); ok {
+					query = pq
+					out.Limit = lim
+				}
 			}
-			defer rows.Close()
+			query = annotateQuery(ctx, cfg.annotations[q.Source], caller, q.Source, query)
 
-			cols, err := rows.Columns()
+			rows, err := db.Query(fctx, query, params...)
 			if err != nil {
-				return nil, fmt.Errorf("listing column names: %w", err)
-			}
-			out.Columns = cols
-
-			var tooMany bool
-			for rows.Next() && !tooMany {
-				if len(out.Rows) == maxRowsPerQuery {
-					tooMany = true
-					break
-				} else if fctx.Err() != nil {
-					return nil, fmt.Errorf("scanning row: %w", fctx.Err())
-				}
-				vals := make([]any, len(cols))
-				vptr := make([]any, len(cols))
-				for i := range cols {
-					vptr[i] = &vals[i]
-				}
-				if err := rows.Scan(vptr...); err != nil {
-					return nil, fmt.Errorf("scanning row: %w", err)
-				}
-				out.Rows = append(out.Rows, vals)
+				return nil, err
 			}
-			if err := rows.Err(); err != nil {
-				return nil, fmt.Errorf("scanning rows: %w", err)
+			defer rows.Close()
+			err = readRows(fctx, rows, cfg.rowLimit, &out, func(n int) {
+				s.hooks.RowsStreamed(fctx, hq, n)
+			})
+			if err != nil && !errors.Is(err, errTooManyRows) {
+				return nil, err
 			}
-			out.NumRows = len(out.Rows)
 
-			if tooMany {
-				return &out, errTooManyRows
-			}
-			return &out, nil
+			// Mask sensitive columns before the results leave this function,
+			// whatever the caller does with them.
+			masked = maskResult(cfg.masks, s.maskKey, q.Source, whoIsFromContext(ctx), &out)
+			return &out, err
 		})
+	if err != nil && !started {
+		s.auditRejected(caller, q.Source, q.Query, err)
+	}
+	return res, err
 }
 
-// queryMeta handles meta-queries for internal state.
-func (s *Server) queryMeta(ctx context.Context, metaQuery string) (*dbResult, error) {
-	switch metaQuery {
-	case "meta:named":
-		// Report all the named queries
-		res := &dbResult{
-			Columns: []string{"source", "label", "queryName", "sql"},
+// readRows reads the columns and up to limit rows from rows into out. If
+// there are more than limit rows, it reports errTooManyRows, and out contains
+// the rows read up to that point. It adds the size of the values read to
+// out.Bytes. If progress != nil, it is called with the number of rows read
+// after each batch of rows, and after the last row.
+func readRows(ctx context.Context, rows RowSet, limit int, out *dbResult, progress func(int)) error {
+	cols, err := rows.Columns()
+	if err != nil {
+		return fmt.Errorf("listing column names: %w", err)
+	}
+	out.Columns = cols
+
+	var tooMany bool
+	for rows.Next() && !tooMany {
+		if len(out.Rows) == limit {
+			tooMany = true
+			break
+		} else if ctx.Err() != nil {
+			return fmt.Errorf("scanning row: %w", ctx.Err())
 		}
-		for _, h := range s.getHandles() {
-			source, label := h.Source(), h.Label()
-			for name, sql := range h.Named() {
-				res.Rows = append(res.Rows, []any{source, label, name, sql})
-			}
+		vals := make([]any, len(cols))
+		vptr := make([]any, len(cols))
+		for i := range cols {
+			vptr[i] = &vals[i]
 		}
-		res.NumRows = len(res.Rows)
-		return res, nil
-	default:
-		return nil, statusErrorf(http.StatusBadRequest, "unknown meta-query %q", metaQuery)
+		if err := rows.Scan(vptr...); err != nil {
+			return fmt.Errorf("scanning row: %w", err)
+		}
+		for _, v := range vals {
+			out.Bytes += valueSize(v)
+		}
+		out.Rows = append(out.Rows, vals)
+		if progress != nil && len(out.Rows)%rowsStreamedBatch == 0 {
+			progress(len(out.Rows))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("scanning rows: %w", err)
+	}
+	out.NumRows = len(out.Rows)
+	if progress != nil && out.NumRows%rowsStreamedBatch != 0 {
+		progress(out.NumRows)
+	}
+
+	if tooMany {
+		return errTooManyRows
 	}
+	return nil
 }
 
 // queryContextJSON calls s.queryContextAny and, if it succeeds, converts its
@@ -563,66 +1033,82 @@ func (s *Server) queryContextJSON(ctx context.Context, caller string, q Query) (
 
 // dbHandleForSource returns the database handle matching the specified src, or
 // nil if no matching handle is found.
-func (s *Server) dbHandleForSource(src string) *dbHandle {
-	for _, h := range s.getHandles() {
-		if h.Source() == src {
-			return h
-		}
-	}
-	return nil
-}
+func (s *Server) dbHandleForSource(src string) *dbHandle { return s.dbs.lookup(src) }
 
-// checkAuth reports the name of the caller and whether they have access to the
-// given source.  If the caller does not have access, checkAuth logs an error
-// to w and returns false.  The reported caller name will be "" if no caller
-// can be identified.
-func (s *Server) checkAuth(w http.ResponseWriter, r *http.Request, src, query string) (string, bool) {
+// checkAuth reports the name and identity of the caller and whether they have
+// access to the given source.  If the caller does not have access, checkAuth
+// logs an error to w and returns false.  The reported caller name will be ""
+// and the identity nil if no caller can be identified.
+func (s *Server) checkAuth(w http.ResponseWriter, r *http.Request, src, query string) (string, *apitype.WhoIsResponse, bool) {
 	// If there is no local client, allow everything.
 	if s.lc == nil {
-		return "", true
+		return "", nil, true
 	}
 	whois, err := s.lc.WhoIs(r.Context(), r.RemoteAddr)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return "", false
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return "", nil, false
 	} else if whois == nil {
-		http.Error(w, "not logged in", http.StatusUnauthorized)
-		return "", false
-	}
-	var caller string
-	if whois.Node.IsTagged() {
-		caller = whois.Node.Name
-	} else {
-		caller = whois.UserProfile.LoginName
+		httpError(w, r, "not logged in", http.StatusUnauthorized)
+		return "", nil, false
 	}
+	caller := callerName(whois)
 
 	// If the caller wants the UI or metadata, and didn't send a query, allow it.
 	// The source does not matter when there is no query.
 	if (r.URL.Path == "/" || r.URL.Path == "/meta") && query == "" {
-		return caller, true
+		return caller, whois, true
+	}
+
+	// A meta-query does not use the source. Its results include only the
+	// sources the caller is authorized to query (see queryMeta).  Likewise a
+	// federated query does not use the source, and each source it refers to
+	// is authorized separately (see queryFederated), and a source pattern
+	// runs only on the matching sources the caller may query (see
+	// queryFanout).
+	if strings.HasPrefix(query, "meta:") || len(parseFederated(query)) != 0 || isSourcePattern(src) {
+		return caller, whois, true
+	}
+	err = s.settings().authorize(src, whois)
+	if err != nil && s.allowsCallerQuery(src, query) {
+		err = nil // a caller-scoped named query is permitted (see AllowCallerQueries)
 	}
-	if err := s.authorize(src, whois); err != nil {
-		http.Error(w, err.Error(), http.StatusForbidden)
-		return caller, false
+	s.recordAuth(caller, src, query, err)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusForbidden)
+		return caller, whois, false
 	}
-	return caller, true
+	return caller, whois, true
 }
 
-// getHandles returns the current slice of database handles.  THe caller must
-// not mutate the slice, but it is safe to read it without a lock.
-func (s *Server) getHandles() []*dbHandle {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	out := make([]*dbHandle, len(s.dbs))
+// callerName returns the name by which the caller identified by who is
+// reported: the node name of a tagged node, or else the login name of the user.
+func callerName(who *apitype.WhoIsResponse) string {
+	if who.Node.IsTagged() {
+		return who.Node.Name
+	}
+	return who.UserProfile.LoginName
+}
 
-	// Check for pending updates.
-	for i, u := range s.dbs {
-		out[i] = u.Get()
-		out[i].tryUpdate()
+// lookupCaller returns the name of the caller of r, or "" if it is not known.
+func (s *Server) lookupCaller(r *http.Request) string {
+	if s.lc == nil {
+		return ""
 	}
+	who, err := s.lc.WhoIs(r.Context(), r.RemoteAddr)
+	if err != nil || who == nil {
+		return ""
+	}
+	return callerName(who)
+}
 
-	// It is safe to return the slice because we never remove any elements, new
-	// data are only ever appended to the end.
-	return out
+// settings returns a snapshot of the current reloadable settings of s.
+func (s *Server) settings() serverSettings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
 }
+
+// getHandles returns the current slice of database handles.  Handles in the
+// slice may be closed concurrently if their sources are removed.
+func (s *Server) getHandles() []*dbHandle { return s.dbs.handles() }
@@ -4,27 +4,38 @@
 package tailsql_test
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"database/sql/driver"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"html"
 	"html/template"
 	"io"
+	"log/slog"
 	"math/rand/v2"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"filippo.io/age"
+	"github.com/google/go-cmp/cmp"
 	"github.com/tailscale/setec/client/setec"
 	"github.com/tailscale/setec/setectest"
 	"github.com/tailscale/tailsql/authorizer"
+	"github.com/tailscale/tailsql/querycheck"
 	"github.com/tailscale/tailsql/server/tailsql"
 	"github.com/tailscale/tailsql/uirules"
 	"tailscale.com/client/tailscale/apitype"
@@ -177,12 +188,11 @@ func TestSecrets(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Creating tailsql server: %v", err)
 	}
-	ss.Mux.Handle("/tsql/", ts.NewMux()) // so we can call /meta below
 	defer ts.Close()
 
 	// After opening the server, the database should have the initial secret
 	// value provided on initialization.
-	if got, want := driver.OpenedURL, "string 1"; got != want {
+	if got, want := driver.openedURL(), "string 1"; got != want {
 		t.Errorf("Initial URL: got %q, want %q", got, want)
 	}
 
@@ -190,15 +200,148 @@ func TestSecrets(t *testing.T) {
 	db.MustActivate(db.Superuser, secretName, db.MustPut(db.Superuser, secretName, "string 2"))
 	tick.Poll()
 
-	// Make the database fetch the latest value.
-	if _, err := hs.Client().Get(hs.URL + "/tsql/meta"); err != nil {
-		t.Errorf("Get tailsql meta: %v", err)
+	// The server checks for the new value in the background. After the
+	// update, the database should have the new secret value.
+	deadline := time.Now().Add(30 * time.Second)
+	for driver.openedURL() != "string 2" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Updated URL: got %q, want %q", driver.openedURL(), "string 2")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSecretProviders(t *testing.T) {
+	url1, _ := mustInitSQLite(t)
+	url2, db2 := mustInitSQLite(t)
+	if _, err := db2.Exec(`delete from users where rowid > 4`); err != nil {
+		t.Fatalf("Update database: %v", err)
+	}
+	url2 += "?mode=ro" // so the rotated value differs in size
+
+	dir := t.TempDir()
+	mustWrite := func(t *testing.T, name string, data []byte) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatalf("Write %q: %v", name, err)
+		}
+	}
+
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("Generate age identity: %v", err)
+	}
+	idFile := filepath.Join(dir, "identity.txt")
+	if err := os.WriteFile(idFile, []byte(id.String()+"\n"), 0600); err != nil {
+		t.Fatalf("Write identity: %v", err)
+	}
+	encrypt := func(t *testing.T, value string) []byte {
+		t.Helper()
+		var buf bytes.Buffer
+		w, err := age.Encrypt(&buf, id.Recipient())
+		if err != nil {
+			t.Fatalf("Encrypt: %v", err)
+		}
+		io.WriteString(w, value)
+		if err := w.Close(); err != nil {
+			t.Fatalf("Encrypt: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name     string
+		provider tailsql.SecretProvider
+		config   *tailsql.SecretConfig
+		secret   string
+		set      func(t *testing.T, value string)
+	}{
+		{"Env", tailsql.EnvSecrets{Prefix: "TAILSQL_TEST_"}, nil, "DB", func(t *testing.T, value string) {
+			t.Setenv("TAILSQL_TEST_DB", value)
+		}},
+		{"File", tailsql.FileSecrets{Dir: dir}, nil, "file.key", func(t *testing.T, value string) {
+			mustWrite(t, "file.key", []byte(value+"\n"))
+		}},
+		{"Command", tailsql.CommandSecrets{
+			Command: []string{"cat"},
+			Refresh: time.Millisecond,
+		}, nil, filepath.Join(dir, "command.key"), func(t *testing.T, value string) {
+			mustWrite(t, "command.key", []byte(value))
+		}},
+		{"Age", tailsql.AgeSecrets{
+			Dir:        dir,
+			Identities: []age.Identity{id},
+		}, nil, "secret.age", func(t *testing.T, value string) {
+			mustWrite(t, "secret.age", encrypt(t, value))
+		}},
+		{"AgeConfig", nil, &tailsql.SecretConfig{
+			Provider:     "age",
+			Dir:          dir,
+			IdentityFile: idFile,
+		}, "config.age", func(t *testing.T, value string) {
+			mustWrite(t, "config.age", encrypt(t, value))
+		}},
 	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.set(t, url1)
+			s, err := tailsql.NewServer(tailsql.Options{
+				Sources:        []tailsql.DBSpec{{Source: "main", Driver: "sqlite", Secret: tc.secret}},
+				SecretProvider: tc.provider,
+				Secrets:        tc.config,
+				Logf:           t.Logf,
+			})
+			if err != nil {
+				t.Fatalf("NewServer: unexpected error: %v", err)
+			}
+			defer s.Close()
+
+			htest := httptest.NewServer(s.NewMux())
+			defer htest.Close()
+			cli := htest.Client()
 
-	// After the update, the database should have the new secret value.
-	if got, want := driver.OpenedURL, "string 2"; got != want {
-		t.Errorf("Updated URL: got %q, want %q", got, want)
+			q := url.Values{"q": {"select count(*) n from users"}}
+			if got, want := string(mustGet(t, cli, htest.URL+"/csv?"+q.Encode())), "n\n10\n"; got != want {
+				t.Fatalf("Query: got %q, want %q", got, want)
+			}
+
+			// Rotate the secret, and wait for the source to pick it up.
+			tc.set(t, url2)
+			deadline := time.Now().Add(30 * time.Second)
+			for {
+				got := string(mustGet(t, cli, htest.URL+"/csv?"+q.Encode()))
+				if got == "n\n4\n" {
+					break
+				} else if time.Now().After(deadline) {
+					t.Fatalf("Query after rotation: got %q, want 4 rows", got)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		})
 	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, cfg := range []tailsql.SecretConfig{
+			{Provider: "nonesuch"},
+			{Provider: "command"},
+			{Provider: "age", IdentityFile: filepath.Join(dir, "nonesuch")},
+		} {
+			s, err := tailsql.NewServer(tailsql.Options{Secrets: &cfg})
+			if err == nil {
+				s.Close()
+				t.Errorf("NewServer %+v: got nil, want error", cfg)
+			}
+		}
+
+		// A source with a secret requires a provider.
+		s, err := tailsql.NewServer(tailsql.Options{
+			Sources: []tailsql.DBSpec{{Source: "main", Driver: "sqlite", Secret: "nonesuch"}},
+		})
+		if err == nil {
+			s.Close()
+			t.Error("NewServer: got nil, want error for missing provider")
+		}
+	})
 }
 
 func TestServer(t *testing.T) {
@@ -388,6 +531,67 @@ func (f *fakeClient) WhoIs(_ context.Context, addr string) (*apitype.WhoIsRespon
 	return nil, nil
 }
 
+// A testServer is a tailsql server behind an HTTP test server, for tests that
+// send queries to the API.
+type testServer struct {
+	*tailsql.Server
+	URL string
+	cli *http.Client
+	fc  *fakeClient // the caller, initially user@example.com
+}
+
+// newTestServer constructs a server with opts and starts an HTTP test server
+// for it, both of which are closed when t ends. If opts has no LocalClient,
+// the server uses a fake client. If opts has no logger, logs go to t.Logf.
+func newTestServer(t *testing.T, opts tailsql.Options) *testServer {
+	t.Helper()
+	fc := &fakeClient{isLogged: true, result: &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "fake.ts.net"},
+		UserProfile: &tailcfg.UserProfile{ID: 100, LoginName: "user@example.com"},
+	}}
+	if opts.LocalClient == nil {
+		opts.LocalClient = fc
+	}
+	if opts.Logger == nil && opts.Logf == nil {
+		opts.Logf = t.Logf
+	}
+	s, err := tailsql.NewServer(opts)
+	if err != nil {
+		t.Fatalf("NewServer: unexpected error: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	htest := httptest.NewServer(s.NewMux())
+	t.Cleanup(htest.Close)
+	return &testServer{Server: s, URL: htest.URL, cli: htest.Client(), fc: fc}
+}
+
+// csvURL returns the API URL for the CSV result of text on src, or on the
+// default source if src == "".
+func (ts *testServer) csvURL(src, text string) string {
+	q := url.Values{"q": {text}}
+	if src != "" {
+		q.Set("src", src)
+	}
+	return ts.URL + "/csv?" + q.Encode()
+}
+
+// query sends text to the API for src, and returns the CSV result.
+func (ts *testServer) query(t *testing.T, src, text string) string {
+	t.Helper()
+	return string(mustGet(t, ts.cli, ts.csvURL(src, text), "sec-tailsql", "1"))
+}
+
+// queryStatus sends text to the API for src, and checks that the response has
+// the given status code.
+func (ts *testServer) queryStatus(t *testing.T, src, text string, code int) {
+	t.Helper()
+	if code == http.StatusOK {
+		ts.query(t, src, text)
+	} else {
+		mustGetFail(t, ts.cli, ts.csvURL(src, text), code, "sec-tailsql", "1")
+	}
+}
+
 func TestAuth(t *testing.T) {
 	const testUser = 1234567
 	var (
@@ -484,133 +688,2236 @@ func TestAuth(t *testing.T) {
 	})
 }
 
-// Verify that context cancellation is correctly propagated.
-// This test is specific to SQLite, but the point is to make sure the context
-// plumbing in tailsql is correct.
-func TestQueryTimeout(t *testing.T) {
+func TestMetaQueries(t *testing.T) {
 	_, db := mustInitSQLite(t)
 
-	// This test query runs forever until interrupted.
-	const testQuery = `WITH RECURSIVE inf(n) AS (
-    SELECT 1
-    UNION ALL
-    SELECT n+1 FROM inf
-) SELECT * FROM inf WHERE n = 0`
+	s := newTestServer(t, tailsql.Options{
+		Authorize: func(src string, wr *apitype.WhoIsResponse) error {
+			if src == "secret" && wr.UserProfile.ID != 200 {
+				return errors.New("authorization denied")
+			}
+			return nil
+		},
+		RowLimit: 50,
+	})
 
-	done := make(chan struct{})
-	go func() {
-		defer close(done)
+	bdb := &blockingDB{
+		sqlDB:   sqlDB{DB: db},
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	s.SetSource("main", bdb, &tailsql.DBOptions{Label: "Main", NamedQueries: map[string]string{
+		"count": "select count(*) from users",
+	}})
+	s.SetDB("secret", db, &tailsql.DBOptions{Label: "Secret", NamedQueries: map[string]string{
+		"hidden": "select 'hidden'",
+	}})
+
+	check := func(t *testing.T, query, want string) {
+		t.Helper()
+		if diff := cmp.Diff(want, s.query(t, "", query)); diff != "" {
+			t.Errorf("Query %q (-want, +got):\n%s", query, diff)
+		}
+	}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
-		defer cancel()
+	t.Run("Help", func(t *testing.T) {
+		got := s.query(t, "", "meta:help")
+		for _, want := range []string{"meta:help", "meta:named", "meta:sources", "meta:whoami", "meta:inflight", "meta:limits"} {
+			if !strings.Contains(got, want+",") {
+				t.Errorf("Help: missing %q:\n%s", want, got)
+			}
+		}
+	})
+	t.Run("Unknown", func(t *testing.T) {
+		s.queryStatus(t, "", "meta:nonesuch", http.StatusBadRequest)
+	})
 
-		rows, err := db.QueryContext(ctx, testQuery)
-		if err == nil {
-			t.Errorf("QueryContext: got rows=%v, want error", rows)
-		} else if !errors.Is(err, context.DeadlineExceeded) {
-			t.Errorf("Got error %v, wanted %v", err, context.DeadlineExceeded)
+	// The caller is not authorized for the "secret" source, so its details
+	// are not reported, and querying it directly fails.
+	t.Run("Restricted", func(t *testing.T) {
+		check(t, "meta:named", "source,label,queryName,sql\nmain,Main,count,select count(*) from users\n")
+		check(t, "meta:sources", "source,label,driver,health,lastError\nmain,Main,,unknown,\n")
+		check(t, "meta:whoami", "login,node,tags,sources\nuser@example.com,fake.ts.net,,main\n")
+		check(t, "meta:limits", "setting,source,value\nqueryTimeout,,none\nrowLimit,,50\nuiRowLimit,,500\nfanoutLimit,,4\n")
+
+		s.queryStatus(t, "secret", "select 1", http.StatusForbidden)
+	})
+
+	t.Run("Authorized", func(t *testing.T) {
+		s.fc.result.UserProfile = &tailcfg.UserProfile{ID: 200, LoginName: "admin@example.com"}
+		defer func() { s.fc.result.UserProfile = &tailcfg.UserProfile{ID: 100, LoginName: "user@example.com"} }()
+
+		check(t, "meta:whoami", "login,node,tags,sources\nadmin@example.com,fake.ts.net,,\"main,secret\"\n")
+		if got := s.query(t, "", "meta:named"); !strings.Contains(got, "secret,Secret,hidden") {
+			t.Errorf("Named: missing secret source:\n%s", got)
 		}
-	}()
+	})
 
-	select {
-	case <-done:
-		// OK
-	case <-time.After(30 * time.Second):
-		t.Fatal("Timeout waiting for query to end")
-	}
+	t.Run("Inflight", func(t *testing.T) {
+		done := make(chan error, 1)
+		go func() {
+			req, _ := http.NewRequest("GET", s.csvURL("main", "select 'slow'"), nil)
+			req.Header.Set("Sec-Tailsql", "1")
+			rsp, err := s.cli.Do(req)
+			if err == nil {
+				rsp.Body.Close()
+			}
+			done <- err
+		}()
+		<-bdb.started
+		got := s.query(t, "", "meta:inflight")
+		close(bdb.release)
+		if err := <-done; err != nil {
+			t.Errorf("Slow query: %v", err)
+		}
+
+		if !strings.Contains(got, "main,user@example.com,select 'slow',") {
+			t.Errorf("Inflight: missing running query:\n%s", got)
+		}
+		check(t, "meta:inflight", "source,caller,query,started,elapsed\n")
+	})
 }
 
-func TestQueryable(t *testing.T) {
-	_, db := mustInitSQLite(t)
+func TestFederatedQuery(t *testing.T) {
+	_, mainDB := mustInitSQLite(t)
+	_, hrDB := mustInitSQLite(t)
+	if _, err := hrDB.Exec(`
+create table salaries (name text, amount integer);
+insert into salaries values ('alice', 100), ('eve', 75);
+create table big (n integer);
+insert into big with recursive c(n) as (select 1 union all select n+1 from c where n < 11) select n from c;
+`); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
 
-	s, err := tailsql.NewServer(tailsql.Options{
-		Sources: []tailsql.DBSpec{{
-			Source: "quux",
-			Label:  "Happy fun database",
-			DB:     sqlDB{DB: db},
+	var logMu sync.Mutex
+	var logs []string
+	s := newTestServer(t, tailsql.Options{
+		Authorize: func(src string, wr *apitype.WhoIsResponse) error {
+			if src == "hr" && wr.UserProfile.ID != 200 {
+				return errors.New("authorization denied")
+			}
+			return nil
+		},
+		RowLimit: 10,
+		Logf: func(msg string, args ...any) {
+			logMu.Lock()
+			defer logMu.Unlock()
+			logs = append(logs, fmt.Sprintf(msg, args...))
+		},
+	})
+	s.SetDB("main", mainDB, nil)
+	s.SetDB("hr", hrDB, nil)
 
-			// Note: Omit Driver to exercise that this is allowed when a
-			// programmatic data source is given.
-		}},
+	const joinQuery = `select u.name, u.title, s.amount
+from from:main.users u join from:hr.salaries s using (name)
+order by u.name`
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		s.queryStatus(t, "", joinQuery, http.StatusForbidden)
+	})
+
+	s.fc.result.UserProfile = &tailcfg.UserProfile{ID: 200, LoginName: "admin@example.com"}
+
+	t.Run("Join", func(t *testing.T) {
+		got := s.query(t, "", joinQuery)
+		want := "name,title,amount\nalice,ceo,100\neve,head of product,75\n"
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Result (-want, +got):\n%s", diff)
+		}
+
+		// Each table is fetched and logged as a query to its own source.
+		logMu.Lock()
+		defer logMu.Unlock()
+		for _, want := range []string{
+			`source=main query="SELECT * FROM users"`,
+			`source=hr query="SELECT * FROM salaries"`,
+			`msg="federated query"`,
+			`caller=admin@example.com sources="[main hr]"`,
+		} {
+			if !slices.ContainsFunc(logs, func(s string) bool { return strings.Contains(s, want) }) {
+				t.Errorf("Logs: missing %q", want)
+			}
+		}
+	})
+
+	t.Run("TooManyRows", func(t *testing.T) {
+		s.queryStatus(t, "", "select count(*) from from:hr.big", http.StatusBadRequest)
+	})
+
+	t.Run("UnknownSource", func(t *testing.T) {
+		s.queryStatus(t, "", "select * from from:nonesuch.users", http.StatusBadRequest)
+	})
+
+	t.Run("NotFederated", func(t *testing.T) {
+		got := s.query(t, "main", "select 'from:hr.salaries' as x")
+		if want := "x\nfrom:hr.salaries\n"; got != want {
+			t.Errorf("Result: got %q, want %q", got, want)
+		}
 	})
+}
+
+func TestFanout(t *testing.T) {
+	_, db1 := mustInitSQLite(t)
+	_, db2 := mustInitSQLite(t)
+	empty, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "empty.db"))
 	if err != nil {
-		t.Fatalf("NewServer: %v", err)
+		t.Fatalf("Open empty database: %v", err)
 	}
-	defer s.Close()
+	defer empty.Close()
 
-	htest := httptest.NewServer(s.NewMux())
-	defer htest.Close()
-	cli := htest.Client()
+	s := newTestServer(t, tailsql.Options{
+		Authorize: func(src string, wr *apitype.WhoIsResponse) error {
+			if src == "shard3" {
+				return errors.New("authorization denied")
+			}
+			return nil
+		},
+		RowLimit:    15,
+		FanoutLimit: 2,
+	})
+	s.SetDB("shard1", db1, nil)
+	s.SetDB("shard2", db2, nil)
+	s.SetDB("shard3", db2, nil) // not authorized
+	s.SetDB("shard4", empty, nil)
+	s.SetDB("other", db1, nil)
+
+	t.Run("Errors", func(t *testing.T) {
+		lines := strings.Split(strings.TrimSpace(s.query(t, "shard*", "select count(*) n from users")), "\n")
+		want := []string{"_source,n,_error", "shard1,10,", "shard2,10,", "shard4,,"}
+		if len(lines) != len(want) {
+			t.Fatalf("Result: got %q, want %d lines", lines, len(want))
+		}
+		for i, line := range lines {
+			if !strings.HasPrefix(line, want[i]) {
+				t.Errorf("Line %d: got %q, want prefix %q", i+1, line, want[i])
+			}
+		}
+		if !strings.Contains(lines[3], "no such table") {
+			t.Errorf("Error row: got %q, want a missing table error", lines[3])
+		}
+	})
 
-	t.Run("Smoke", func(t *testing.T) {
-		const testProbe = "mindlesprocket"
-		q := url.Values{
-			"src": {"quux"},
-			"q":   {fmt.Sprintf(`select '%s'`, testProbe)},
+	t.Run("RowLimit", func(t *testing.T) {
+		got := s.query(t, "shard1*", "select name from users")
+		if n := strings.Count(got, "\n"); n != 11 {
+			t.Errorf("Single shard: got %d lines, want 11", n)
 		}
-		rsp := string(mustGet(t, cli, htest.URL+"/csv?"+q.Encode()))
-		if !strings.Contains(rsp, testProbe) {
-			t.Errorf("Query failed: got %q, want %q", rsp, testProbe)
+		got = s.query(t, "shard*", "select name from users order by name")
+		// The rows are capped at the row limit, but errors are always reported.
+		lines := strings.Split(strings.TrimSpace(got), "\n")
+		if len(lines) != 17 {
+			t.Fatalf("All shards: got %d lines, want 17:\n%s", len(lines), got)
+		}
+		if lines[0] != "_source,name,_error" || lines[1] != "shard1,alice," ||
+			lines[11] != "shard2,alice," || !strings.HasPrefix(lines[16], "shard4,,") {
+			t.Errorf("All shards: unexpected result:\n%s", got)
+		}
+	})
+
+	t.Run("NoMatch", func(t *testing.T) {
+		s.queryStatus(t, "nonesuch*", "select 1", http.StatusBadRequest)
+	})
+
+	t.Run("EmptyShard", func(t *testing.T) {
+		// A check that rewrites the query for one source to be empty skips
+		// that source.
+		s := newTestServer(t, tailsql.Options{
+			CheckQuery: func(q tailsql.Query) (tailsql.Query, error) {
+				if q.Source == "shard2" {
+					q.Query = ""
+				}
+				return q, nil
+			},
+		})
+		s.SetDB("shard1", db1, nil)
+		s.SetDB("shard2", db2, nil)
+		if got, want := s.query(t, "shard*", "select count(*) n from users"), "_source,n\nshard1,10\n"; got != want {
+			t.Errorf("Result: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("UI", func(t *testing.T) {
+		got := string(mustGet(t, s.cli, s.URL+"/"))
+		if !strings.Contains(got, `value="shard*"`) || !strings.Contains(got, "All shard* (4 sources)") {
+			t.Errorf("UI: missing shard* pattern in source picker")
 		}
 	})
 }
 
-type sqlDB struct{ *sql.DB }
+func TestDiff(t *testing.T) {
+	_, db1 := mustInitSQLite(t)
+	_, db2 := mustInitSQLite(t)
+	if _, err := db2.Exec(`DELETE FROM users WHERE name = 'mallory';
+UPDATE users SET title = 'president' WHERE name = 'alice';
+INSERT INTO users VALUES ('oscar', 'eng', 'ohio');`); err != nil {
+		t.Fatalf("Modify database: %v", err)
+	}
 
-func (s sqlDB) Query(ctx context.Context, query string, params ...any) (tailsql.RowSet, error) {
-	return s.DB.QueryContext(ctx, query, params...)
+	s := newTestServer(t, tailsql.Options{
+		Authorize: func(src string, wr *apitype.WhoIsResponse) error {
+			if src == "secret" {
+				return errors.New("authorization denied")
+			}
+			return nil
+		},
+		RowLimit: 12,
+	})
+	s.SetDB("old", db1, nil)
+	s.SetDB("new", db2, nil)
+	s.SetDB("secret", db2, nil)
+	diffURL := func(path, text, diff, key string) string {
+		q := url.Values{"src": {"old"}, "q": {text}, "diff": {diff}, "key": {key}}
+		return s.URL + path + "?" + q.Encode()
+	}
+	const query = "select name, title from users order by name"
+
+	t.Run("Keyed", func(t *testing.T) {
+		got := string(mustGet(t, s.cli, diffURL("/csv", query, "new", "name"), "sec-tailsql", "1"))
+		const want = `_change,name,title
+changed-from,alice,ceo
+changed-to,alice,president
+removed,mallory,eng
+added,oscar,eng
+`
+		if got != want {
+			t.Errorf("Result: got:\n%s\nwant:\n%s", got, want)
+		}
+	})
+
+	t.Run("Unkeyed", func(t *testing.T) {
+		got := string(mustGet(t, s.cli, diffURL("/csv", query, "new", ""), "sec-tailsql", "1"))
+		const want = `_change,name,title
+removed,alice,ceo
+removed,mallory,eng
+added,alice,president
+added,oscar,eng
+`
+		if got != want {
+			t.Errorf("Result: got:\n%s\nwant:\n%s", got, want)
+		}
+	})
+
+	t.Run("UI", func(t *testing.T) {
+		got := string(mustGet(t, s.cli, diffURL("/", query, "new", "name"), "sec-tailsql", "1"))
+		for _, want := range []string{`class="diff-changed-from"`, `class="diff-added"`, `<td class="diff-cell">president</td>`} {
+			if !strings.Contains(got, want) {
+				t.Errorf("UI: missing %q", want)
+			}
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		tests := []struct {
+			name, query, diff, key string
+			want                   int
+		}{
+			{"Unauthorized", query, "secret", "", http.StatusForbidden},
+			{"UnknownSource", query, "nonesuch", "", http.StatusBadRequest},
+			{"SameSource", query, "old", "", http.StatusBadRequest},
+			{"UnknownKey", query, "new", "nonesuch", http.StatusBadRequest},
+			{"DuplicateKey", query, "new", "title", http.StatusBadRequest},
+			{"TooManyRows", "select * from users, misc", "new", "", http.StatusBadRequest},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				mustGetFail(t, s.cli, diffURL("/csv", tc.query, tc.diff, tc.key), tc.want, "sec-tailsql", "1")
+			})
+		}
+	})
 }
 
-func TestRoutePrefix(t *testing.T) {
+func TestMasking(t *testing.T) {
+	_, db := mustInitSQLite(t)
+	fc := &fakeClient{isLogged: true}
+	setCaller := func(login string, caps ...string) {
+		cm := make(tailcfg.PeerCapMap)
+		for _, c := range caps {
+			cm[tailcfg.PeerCapability(c)] = nil
+		}
+		fc.result = &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{Name: "fake.ts.net"},
+			UserProfile: &tailcfg.UserProfile{ID: 100, LoginName: login},
+			CapMap:      cm,
+		}
+	}
 	s, err := tailsql.NewServer(tailsql.Options{
-		RoutePrefix: "/sub/dir",
+		LocalClient: fc,
+		LocalState:  filepath.Join(t.TempDir(), "state.db"),
+		LocalSource: "self",
+		Masks: []tailsql.MaskRule{
+			{Source: "main", Column: "name", Mode: tailsql.MaskHash, Exempt: []string{"admin@example.com"}},
+			{Source: "main", Column: "loc*", Mode: tailsql.MaskPartial, Exempt: []string{"cap:example.com/cap/pii"}},
+			{Column: "title", Mode: tailsql.MaskRedact, Exempt: []string{"cap:example.com/cap/audit"}},
+			{Source: "other", Column: "*", Mode: tailsql.MaskNull},
+		},
+		Logf: t.Logf,
 	})
 	if err != nil {
 		t.Fatalf("NewServer: unexpected error: %v", err)
 	}
 	defer s.Close()
+	const userQuery = `select name, title, location from users where name in ('alice', 'amelie') order by name`
+	s.SetDB("main", db, &tailsql.DBOptions{NamedQueries: map[string]string{
+		"users": userQuery,
+		"alice": `select name from users where name = 'alice'`,
+	}})
+	s.SetDB("other", db, &tailsql.DBOptions{NamedQueries: map[string]string{
+		"alice": `select name, title from users where name = 'alice'`,
+	}})
 
-	hs := httptest.NewServer(s.NewMux())
-	defer hs.Close()
-	cli := hs.Client()
+	htest := httptest.NewServer(s.NewMux())
+	defer htest.Close()
+	cli := htest.Client()
+	query := func(path, src, text string) string {
+		q := url.Values{"src": {src}, "q": {text}}
+		return string(mustGet(t, cli, htest.URL+path+"?"+q.Encode(), "sec-tailsql", "1"))
+	}
 
-	t.Run("NotFound", func(t *testing.T) {
-		rsp, err := cli.Get(hs.URL + "/static/logo.svg")
-		if err != nil {
-			t.Fatalf("Get: unexpected error: %v", err)
+	t.Run("Masked", func(t *testing.T) {
+		setCaller("user@example.com")
+		lines := strings.Split(query("/csv", "main", "named:users"), "\n")
+		if len(lines) != 4 || lines[0] != "name,title,location" {
+			t.Fatalf("Result: got %q, want header and 2 rows", lines)
 		}
-		_, err = io.ReadAll(rsp.Body)
-		rsp.Body.Close()
-		if err != nil {
-			t.Errorf("Read body: %v", err)
+		alice := strings.Split(lines[1], ",")
+		if len(alice[0]) != 16 || alice[0] == "alice" {
+			t.Errorf("Hashed name: got %q", alice[0])
 		}
-		if code := rsp.StatusCode; code != http.StatusNotFound {
-			t.Errorf("Get: got response %v, want %v", code, http.StatusNotFound)
+		if alice[1] != "[redacted]" || alice[2] != "*****rdam" {
+			t.Errorf("Masked values: got %q", alice[1:])
+		}
+		// NULL values are not masked.
+		if amelie := strings.Split(lines[2], ","); amelie[2] != "" {
+			t.Errorf("Masked NULL: got %q, want empty", amelie[2])
+		}
+
+		// Hashes are consistent, so equal values mask to equal hashes.
+		again := strings.Split(query("/csv", "main", "named:alice"), "\n")
+		if again[1] != alice[0] {
+			t.Errorf("Hashed name: got %q, then %q", alice[0], again[1])
 		}
 	})
 
-	t.Run("OK", func(t *testing.T) {
-		txt := string(mustGet(t, cli, hs.URL+"/sub/dir/static/logo.svg"))
-		if !strings.HasPrefix(txt, "<svg ") {
-			t.Errorf("Get logo.svg: output missing SVG prefix:\n%s", txt)
+	t.Run("JSON", func(t *testing.T) {
+		setCaller("user@example.com")
+		got := query("/json", "other", "named:alice")
+		// The first matching rule applies, so title is redacted, not NULL.
+		if want := `{"name":null,"title":"[redacted]"}`; strings.TrimSpace(got) != want {
+			t.Errorf("Result: got %q, want %q", got, want)
 		}
 	})
 
-	t.Run("UI", func(t *testing.T) {
-		txt := string(mustGet(t, cli, hs.URL+"/sub/dir"))
-		if !strings.Contains(txt, "Tailscale SQL Playground") {
-			t.Errorf("Get UI: missing expected title:\n%s", txt)
+	t.Run("Exempt", func(t *testing.T) {
+		setCaller("admin@example.com", "example.com/cap/pii")
+		got := query("/csv", "main", "named:users")
+		if want := "name,title,location\nalice,[redacted],amsterdam\namelie,[redacted],\n"; got != want {
+			t.Errorf("Result: got %q, want %q", got, want)
 		}
 	})
-}
 
-type fakeDriver struct {
-	OpenedURL string
-}
+	t.Run("Federated", func(t *testing.T) {
+		setCaller("user@example.com")
+		// Each table is masked before it is loaded, so the query sees only the
+		// masked values.
+		got := query("/csv", "main", `select location from from:main.users where name = 'alice' or location like '%rdam'`)
+		if want := "location\n*****rdam\n"; got != want {
+			t.Errorf("Result: got %q, want %q", got, want)
+		}
+	})
 
-func (f *fakeDriver) Open(url string) (driver.Conn, error) {
-	f.OpenedURL = url
-	return fakeConn{}, nil
+	t.Run("AdHoc", func(t *testing.T) {
+		// A caller subject to a rule for the source cannot send it ad hoc
+		// queries, which could rename or transform the masked columns.
+		setCaller("user@example.com", "example.com/cap/audit")
+		for _, src := range []string{"main", "other"} {
+			q := url.Values{"src": {src}, "q": {"select name as n from users"}}
+			mustGetFail(t, cli, htest.URL+"/csv?"+q.Encode(), http.StatusForbidden, "sec-tailsql", "1")
+		}
+
+		// In a fan-out query, the rejection is reported for the source.
+		if got := query("/csv", "m*", "select name as n from users"); !strings.Contains(got, "only named queries are allowed") {
+			t.Errorf("Fan-out result: got %q, want a masking error", got)
+		}
+
+		// A caller exempt from all the rules for the source can.
+		setCaller("admin@example.com", "example.com/cap/pii", "example.com/cap/audit")
+		if got, want := query("/csv", "main", "select name as n from users where name = 'alice'"), "n\nalice\n"; got != want {
+			t.Errorf("Result: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("QueryLog", func(t *testing.T) {
+		setCaller("user@example.com", "example.com/cap/audit")
+		got := query("/csv", "self", `select masked from query_log where source = 'main' order by timestamp limit 1`)
+		if want := "masked\n\"name,title,location\"\n"; got != want {
+			t.Errorf("Query log: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("Key", func(t *testing.T) {
+		// Servers with the same key hash values the same way, so the hashes
+		// survive a restart.
+		t.Setenv("TAILSQL_TEST_MASK_KEY", "swordfish\n")
+		hash := func(opts tailsql.Options) string {
+			t.Helper()
+			opts.Masks = []tailsql.MaskRule{{Column: "name", Mode: tailsql.MaskHash}}
+			opts.Logf = t.Logf
+			s, err := tailsql.NewServer(opts)
+			if err != nil {
+				t.Fatalf("NewServer: unexpected error: %v", err)
+			}
+			defer s.Close()
+			_, db := mustInitSQLite(t) // the server closes it
+			s.SetDB("main", db, &tailsql.DBOptions{NamedQueries: map[string]string{
+				"alice": `select name from users where name = 'alice'`,
+			}})
+			htest := httptest.NewServer(s.NewMux())
+			defer htest.Close()
+			q := url.Values{"src": {"main"}, "q": {"named:alice"}}
+			return string(mustGet(t, htest.Client(), htest.URL+"/csv?"+q.Encode()))
+		}
+		env := tailsql.EnvSecrets{Prefix: "TAILSQL_TEST_"}
+		h1 := hash(tailsql.Options{MaskKeySecret: "MASK_KEY", SecretProvider: env})
+		h2 := hash(tailsql.Options{MaskKeySecret: "MASK_KEY", SecretProvider: env})
+		if h1 != h2 {
+			t.Errorf("Hashes with the same secret key differ: %q, %q", h1, h2)
+		}
+		if h3 := hash(tailsql.Options{MaskKey: []byte("swordfish")}); h3 != h1 {
+			t.Errorf("Hashes with the same key differ: %q, %q", h1, h3)
+		}
+		if h4 := hash(tailsql.Options{}); h4 == h1 {
+			t.Errorf("Hash with a random key: got %q, want a different value", h4)
+		}
+
+		if _, err := tailsql.NewServer(tailsql.Options{MaskKeySecret: "MASK_KEY"}); err == nil {
+			t.Error("NewServer: got nil, want error for a mask key secret with no provider")
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := tailsql.NewServer(tailsql.Options{
+			Masks: []tailsql.MaskRule{{Column: "name", Mode: "scramble"}},
+		})
+		if err == nil {
+			t.Error("NewServer: got nil, want error for unknown mask mode")
+		}
+	})
+}
+
+// blockingSink is an AuditSink that records events, but blocks until its
+// release channel is closed.
+type blockingSink struct {
+	release chan struct{}
+
+	mu     sync.Mutex
+	events []tailsql.AuditEvent
+}
+
+func (b *blockingSink) Audit(_ context.Context, events []tailsql.AuditEvent) error {
+	<-b.release
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events = append(b.events, events...)
+	return nil
+}
+
+func TestAudit(t *testing.T) {
+	// runQueries starts a server with the given options, and runs some
+	// queries. Each of 10 queries has an auth, start, and end event, and a
+	// final denied request has only an auth event.
+	const wantEvents = 31
+	runQueries := func(t *testing.T, opts tailsql.Options) *testServer {
+		t.Helper()
+		opts.Authorize = func(src string, _ *apitype.WhoIsResponse) error {
+			if src == "secret" {
+				return errors.New("authorization denied")
+			}
+			return nil
+		}
+		opts.Masks = []tailsql.MaskRule{{Column: "location", Mode: tailsql.MaskRedact}}
+		s := newTestServer(t, opts)
+		_, db := mustInitSQLite(t)
+		s.SetDB("main", db, &tailsql.DBOptions{NamedQueries: map[string]string{
+			"users": "select name, location from users",
+		}})
+		s.SetDB("secret", db, nil)
+
+		for range 10 {
+			s.query(t, "main", "named:users")
+		}
+		s.queryStatus(t, "secret", "select 1", http.StatusForbidden)
+		return s
+	}
+
+	t.Run("Sinks", func(t *testing.T) {
+		var hookMu sync.Mutex
+		var hookEvents []tailsql.AuditEvent
+		hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var events []tailsql.AuditEvent
+			if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+				t.Errorf("Decode webhook body: %v", err)
+			}
+			hookMu.Lock()
+			defer hookMu.Unlock()
+			hookEvents = append(hookEvents, events...)
+		}))
+		defer hook.Close()
+
+		logPath := filepath.Join(t.TempDir(), "audit.jsonl")
+		s := runQueries(t, tailsql.Options{
+			Audit: &tailsql.AuditConfig{
+				File:     logPath,
+				MaxSize:  1500,
+				MaxFiles: 2,
+				Webhook:  hook.URL,
+			},
+		})
+		if err := s.Close(); err != nil { // flushes the events
+			t.Fatalf("Close: unexpected error: %v", err)
+		}
+
+		hookMu.Lock()
+		defer hookMu.Unlock()
+		if len(hookEvents) != wantEvents {
+			t.Fatalf("Webhook: got %d events, want %d", len(hookEvents), wantEvents)
+		}
+		auth, start, end := hookEvents[0], hookEvents[1], hookEvents[2]
+		if auth.Kind != tailsql.AuditAuth || auth.Denied || auth.Caller != "user@example.com" || auth.Source != "main" {
+			t.Errorf("Auth event: got %+v", auth)
+		}
+		if start.Kind != tailsql.AuditQueryStart || start.Query != "named:users" {
+			t.Errorf("Start event: got %+v", start)
+		}
+		if end.Kind != tailsql.AuditQueryEnd || end.Rows != 10 || end.Bytes == 0 ||
+			!slices.Equal(end.Masked, []string{"location"}) || end.Error != "" {
+			t.Errorf("End event: got %+v", end)
+		}
+		last := hookEvents[len(hookEvents)-1]
+		if last.Kind != tailsql.AuditAuth || !last.Denied || last.Source != "secret" {
+			t.Errorf("Denied event: got %+v", last)
+		}
+
+		// The file log rotates, keeping the two most recent files, so it ends
+		// with the same events the webhook received.
+		var fileEvents []tailsql.AuditEvent
+		for _, path := range []string{logPath + ".2", logPath + ".1", logPath} {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Read audit log: %v", err)
+			} else if len(data) > 1500 {
+				t.Errorf("File %s has %d bytes, want at most 1500", path, len(data))
+			}
+			dec := json.NewDecoder(bytes.NewReader(data))
+			for dec.More() {
+				var e tailsql.AuditEvent
+				if err := dec.Decode(&e); err != nil {
+					t.Fatalf("Decode %s: %v", path, err)
+				}
+				fileEvents = append(fileEvents, e)
+			}
+		}
+		if len(fileEvents) == 0 || len(fileEvents) >= wantEvents {
+			t.Fatalf("File: got %d events, want some but not all of %d", len(fileEvents), wantEvents)
+		}
+		tail := hookEvents[len(hookEvents)-len(fileEvents):]
+		if diff := cmp.Diff(tail, fileEvents); diff != "" {
+			t.Errorf("File events (-want, +got):\n%s", diff)
+		}
+	})
+
+	t.Run("Slow", func(t *testing.T) {
+		// A sink that cannot keep up must not block queries. Instead, the
+		// events that overflow its buffer are discarded.
+		slow := &blockingSink{release: make(chan struct{})}
+		s := runQueries(t, tailsql.Options{
+			AuditSinks: []tailsql.AuditSink{slow},
+			Audit:      &tailsql.AuditConfig{Buffer: 4},
+		})
+
+		// Close waits for the buffered events to be delivered.
+		done := make(chan error)
+		go func() { done <- s.Close() }()
+		select {
+		case <-done:
+			t.Fatal("Close returned before the slow sink was released")
+		case <-time.After(100 * time.Millisecond):
+		}
+		close(slow.release)
+		if err := <-done; err != nil {
+			t.Errorf("Close: unexpected error: %v", err)
+		}
+
+		slow.mu.Lock()
+		defer slow.mu.Unlock()
+		if len(slow.events) == 0 || len(slow.events) >= wantEvents {
+			t.Errorf("Slow sink: got %d events, want some but not all of %d", len(slow.events), wantEvents)
+		}
+	})
+
+	t.Run("Sync", func(t *testing.T) {
+		// A synchronous sink has every event by the time the request ends,
+		// including those for queries refused before they were sent.
+		sink := &blockingSink{release: make(chan struct{})}
+		close(sink.release)
+		s := runQueries(t, tailsql.Options{
+			AuditSinks: []tailsql.AuditSink{tailsql.SyncAuditSink(sink)},
+			CheckQuery: querycheck.DenyStatements("delete"),
+		})
+		s.queryStatus(t, "main", "delete from users", http.StatusBadRequest)
+		s.queryStatus(t, "main", "attach 'x' as y", http.StatusBadRequest)
+		s.queryStatus(t, "nonesuch", "select 1", http.StatusBadRequest)
+
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		// Each rejection has an event, and the two that passed the query
+		// check also have an auth event.
+		if len(sink.events) != wantEvents+5 {
+			t.Fatalf("Sync sink: got %d events, want %d", len(sink.events), wantEvents+5)
+		}
+		var rejected []string
+		for _, e := range sink.events {
+			if e.Kind == tailsql.AuditQueryRejected {
+				if e.Error == "" || e.Caller != "user@example.com" {
+					t.Errorf("Rejected event: got %+v, want caller and error", e)
+				}
+				rejected = append(rejected, e.Source+": "+e.Query)
+			}
+		}
+		want := []string{"main: delete from users", "main: attach 'x' as y", "nonesuch: select 1"}
+		if diff := cmp.Diff(want, rejected); diff != "" {
+			t.Errorf("Rejected queries (-want, +got):\n%s", diff)
+		}
+	})
+}
+
+// Verify that context cancellation is correctly propagated.
+// This test is specific to SQLite, but the point is to make sure the context
+// plumbing in tailsql is correct.
+func TestQueryTimeout(t *testing.T) {
+	_, db := mustInitSQLite(t)
+
+	// This test query runs forever until interrupted.
+	const testQuery = `WITH RECURSIVE inf(n) AS (
+    SELECT 1
+    UNION ALL
+    SELECT n+1 FROM inf
+) SELECT * FROM inf WHERE n = 0`
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		rows, err := db.QueryContext(ctx, testQuery)
+		if err == nil {
+			t.Errorf("QueryContext: got rows=%v, want error", rows)
+		} else if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Got error %v, wanted %v", err, context.DeadlineExceeded)
+		}
+	}()
+
+	select {
+	case <-done:
+		// OK
+	case <-time.After(30 * time.Second):
+		t.Fatal("Timeout waiting for query to end")
+	}
+}
+
+func TestQueryable(t *testing.T) {
+	_, db := mustInitSQLite(t)
+
+	s, err := tailsql.NewServer(tailsql.Options{
+		Sources: []tailsql.DBSpec{{
+			Source: "quux",
+			Label:  "Happy fun database",
+			DB:     sqlDB{DB: db},
+
+			// Note: Omit Driver to exercise that this is allowed when a
+			// programmatic data source is given.
+		}},
+	})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+
+	htest := httptest.NewServer(s.NewMux())
+	defer htest.Close()
+	cli := htest.Client()
+
+	t.Run("Smoke", func(t *testing.T) {
+		const testProbe = "mindlesprocket"
+		q := url.Values{
+			"src": {"quux"},
+			"q":   {fmt.Sprintf(`select '%s'`, testProbe)},
+		}
+		rsp := string(mustGet(t, cli, htest.URL+"/csv?"+q.Encode()))
+		if !strings.Contains(rsp, testProbe) {
+			t.Errorf("Query failed: got %q, want %q", rsp, testProbe)
+		}
+	})
+}
+
+func TestReload(t *testing.T) {
+	url1, _ := mustInitSQLite(t)
+	url2, _ := mustInitSQLite(t)
+
+	s, err := tailsql.NewServer(tailsql.Options{
+		Sources: []tailsql.DBSpec{
+			{Source: "a", Label: "Alpha", Driver: "sqlite", URL: url1},
+			{Source: "b", Label: "Bravo", Driver: "sqlite", URL: url1},
+			{Source: "c", Label: "Charlie", Driver: "sqlite", URL: url1},
+		},
+		Logf: t.Logf,
+	})
+	if err != nil {
+		t.Fatalf("NewServer: unexpected error: %v", err)
+	}
+	defer s.Close()
+
+	// A source added programmatically is not affected by reloading.
+	_, db := mustInitSQLite(t)
+	s.SetDB("prog", db, &tailsql.DBOptions{Label: "Programmatic"})
+
+	htest := httptest.NewServer(s.NewMux())
+	defer htest.Close()
+	cli := htest.Client()
+
+	err = s.Reload(context.Background(), tailsql.Options{
+		Sources: []tailsql.DBSpec{
+			// Update the label and named queries of an existing source.
+			{Source: "a", Label: "Apple", Driver: "sqlite", URL: url1, Named: map[string]string{
+				"probe": "select 'a-probe'",
+			}},
+			// Remove source "b" (by omission).
+			// Change the URL of an existing source.
+			{Source: "c", Label: "Charlie", Driver: "sqlite", URL: url2},
+			// Add a new source.
+			{Source: "d", Label: "Delta", Driver: "sqlite", URL: url2},
+			// Add a source that cannot be opened.
+			{Source: "e", Label: "Echo", Driver: "nonesuch", URL: url2},
+		},
+		UILinks:      []tailsql.UILink{{Anchor: "new", URL: "http://new"}},
+		QueryTimeout: tailsql.Duration(5 * time.Second),
+		RowLimit:     25,
+	})
+	if err == nil {
+		t.Error("Reload: got nil, want error")
+	} else if !strings.Contains(err.Error(), `"e"`) {
+		t.Errorf("Reload: got error %v, want it to mention source e", err)
+	} else {
+		t.Logf("Reload: got expected error: %v", err)
+	}
+
+	t.Run("Meta", func(t *testing.T) {
+		var meta struct {
+			Meta tailsql.Options `json:"meta"`
+		}
+		if err := json.Unmarshal(mustGet(t, cli, htest.URL+"/meta"), &meta); err != nil {
+			t.Fatalf("Decode meta: %v", err)
+		}
+		var got []string
+		for _, src := range meta.Meta.Sources {
+			got = append(got, src.Source+"="+src.Label)
+		}
+		want := []string{"a=Apple", "c=Charlie", "prog=Programmatic", "d=Delta"}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Sources (-want, +got):\n%s", diff)
+		}
+		if got, want := meta.Meta.QueryTimeout.Duration(), 5*time.Second; got != want {
+			t.Errorf("Query timeout: got %v, want %v", got, want)
+		}
+		if got, want := meta.Meta.RowLimit, 25; got != want {
+			t.Errorf("Row limit: got %v, want %v", got, want)
+		}
+		if len(meta.Meta.UILinks) != 1 || meta.Meta.UILinks[0].Anchor != "new" {
+			t.Errorf("Links: got %+v, want one link", meta.Meta.UILinks)
+		}
+	})
+
+	t.Run("Query", func(t *testing.T) {
+		for _, src := range []string{"a", "c", "d", "prog"} {
+			q := url.Values{"src": {src}, "q": {"select count(*) n from users"}}
+			if got, want := string(mustGet(t, cli, htest.URL+"/csv?"+q.Encode())), "n\n10\n"; got != want {
+				t.Errorf("Query %q: got %q, want %q", src, got, want)
+			}
+		}
+		q := url.Values{"src": {"a"}, "q": {"named:probe"}}
+		if got := string(mustGet(t, cli, htest.URL+"/csv?"+q.Encode())); !strings.Contains(got, "a-probe") {
+			t.Errorf("Named query: got %q, want a-probe", got)
+		}
+
+		q = url.Values{"src": {"b"}, "q": {"select 1"}}
+		mustGetFail(t, cli, htest.URL+"/csv?"+q.Encode(), http.StatusBadRequest, "sec-tailsql", "1")
+	})
+}
+
+func TestReloadAccess(t *testing.T) {
+	dbURL, _ := mustInitSQLite(t)
+	sources := []tailsql.DBSpec{
+		{Source: "main", Driver: "sqlite", URL: dbURL},
+		{Source: "hr", Driver: "sqlite", URL: dbURL},
+	}
+	s := newTestServer(t, tailsql.Options{
+		Sources: sources,
+		Access: &authorizer.Policy{
+			Rules:   []authorizer.PolicyRule{{Sources: []string{"hr"}, Allow: []string{"*@example.com"}}},
+			Default: "allow",
+		},
+	})
+	s.queryStatus(t, "main", "select 1", http.StatusOK)
+	s.queryStatus(t, "hr", "select 1", http.StatusOK)
+
+	// Reloading a tighter policy takes effect for new requests.
+	if err := s.Reload(context.Background(), tailsql.Options{
+		Sources: sources,
+		Access: &authorizer.Policy{
+			Rules: []authorizer.PolicyRule{{Sources: []string{"hr"}, Allow: []string{"admin@example.com"}}},
+		},
+	}); err != nil {
+		t.Fatalf("Reload: unexpected error: %v", err)
+	}
+	s.queryStatus(t, "main", "select 1", http.StatusForbidden)
+	s.queryStatus(t, "hr", "select 1", http.StatusForbidden)
+
+	// An invalid policy is reported, and the previous policy is kept.
+	err := s.Reload(context.Background(), tailsql.Options{
+		Sources: sources,
+		Access:  &authorizer.Policy{Rules: []authorizer.PolicyRule{{Sources: []string{"main"}}}, Default: "allow"},
+	})
+	if err == nil {
+		t.Error("Reload: got nil, want error for invalid policy")
+	}
+	s.queryStatus(t, "main", "select 1", http.StatusForbidden)
+
+	// NewServer also rejects an invalid policy.
+	if _, err := tailsql.NewServer(tailsql.Options{
+		Access: &authorizer.Policy{Default: "maybe"},
+	}); err == nil {
+		t.Error("NewServer: got nil, want error for invalid policy")
+	}
+}
+
+func TestQueryCheck(t *testing.T) {
+	dbURL, _ := mustInitSQLite(t)
+
+	var seen []tailsql.Query
+	s, err := tailsql.NewServer(tailsql.Options{
+		Sources: []tailsql.DBSpec{
+			{Source: "main", Driver: "sqlite", URL: dbURL},
+			{Source: "hr", Driver: "sqlite", URL: dbURL, Named: map[string]string{
+				"count": "select count(*) n from users",
+			}},
+		},
+		CheckQuery: querycheck.All(
+			func(q tailsql.Query) (tailsql.Query, error) {
+				seen = append(seen, q)
+				return q, nil
+			},
+			querycheck.DangerousFunctions(),
+			querycheck.ForSources(querycheck.NamedOnly(), "hr"),
+		),
+		Logf: t.Logf,
+	})
+	if err != nil {
+		t.Fatalf("NewServer: unexpected error: %v", err)
+	}
+	defer s.Close()
+
+	htest := httptest.NewServer(s.NewMux())
+	defer htest.Close()
+	cli := htest.Client()
+
+	query := func(src, text string) string {
+		return htest.URL + "/csv?" + url.Values{"src": {src}, "q": {text}}.Encode()
+	}
+
+	// A query without a source is checked against the default source.
+	mustGet(t, cli, query("", "select 1"))
+	want := tailsql.Query{Source: "main", Driver: "sqlite", Query: "select 1"}
+	if len(seen) != 1 || seen[0] != want {
+		t.Errorf("Checked queries: got %+v, want [%+v]", seen, want)
+	}
+
+	mustGetFail(t, cli, query("main", "select load_extension('x')"), http.StatusBadRequest, "sec-tailsql", "1")
+	mustGetFail(t, cli, query("hr", "select * from users"), http.StatusBadRequest, "sec-tailsql", "1")
+	if got := string(mustGet(t, cli, query("hr", "named:count"))); got != "n\n10\n" {
+		t.Errorf("Named query: got %q, want 10 rows", got)
+	}
+
+	// Reloading replaces the query check.
+	if err := s.Reload(context.Background(), tailsql.Options{
+		Sources: []tailsql.DBSpec{
+			{Source: "main", Driver: "sqlite", URL: dbURL},
+			{Source: "hr", Driver: "sqlite", URL: dbURL},
+		},
+		CheckQuery: querycheck.NamedOnly(),
+	}); err != nil {
+		t.Fatalf("Reload: unexpected error: %v", err)
+	}
+	mustGetFail(t, cli, query("main", "select 1"), http.StatusBadRequest, "sec-tailsql", "1")
+}
+
+func TestLimitPushdown(t *testing.T) {
+	dbURL, db := mustInitSQLite(t)
+
+	s, err := tailsql.NewServer(tailsql.Options{
+		Sources: []tailsql.DBSpec{
+			{Source: "main", Driver: "sqlite", URL: dbURL},
+			{Source: "raw", Driver: "sqlite", URL: dbURL, NoLimitPushdown: true},
+		},
+		RowLimit: 3,
+		Logf:     t.Logf,
+	})
+	if err != nil {
+		t.Fatalf("NewServer: unexpected error: %v", err)
+	}
+	defer s.Close()
+	s.SetDB("prog", db, nil) // dialect unknown, so no push-down
+
+	htest := httptest.NewServer(s.NewMux())
+	defer htest.Close()
+	cli := htest.Client()
+
+	t.Run("Meta", func(t *testing.T) {
+		var meta struct {
+			LimitPushdown map[string]int `json:"limitPushdown"`
+		}
+		if err := json.Unmarshal(mustGet(t, cli, htest.URL+"/meta"), &meta); err != nil {
+			t.Fatalf("Decode meta: %v", err)
+		}
+		if diff := cmp.Diff(map[string]int{"main": 4}, meta.LimitPushdown); diff != "" {
+			t.Errorf("Limit push-down (-want, +got):\n%s", diff)
+		}
+	})
+
+	t.Run("UI", func(t *testing.T) {
+		tests := []struct {
+			src, query string
+			added      bool
+		}{
+			{"main", "select name from users", true},
+			{"main", "select name from users limit 2", false},
+			{"main", "select u.name, v.name from users u join users v using (name) order by u.name", true},
+			{"raw", "select name from users", false},
+			{"prog", "select name from users", false},
+		}
+		for _, tc := range tests {
+			q := url.Values{"src": {tc.src}, "q": {tc.query}}
+			got := string(mustGet(t, cli, htest.URL+"/?"+q.Encode()))
+			if added := strings.Contains(got, "LIMIT 4 added to query"); added != tc.added {
+				t.Errorf("Query %s %q: limit added is %v, want %v", tc.src, tc.query, added, tc.added)
+			}
+		}
+	})
+
+	t.Run("Rows", func(t *testing.T) {
+		// The server reports only the row limit, with or without push-down.
+		for _, src := range []string{"main", "raw"} {
+			q := url.Values{"src": {src}, "q": {"select rowid from users order by rowid"}}
+			if got, want := string(mustGet(t, cli, htest.URL+"/csv?"+q.Encode())), "rowid\n1\n2\n3\n"; got != want {
+				t.Errorf("Query %q: got %q, want %q", src, got, want)
+			}
+		}
+	})
+}
+
+func TestUnavailableSource(t *testing.T) {
+	dbURL, _ := mustInitSQLite(t)
+	keyFile := filepath.Join(t.TempDir(), "late.key") // not created yet
+
+	opts := tailsql.Options{
+		Sources: []tailsql.DBSpec{
+			{Source: "main", Label: "Main", Driver: "sqlite", URL: dbURL},
+			{Source: "late", Label: "Late", Driver: "sqlite", KeyFile: keyFile},
+		},
+		HealthCheckInterval: tailsql.Duration(10 * time.Millisecond),
+		Logf:                t.Logf,
+	}
+	if s, err := tailsql.NewServer(opts); err == nil {
+		s.Close()
+		t.Fatal("NewServer: got nil, want error for unavailable source")
+	}
+
+	opts.AllowUnavailable = true
+	s, err := tailsql.NewServer(opts)
+	if err != nil {
+		t.Fatalf("NewServer: unexpected error: %v", err)
+	}
+	defer s.Close()
+
+	htest := httptest.NewServer(s.NewMux())
+	defer htest.Close()
+	cli := htest.Client()
+
+	type healthz struct {
+		Status  tailsql.HealthStatus `json:"status"`
+		Sources []struct {
+			Source string               `json:"source"`
+			Status tailsql.HealthStatus `json:"status"`
+		} `json:"sources"`
+	}
+	getHealth := func() (h healthz) {
+		t.Helper()
+		rsp, err := cli.Get(htest.URL + "/healthz")
+		if err != nil {
+			t.Fatalf("Get healthz: %v", err)
+		}
+		defer rsp.Body.Close()
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatalf("Get healthz: got status %d, want %d", rsp.StatusCode, http.StatusOK)
+		}
+		if err := json.NewDecoder(rsp.Body).Decode(&h); err != nil {
+			t.Fatalf("Decode healthz: %v", err)
+		}
+		return h
+	}
+	sourceStatus := func(h healthz, src string) tailsql.HealthStatus {
+		for _, s := range h.Sources {
+			if s.Source == src {
+				return s.Status
+			}
+		}
+		return ""
+	}
+
+	t.Run("Down", func(t *testing.T) {
+		h := getHealth()
+		if h.Status != tailsql.HealthDegraded {
+			t.Errorf("Server status: got %q, want %q", h.Status, tailsql.HealthDegraded)
+		}
+		if got := sourceStatus(h, "late"); got != tailsql.HealthDown {
+			t.Errorf("Source late: got %q, want %q", got, tailsql.HealthDown)
+		}
+
+		q := url.Values{"src": {"late"}, "q": {"select 1"}}
+		mustGetFail(t, cli, htest.URL+"/csv?"+q.Encode(), http.StatusServiceUnavailable, "sec-tailsql", "1")
+
+		ui := string(mustGet(t, cli, htest.URL))
+		if want := "Late (down)"; !strings.Contains(ui, want) {
+			t.Errorf("Missing UI substring %q", want)
+		}
+	})
+
+	t.Run("Healthy", func(t *testing.T) {
+		for sourceStatus(getHealth(), "main") != tailsql.HealthOK {
+			time.Sleep(5 * time.Millisecond)
+		}
+		var meta struct {
+			Health []tailsql.SourceHealth `json:"health"`
+		}
+		if err := json.Unmarshal(mustGet(t, cli, htest.URL+"/meta"), &meta); err != nil {
+			t.Fatalf("Decode meta: %v", err)
+		}
+		if len(meta.Health) != 2 {
+			t.Fatalf("Meta health: got %+v, want 2 sources", meta.Health)
+		}
+		if h := meta.Health[1]; h.Status != tailsql.HealthDown || h.LastError == "" {
+			t.Errorf("Meta health for late: got %+v, want down with an error", h)
+		}
+	})
+
+	t.Run("Reconnect", func(t *testing.T) {
+		if err := os.WriteFile(keyFile, []byte(dbURL), 0600); err != nil {
+			t.Fatalf("Write key file: %v", err)
+		}
+		deadline := time.Now().Add(30 * time.Second)
+		for sourceStatus(getHealth(), "late") == tailsql.HealthDown {
+			if time.Now().After(deadline) {
+				t.Fatal("Timed out waiting for source to reconnect")
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		q := url.Values{"src": {"late"}, "q": {"select count(*) n from users"}}
+		if got, want := string(mustGet(t, cli, htest.URL+"/csv?"+q.Encode())), "n\n10\n"; got != want {
+			t.Errorf("Query: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("AllDown", func(t *testing.T) {
+		s, err := tailsql.NewServer(tailsql.Options{
+			Sources: []tailsql.DBSpec{
+				{Source: "nope", Driver: "sqlite", KeyFile: filepath.Join(t.TempDir(), "nonesuch")},
+			},
+			AllowUnavailable: true,
+			Logf:             t.Logf,
+		})
+		if err != nil {
+			t.Fatalf("NewServer: unexpected error: %v", err)
+		}
+		defer s.Close()
+		hs := httptest.NewServer(s.NewMux())
+		defer hs.Close()
+		mustGet(t, hs.Client(), hs.URL+"/healthz")
+		mustGetFail(t, hs.Client(), hs.URL+"/readyz", http.StatusServiceUnavailable)
+	})
+}
+
+func TestReadiness(t *testing.T) {
+	dbURL, _ := mustInitSQLite(t)
+	keyFile := filepath.Join(t.TempDir(), "late.key")
+	statePath := filepath.Join(t.TempDir(), "state.db")
+	s, err := tailsql.NewServer(tailsql.Options{
+		Sources: []tailsql.DBSpec{
+			{Source: "main", Driver: "sqlite", URL: dbURL},
+			{Source: "late", Driver: "sqlite", KeyFile: keyFile},
+		},
+		LocalState:       statePath,
+		AllowUnavailable: true,
+		Logf:             t.Logf,
+	})
+	if err != nil {
+		t.Fatalf("NewServer: unexpected error: %v", err)
+	}
+	defer s.Close()
+
+	htest := httptest.NewServer(s.NewMux())
+	defer htest.Close()
+	cli := htest.Client()
+
+	type readyz struct {
+		Ready   bool `json:"ready"`
+		Sources []struct {
+			Source string               `json:"source"`
+			Status tailsql.HealthStatus `json:"status"`
+		} `json:"sources"`
+		LocalState tailsql.HealthStatus `json:"localState"`
+	}
+	getReady := func(path string) (int, readyz, string) {
+		t.Helper()
+		rsp, err := cli.Get(htest.URL + path)
+		if err != nil {
+			t.Fatalf("Get %s: %v", path, err)
+		}
+		defer rsp.Body.Close()
+		body, _ := io.ReadAll(rsp.Body)
+		var rd readyz
+		if err := json.Unmarshal(body, &rd); err != nil {
+			t.Fatalf("Decode %s: %v", path, err)
+		}
+		return rsp.StatusCode, rd, string(body)
+	}
+
+	t.Run("NotReady", func(t *testing.T) {
+		mustGet(t, cli, htest.URL+"/healthz")
+		code, rd, body := getReady("/readyz")
+		if code != http.StatusServiceUnavailable || rd.Ready {
+			t.Errorf("Readyz: got %d %+v, want 503 not ready", code, rd)
+		}
+		if rd.LocalState != tailsql.HealthOK {
+			t.Errorf("Local state: got %q, want %q", rd.LocalState, tailsql.HealthOK)
+		}
+		if strings.Contains(body, keyFile) || strings.Contains(body, "no such file") {
+			t.Errorf("Readyz leaks error details: %s", body)
+		}
+		if err := s.Ready(context.Background()); err == nil {
+			t.Error("Ready: got nil, want error")
+		} else if !strings.Contains(err.Error(), `source "late" is down`) {
+			t.Errorf("Ready: got %v, want late to be down", err)
+		}
+	})
+
+	t.Run("Ready", func(t *testing.T) {
+		if err := os.WriteFile(keyFile, []byte(dbURL), 0600); err != nil {
+			t.Fatalf("Write key file: %v", err)
+		}
+		deadline := time.Now().Add(30 * time.Second)
+		for s.Ready(context.Background()) != nil {
+			if time.Now().After(deadline) {
+				t.Fatal("Timed out waiting for readiness")
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		code, rd, _ := getReady("/readyz?ping=1")
+		if code != http.StatusOK || !rd.Ready {
+			t.Errorf("Readyz: got %d %+v, want 200 ready", code, rd)
+		}
+		for _, src := range rd.Sources {
+			if src.Status != tailsql.HealthOK {
+				t.Errorf("Source %q: got %q after ping, want %q", src.Source, src.Status, tailsql.HealthOK)
+			}
+		}
+	})
+
+	t.Run("PingReused", func(t *testing.T) {
+		db, err := sql.Open("sqlite", dbURL)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		pdb := &pingCounter{sqlDB: sqlDB{db}}
+		s.SetSource("counted", pdb, nil)
+		defer s.RemoveSource("counted")
+
+		// A ping of a source checked in the last few seconds reuses the
+		// result of that check.
+		for range 5 {
+			if code, rd, _ := getReady("/readyz?ping=1"); code != http.StatusOK || !rd.Ready {
+				t.Errorf("Readyz: got %d %+v, want 200 ready", code, rd)
+			}
+		}
+		if got := pdb.pings.Load(); got != 1 {
+			t.Errorf("Pings: got %d, want 1", got)
+		}
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		s.Close()
+		mustGetFail(t, cli, htest.URL+"/healthz", http.StatusServiceUnavailable)
+		mustGetFail(t, cli, htest.URL+"/readyz", http.StatusServiceUnavailable)
+	})
+}
+
+func TestPoolOptions(t *testing.T) {
+	dbURL, _ := mustInitSQLite(t)
+	m := new(expvar.Map)
+	s, err := tailsql.NewServer(tailsql.Options{
+		Sources: []tailsql.DBSpec{{
+			Source: "main",
+			Driver: "sqlite",
+			URL:    dbURL,
+			PoolOptions: tailsql.PoolOptions{
+				MaxOpenConns:    3,
+				ConnMaxLifetime: tailsql.Duration(time.Minute),
+			},
+		}},
+		Metrics: m,
+		Logf:    t.Logf,
+	})
+	if err != nil {
+		t.Fatalf("NewServer: unexpected error: %v", err)
+	}
+	defer s.Close()
+
+	_, db := mustInitSQLite(t)
+	s.SetDB("other", db, &tailsql.DBOptions{
+		PoolOptions: tailsql.PoolOptions{MaxOpenConns: 5},
+	})
+
+	var stats map[string]sql.DBStats
+	if err := json.Unmarshal([]byte(m.Get("db_pool_stats").String()), &stats); err != nil {
+		t.Fatalf("Decode pool stats: %v", err)
+	}
+	for src, want := range map[string]int{"main": 3, "other": 5} {
+		if got := stats[src].MaxOpenConnections; got != want {
+			t.Errorf("Source %q: got max open %d, want %d", src, got, want)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	const loopQuery = `WITH RECURSIVE inf(n) AS (SELECT 1 UNION ALL SELECT n+1 FROM inf) SELECT * FROM inf WHERE n = 0`
+
+	newServer := func(m *expvar.Map) *testServer {
+		s := newTestServer(t, tailsql.Options{
+			Authorize: func(src string, _ *apitype.WhoIsResponse) error {
+				if src == "secret" {
+					return errors.New("authorization denied")
+				}
+				return nil
+			},
+			RowLimit:     5,
+			QueryTimeout: tailsql.Duration(100 * time.Millisecond),
+			Metrics:      m,
+		})
+		_, db := mustInitSQLite(t)
+		s.SetDB("main", db, nil)
+		s.SetDB("secret", db, nil)
+		return s
+	}
+
+	m1, m2 := new(expvar.Map), new(expvar.Map)
+	s1 := newServer(m1)
+	newServer(m2) // separate metrics; not queried
+
+	s1.queryStatus(t, "main", "select name from users limit 3", http.StatusOK)
+	s1.queryStatus(t, "main", "select name from users", http.StatusOK) // truncated
+	s1.queryStatus(t, "main", "select * from nonesuch", http.StatusInternalServerError)
+	s1.queryStatus(t, "main", loopQuery, http.StatusInternalServerError) // timeout
+	s1.queryStatus(t, "secret", "select 1", http.StatusForbidden)
+
+	labelValue := func(m *expvar.Map, name, label string) string {
+		t.Helper()
+		v := m.Get(name)
+		if v == nil {
+			return "<missing>"
+		}
+		var vals map[string]any
+		if err := json.Unmarshal([]byte(v.String()), &vals); err != nil {
+			t.Fatalf("Decode %s: %v", name, err)
+		}
+		return fmt.Sprint(vals[label])
+	}
+	tests := []struct {
+		name, label, want string
+	}{
+		{"counter_api_request", "csv", "4"}, // the denied request is not counted
+		{"counter_api_error", "auth", "1"},
+		{"counter_query", "main", "4"},
+		{"counter_query_error", "main", "2"},
+		{"counter_query_timeout", "main", "1"},
+		{"counter_query_truncated", "main", "1"},
+		{"counter_query_rows", "main", "8"},
+		{"counter_auth_denied", "secret", "1"},
+	}
+	for _, tc := range tests {
+		if got := labelValue(m1, tc.name, tc.label); got != tc.want {
+			t.Errorf("Server 1 %s{%s}: got %s, want %s", tc.name, tc.label, got, tc.want)
+		}
+		if got := labelValue(m2, tc.name, tc.label); got != "<nil>" {
+			t.Errorf("Server 2 %s{%s}: got %s, want <nil>", tc.name, tc.label, got)
+		}
+	}
+	if got := m1.Get("gauge_query_inflight").String(); got != "0" {
+		t.Errorf("In-flight gauge: got %s, want 0", got)
+	}
+
+	hist, ok := m1.Get("query_duration_seconds").(interface{ WritePrometheus(io.Writer, string) })
+	if !ok {
+		t.Fatal("Duration histogram does not implement WritePrometheus")
+	}
+	var buf bytes.Buffer
+	hist.WritePrometheus(&buf, "tailsql_query_duration_seconds")
+	for _, want := range []string{
+		"# TYPE tailsql_query_duration_seconds histogram\n",
+		`tailsql_query_duration_seconds_bucket{source="main",le="+Inf"} 4` + "\n",
+		`tailsql_query_duration_seconds_count{source="main"} 4` + "\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Histogram output missing %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestWatchSource(t *testing.T) {
+	url1, _ := mustInitSQLite(t)
+	url2, db2 := mustInitSQLite(t)
+	if _, err := db2.Exec(`delete from users where rowid > 4`); err != nil {
+		t.Fatalf("Update database: %v", err)
+	}
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "db.key")
+	if err := os.WriteFile(keyFile, []byte(url1), 0600); err != nil {
+		t.Fatalf("Write key file: %v", err)
+	}
+
+	// A SQLite database file that will be replaced by a snapshot.
+	snapPath := filepath.Join(dir, "snap.db")
+	mustWriteDB := func(path, init string) {
+		t.Helper()
+		db, err := sql.Open("sqlite", "file:"+path)
+		if err != nil {
+			t.Fatalf("Open %q: %v", path, err)
+		}
+		defer db.Close()
+		if _, err := db.Exec(init); err != nil {
+			t.Fatalf("Initialize %q: %v", path, err)
+		}
+	}
+	mustWriteDB(snapPath, `create table t (v text); insert into t values ('old')`)
+
+	const interval = tailsql.Duration(5 * time.Millisecond)
+	s, err := tailsql.NewServer(tailsql.Options{
+		Sources: []tailsql.DBSpec{
+			{Source: "key", Driver: "sqlite", KeyFile: keyFile, WatchInterval: interval},
+			{Source: "snap", Driver: "sqlite", URL: "file:" + snapPath, WatchInterval: interval},
+		},
+		Logf: t.Logf,
+	})
+	if err != nil {
+		t.Fatalf("NewServer: unexpected error: %v", err)
+	}
+	defer s.Close()
+
+	htest := httptest.NewServer(s.NewMux())
+	defer htest.Close()
+	cli := htest.Client()
+
+	query := func(src, text string) string {
+		t.Helper()
+		q := url.Values{"src": {src}, "q": {text}}
+		return string(mustGet(t, cli, htest.URL+"/csv?"+q.Encode()))
+	}
+	waitFor := func(src, text, want string) {
+		t.Helper()
+		deadline := time.Now().Add(30 * time.Second)
+		for {
+			got := query(src, text)
+			if got == want {
+				return
+			} else if time.Now().After(deadline) {
+				t.Fatalf("Query %q: got %q, want %q", src, got, want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	t.Run("KeyFile", func(t *testing.T) {
+		const countUsers = `select count(*) n from users`
+		if got, want := query("key", countUsers), "n\n10\n"; got != want {
+			t.Fatalf("Query: got %q, want %q", got, want)
+		}
+		if err := os.WriteFile(keyFile, []byte(url2), 0600); err != nil {
+			t.Fatalf("Write key file: %v", err)
+		}
+		waitFor("key", countUsers, "n\n4\n")
+	})
+
+	t.Run("Snapshot", func(t *testing.T) {
+		const getValue = `select v from t`
+		if got, want := query("snap", getValue), "v\nold\n"; got != want {
+			t.Fatalf("Query: got %q, want %q", got, want)
+		}
+		tmpPath := filepath.Join(dir, "snap.db.tmp")
+		mustWriteDB(tmpPath, `create table t (v text); insert into t values ('new')`)
+		if err := os.Rename(tmpPath, snapPath); err != nil {
+			t.Fatalf("Replace snapshot: %v", err)
+		}
+		waitFor("snap", getValue, "v\nnew\n")
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := tailsql.NewServer(tailsql.Options{
+			Sources: []tailsql.DBSpec{{
+				Source: "bad", Driver: "sqlite", URL: "file::memory:", WatchInterval: interval,
+			}},
+		})
+		if err == nil {
+			t.Error("NewServer: got nil, want error for unwatchable source")
+		}
+	})
+}
+
+// blockingDB is a Queryable that waits for a signal before running queries,
+// and records when it has been closed.
+type blockingDB struct {
+	sqlDB
+	started chan struct{}
+	release chan struct{}
+	closed  atomic.Bool
+}
+
+func (b *blockingDB) Query(ctx context.Context, query string, params ...any) (tailsql.RowSet, error) {
+	close(b.started)
+	<-b.release
+	return b.sqlDB.Query(ctx, query, params...)
+}
+
+func (b *blockingDB) Close() error { b.closed.Store(true); return nil }
+
+func TestRemoveSource(t *testing.T) {
+	_, db := mustInitSQLite(t)
+
+	s, err := tailsql.NewServer(tailsql.Options{Logf: t.Logf})
+	if err != nil {
+		t.Fatalf("NewServer: unexpected error: %v", err)
+	}
+	defer s.Close()
+
+	bdb := &blockingDB{
+		sqlDB:   sqlDB{DB: db},
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	s.SetSource("shard1", bdb, &tailsql.DBOptions{Label: "Shard 1"})
+	s.SetDB("shard2", db, &tailsql.DBOptions{Label: "Shard 2"})
+
+	sources := func() (out []string) {
+		for _, src := range s.Sources() {
+			out = append(out, src.Source)
+		}
+		return
+	}
+	if diff := cmp.Diff([]string{"shard1", "shard2"}, sources()); diff != "" {
+		t.Errorf("Sources (-want, +got):\n%s", diff)
+	}
+
+	htest := httptest.NewServer(s.NewMux())
+	defer htest.Close()
+	cli := htest.Client()
+	query := func(src string) int {
+		q := url.Values{"src": {src}, "q": {"select count(*) from users"}}
+		rsp, err := cli.Do(mustGetRequest(t, htest.URL+"/csv?"+q.Encode(), "sec-tailsql", "1"))
+		if err != nil {
+			t.Errorf("Query %q: %v", src, err)
+			return 0
+		}
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+
+	// Start a query on shard1, and wait for it to reach the database.
+	qdone := make(chan int, 1)
+	go func() { qdone <- query("shard1") }()
+	<-bdb.started
+
+	// Removing the source takes it out of service immediately, but does not
+	// close the database while the query is in flight.
+	rdone := make(chan bool, 1)
+	go func() { rdone <- s.RemoveSource("shard1") }()
+	for slices.Contains(sources(), "shard1") {
+		time.Sleep(time.Millisecond)
+	}
+	if got, want := query("shard1"), http.StatusBadRequest; got != want {
+		t.Errorf("Query removed source: got %d, want %d", got, want)
+	}
+	select {
+	case <-rdone:
+		t.Error("RemoveSource returned while a query was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if bdb.closed.Load() {
+		t.Error("Database closed while a query was in flight")
+	}
+
+	// Once the query finishes, the database should be closed.
+	close(bdb.release)
+	if got, want := <-qdone, http.StatusOK; got != want {
+		t.Errorf("In-flight query: got %d, want %d", got, want)
+	}
+	if !<-rdone {
+		t.Error("RemoveSource(shard1) reported false, want true")
+	}
+	if !bdb.closed.Load() {
+		t.Error("Database was not closed after removal")
+	}
+
+	if s.RemoveSource("shard1") {
+		t.Error("RemoveSource(shard1) again reported true, want false")
+	}
+	if diff := cmp.Diff([]string{"shard2"}, sources()); diff != "" {
+		t.Errorf("Sources (-want, +got):\n%s", diff)
+	}
+	if got, want := query("shard2"), http.StatusOK; got != want {
+		t.Errorf("Query shard2: got %d, want %d", got, want)
+	}
+}
+
+type sqlDB struct{ *sql.DB }
+
+func (s sqlDB) Query(ctx context.Context, query string, params ...any) (tailsql.RowSet, error) {
+	return s.DB.QueryContext(ctx, query, params...)
+}
+
+// pingCounter is a database that counts the pings it receives.
+type pingCounter struct {
+	sqlDB
+	pings atomic.Int32
+}
+
+func (p *pingCounter) PingContext(ctx context.Context) error {
+	p.pings.Add(1)
+	return p.sqlDB.PingContext(ctx)
+}
+
+type hookKey struct{}
+
+// fakeHooks records the calls to its methods, and adds a value to the context
+// of each request.
+type fakeHooks struct {
+	tailsql.BaseHooks
+
+	mu     sync.Mutex
+	events []string
+}
+
+func (f *fakeHooks) record(format string, args ...any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeHooks) take() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := f.events
+	f.events = nil
+	return out
+}
+
+func (f *fakeHooks) RequestReceived(ctx context.Context, r *http.Request) context.Context {
+	f.record("received %s", r.URL.Path)
+	return context.WithValue(ctx, hookKey{}, "trace-1")
+}
+
+func (f *fakeHooks) Authorized(ctx context.Context, caller string, q tailsql.Query, allowed bool) context.Context {
+	f.record("authorized %s %s %v", caller, q.Source, allowed)
+	return ctx
+}
+
+func (f *fakeHooks) QueryStarted(ctx context.Context, caller string, q tailsql.Query) context.Context {
+	f.record("started %s %v", q.Source, ctx.Value(hookKey{}))
+	return ctx
+}
+
+func (f *fakeHooks) RowsStreamed(ctx context.Context, q tailsql.Query, rows int) {
+	f.record("rows %s %d", q.Source, rows)
+}
+
+func (f *fakeHooks) QueryFinished(ctx context.Context, q tailsql.Query, stats tailsql.QueryStats, err error) {
+	f.record("finished %s rows=%d more=%v err=%v", q.Source, stats.Rows, stats.More, err != nil)
+}
+
+// contextDB is a Queryable that records a context value from each query.
+type contextDB struct {
+	sqlDB
+	got atomic.Value
+}
+
+func (c *contextDB) Query(ctx context.Context, query string, params ...any) (tailsql.RowSet, error) {
+	c.got.Store(fmt.Sprint(ctx.Value(hookKey{})))
+	return c.sqlDB.Query(ctx, query, params...)
+}
+
+func TestHooks(t *testing.T) {
+	_, db := mustInitSQLite(t)
+	hooks := new(fakeHooks)
+	s := newTestServer(t, tailsql.Options{
+		Authorize: func(src string, _ *apitype.WhoIsResponse) error {
+			if src == "secret" {
+				return errors.New("authorization denied")
+			}
+			return nil
+		},
+		RowLimit: 2000,
+		Hooks:    hooks,
+	})
+	cdb := &contextDB{sqlDB: sqlDB{db}}
+	s.SetSource("main", cdb, nil)
+	s.SetDB("secret", db, nil)
+
+	const countQuery = `WITH RECURSIVE c(n) AS (SELECT 1 UNION ALL SELECT n+1 FROM c WHERE n < %d) SELECT n FROM c`
+
+	t.Run("Query", func(t *testing.T) {
+		s.queryStatus(t, "main", fmt.Sprintf(countQuery, 1500), http.StatusOK)
+		want := []string{
+			"received /csv",
+			"authorized user@example.com main true",
+			"started main trace-1",
+			"rows main 1000",
+			"rows main 1500",
+			"finished main rows=1500 more=false err=false",
+		}
+		if diff := cmp.Diff(want, hooks.take()); diff != "" {
+			t.Errorf("Events (-want, +got):\n%s", diff)
+		}
+		if got := cdb.got.Load(); got != "trace-1" {
+			t.Errorf("Context value in Query: got %v, want trace-1", got)
+		}
+	})
+
+	t.Run("TooManyRows", func(t *testing.T) {
+		s.queryStatus(t, "main", fmt.Sprintf(countQuery, 3000), http.StatusOK)
+		got := hooks.take()
+		if n := len(got); n == 0 || got[n-1] != "finished main rows=2000 more=true err=true" {
+			t.Errorf("Events: got %q", got)
+		}
+	})
+
+	t.Run("QueryError", func(t *testing.T) {
+		s.queryStatus(t, "main", "select * from nonesuch", http.StatusInternalServerError)
+		want := []string{
+			"received /csv",
+			"authorized user@example.com main true",
+			"started main trace-1",
+			"finished main rows=0 more=false err=true",
+		}
+		if diff := cmp.Diff(want, hooks.take()); diff != "" {
+			t.Errorf("Events (-want, +got):\n%s", diff)
+		}
+	})
+
+	t.Run("Denied", func(t *testing.T) {
+		s.queryStatus(t, "secret", "select 1", http.StatusForbidden)
+		want := []string{
+			"received /csv",
+			"authorized user@example.com secret false",
+		}
+		if diff := cmp.Diff(want, hooks.take()); diff != "" {
+			t.Errorf("Events (-want, +got):\n%s", diff)
+		}
+	})
+}
+
+// logRecords is an io.Writer that collects the records written by a JSON
+// slog handler.
+type logRecords struct {
+	mu   sync.Mutex
+	recs []map[string]any
+}
+
+func (l *logRecords) Write(p []byte) (int, error) {
+	var rec map[string]any
+	if err := json.Unmarshal(p, &rec); err != nil {
+		return 0, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.recs = append(l.recs, rec)
+	return len(p), nil
+}
+
+// find returns the first record with the given message and request ID.
+func (l *logRecords) find(msg, id string) map[string]any {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, rec := range l.recs {
+		if rec["msg"] == msg && rec["request_id"] == id {
+			return rec
+		}
+	}
+	return nil
+}
+
+func TestLogger(t *testing.T) {
+	_, db := mustInitSQLite(t)
+	logs := new(logRecords)
+	s := newTestServer(t, tailsql.Options{
+		Logger: slog.New(slog.NewJSONHandler(logs, nil)),
+	})
+	s.SetDB("main", db, nil)
+
+	get := func(query string) (*http.Response, string) {
+		t.Helper()
+		req := mustGetRequest(t, s.csvURL("main", query), "sec-tailsql", "1")
+		rsp, err := s.cli.Do(req)
+		if err != nil {
+			t.Fatalf("Get: unexpected error: %v", err)
+		}
+		defer rsp.Body.Close()
+		body, _ := io.ReadAll(rsp.Body)
+		return rsp, string(body)
+	}
+
+	t.Run("Query", func(t *testing.T) {
+		const query = `select name from users where location is not null`
+		rsp, _ := get(query)
+		id := rsp.Header.Get("X-Request-Id")
+		if id == "" {
+			t.Fatal("Response has no request ID")
+		}
+		rec := logs.find("query", id)
+		if rec == nil {
+			t.Fatalf("No query log for request %q", id)
+		}
+		for key, want := range map[string]any{
+			"caller": "user@example.com",
+			"source": "main",
+			"query":  query,
+			"rows":   float64(9),
+		} {
+			if got := rec[key]; got != want {
+				t.Errorf("Log %q: got %v, want %v", key, got, want)
+			}
+		}
+		if h, ok := rec["query_hash"].(string); !ok || h == "" {
+			t.Errorf("Log query_hash: got %v, want non-empty", rec["query_hash"])
+		}
+		if _, ok := rec["elapsed"]; !ok {
+			t.Error("Log elapsed: missing")
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		rsp, body := get(`select * from nonesuch`)
+		if rsp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("Status: got %d, want %d", rsp.StatusCode, http.StatusInternalServerError)
+		}
+		id := rsp.Header.Get("X-Request-Id")
+		if want := "(request ID " + id + ")"; id == "" || !strings.Contains(body, want) {
+			t.Errorf("Error response: got %q, want %q", body, want)
+		}
+		rec := logs.find("query", id)
+		if rec == nil {
+			t.Fatalf("No query log for request %q", id)
+		}
+		if e, ok := rec["error"].(string); !ok || !strings.Contains(e, "nonesuch") {
+			t.Errorf("Log error: got %v, want no such table", rec["error"])
+		}
+	})
+}
+
+// callerDB is a Queryable that records the caller information from the
+// context of each query.
+type callerDB struct {
+	sqlDB
+
+	mu     sync.Mutex
+	caller []tailsql.CallerInfo
+}
+
+func (c *callerDB) Query(ctx context.Context, query string, params ...any) (tailsql.RowSet, error) {
+	ci, ok := tailsql.CallerFromContext(ctx)
+	if !ok {
+		return nil, errors.New("no caller information")
+	}
+	c.mu.Lock()
+	c.caller = append(c.caller, ci)
+	c.mu.Unlock()
+	return c.sqlDB.Query(ctx, query, params...)
+}
+
+func (c *callerDB) take() []tailsql.CallerInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := c.caller
+	c.caller = nil
+	return out
+}
+
+func TestCallerContext(t *testing.T) {
+	_, db := mustInitSQLite(t)
+	who := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "laptop.example.ts.net"},
+		UserProfile: &tailcfg.UserProfile{ID: 100, LoginName: "user@example.com"},
+		CapMap: tailcfg.PeerCapMap{
+			"example.com/cap/tailsql-rows": []tailcfg.RawMessage{`{"region":"north"}`},
+		},
+	}
+	s, err := tailsql.NewServer(tailsql.Options{
+		LocalClient: &fakeClient{isLogged: true, result: who},
+		Logf:        t.Logf,
+	})
+	if err != nil {
+		t.Fatalf("NewServer: unexpected error: %v", err)
+	}
+	defer s.Close()
+	cdb := &callerDB{sqlDB: sqlDB{db}}
+	s.SetSource("main", cdb, nil)
+
+	htest := httptest.NewServer(s.NewMux())
+	defer htest.Close()
+	get := func(path, src, query string) string {
+		t.Helper()
+		q := url.Values{"src": {src}, "q": {query}}
+		req := mustGetRequest(t, htest.URL+path+"?"+q.Encode(), "sec-tailsql", "1")
+		rsp, err := htest.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Get: unexpected error: %v", err)
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatalf("Get: status %d", rsp.StatusCode)
+		}
+		return rsp.Header.Get("X-Request-Id")
+	}
+	check := func(t *testing.T, id, path string) {
+		t.Helper()
+		got := cdb.take()
+		if len(got) != 1 {
+			t.Fatalf("Got %d queries, want 1", len(got))
+		}
+		ci := got[0]
+		if ci.WhoIs != who {
+			t.Errorf("WhoIs: got %p, want %p", ci.WhoIs, who)
+		}
+		ci.WhoIs = nil
+		ci.RemoteAddr = "" // varies
+		want := tailsql.CallerInfo{
+			Login:     "user@example.com",
+			NodeName:  "laptop.example.ts.net",
+			CapMap:    who.CapMap,
+			RequestID: id,
+			Path:      path,
+			Source:    "main",
+		}
+		if diff := cmp.Diff(want, ci); diff != "" {
+			t.Errorf("CallerInfo (-want, +got):\n%s", diff)
+		}
+	}
+
+	t.Run("Query", func(t *testing.T) {
+		id := get("/json", "main", "select * from users")
+		check(t, id, "/json")
+	})
+	t.Run("Federated", func(t *testing.T) {
+		id := get("/csv", "", "select count(*) from from:main.users")
+		check(t, id, "/csv")
+	})
+	t.Run("NoRequest", func(t *testing.T) {
+		if ci, ok := tailsql.CallerFromContext(context.Background()); ok {
+			t.Errorf("CallerFromContext: got %+v, want none", ci)
+		}
+	})
+}
+
+func TestCallerQueries(t *testing.T) {
+	dbURL, _ := mustInitSQLite(t)
+	s := newTestServer(t, tailsql.Options{
+		Sources: []tailsql.DBSpec{{
+			Source: "main",
+			Driver: "sqlite",
+			URL:    dbURL,
+			Named: map[string]string{
+				"me":    `select name, title from users where name || '@example.com' = :caller_login`,
+				"count": `select count(*) from users`,
+			},
+			AllowCallerQueries: true,
+		}},
+		Authorize: func(src string, who *apitype.WhoIsResponse) error {
+			if who.UserProfile.LoginName != "admin@example.com" {
+				return errors.New("authorization denied")
+			}
+			return nil
+		},
+	})
+	s.fc.result.UserProfile.LoginName = "carole@example.com"
+
+	t.Run("Scoped", func(t *testing.T) {
+		got := s.query(t, "main", "named:me")
+		if want := "name,title\ncarole,cto\n"; got != want {
+			t.Errorf("Result: got %q, want %q", got, want)
+		}
+	})
+	t.Run("Unscoped", func(t *testing.T) {
+		s.queryStatus(t, "main", "named:count", http.StatusForbidden)
+	})
+	t.Run("AdHoc", func(t *testing.T) {
+		s.queryStatus(t, "main", "select * from users", http.StatusForbidden)
+	})
+
+	s.fc.result.UserProfile = &tailcfg.UserProfile{ID: 200, LoginName: "admin@example.com"}
+	t.Run("Authorized", func(t *testing.T) {
+		got := s.query(t, "main", "named:count")
+		if want := "count(*)\n10\n"; got != want {
+			t.Errorf("Result: got %q, want %q", got, want)
+		}
+		got = s.query(t, "main", "named:me")
+		if want := "name,title\n"; got != want {
+			t.Errorf("Result: got %q, want %q", got, want)
+		}
+	})
+}
+
+// queryRecorder is a Queryable that records the text of each query.
+type queryRecorder struct {
+	sqlDB
+
+	mu      sync.Mutex
+	queries []string
+}
+
+func (r *queryRecorder) Query(ctx context.Context, query string, params ...any) (tailsql.RowSet, error) {
+	r.mu.Lock()
+	r.queries = append(r.queries, query)
+	r.mu.Unlock()
+	return r.sqlDB.Query(ctx, query, params...)
+}
+
+func TestAnnotation(t *testing.T) {
+	_, db := mustInitSQLite(t)
+	rec := &queryRecorder{sqlDB: sqlDB{db}}
+	logs := new(logRecords)
+	s := newTestServer(t, tailsql.Options{
+		Sources: []tailsql.DBSpec{{
+			Source:     "main",
+			DB:         rec,
+			Annotation: tailsql.DefaultAnnotation,
+		}},
+		Logger: slog.New(slog.NewJSONHandler(logs, nil)),
+	})
+
+	const query = `select count(*) from users`
+	req := mustGetRequest(t, s.csvURL("main", query), "sec-tailsql", "1")
+	rsp, err := s.cli.Do(req)
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	rsp.Body.Close()
+	id := rsp.Header.Get("X-Request-Id")
+
+	// The source gets the annotated query.
+	want := "/* tailsql user=user@example.com src=main req=" + id + " */ " + query
+	rec.mu.Lock()
+	if len(rec.queries) != 1 || rec.queries[0] != want {
+		t.Errorf("Queries: got %q, want [%q]", rec.queries, want)
+	}
+	rec.mu.Unlock()
+
+	// The log records the query as given.
+	if r := logs.find("query", id); r == nil || r["query"] != query {
+		t.Errorf("Log: got %v, want query %q", r, query)
+	}
+
+	// An annotation that could break out of its comment is rejected.
+	_, err = tailsql.NewServer(tailsql.Options{
+		Sources: []tailsql.DBSpec{{Source: "bad", DB: rec, Annotation: "x */ y"}},
+	})
+	if err == nil {
+		t.Error("NewServer with an invalid annotation: got nil, want error")
+	}
+}
+
+// stallDB is a Queryable whose queries wait until their context ends.
+type stallDB struct {
+	sqlDB
+	started chan struct{}
+}
+
+func (b *stallDB) Query(ctx context.Context, query string, params ...any) (tailsql.RowSet, error) {
+	close(b.started)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestShutdown(t *testing.T) {
+	_, db := mustInitSQLite(t)
+
+	// start returns a server with a single source, db, whose audit events are
+	// recorded by the returned sink.
+	start := func(t *testing.T, db tailsql.Queryable) (*testServer, *blockingSink) {
+		sink := &blockingSink{release: make(chan struct{})}
+		close(sink.release)
+		s := newTestServer(t, tailsql.Options{AuditSinks: []tailsql.AuditSink{sink}})
+		s.SetSource("main", db, nil)
+		return s, sink
+	}
+	query := func(s *testServer) int {
+		rsp, err := s.cli.Do(mustGetRequest(t, s.csvURL("main", "select count(*) from users"), "sec-tailsql", "1"))
+		if err != nil {
+			t.Errorf("Query: %v", err)
+			return 0
+		}
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+
+	t.Run("Drain", func(t *testing.T) {
+		bdb := &blockingDB{
+			sqlDB:   sqlDB{DB: db},
+			started: make(chan struct{}),
+			release: make(chan struct{}),
+		}
+		s, sink := start(t, bdb)
+
+		done := make(chan int)
+		go func() { done <- query(s) }()
+		<-bdb.started
+
+		shut := make(chan error)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			shut <- s.Shutdown(ctx)
+		}()
+
+		// Wait for the server to start draining, after which new requests are
+		// refused.
+		for query(s) != http.StatusServiceUnavailable {
+			time.Sleep(5 * time.Millisecond)
+		}
+		mustGetFail(t, s.cli, s.URL+"/readyz", http.StatusServiceUnavailable)
+		if bdb.closed.Load() {
+			t.Error("Source closed while a query is in progress")
+		}
+
+		close(bdb.release)
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("Query in progress: got status %d, want %d", code, http.StatusOK)
+		}
+		if err := <-shut; err != nil {
+			t.Errorf("Shutdown: unexpected error: %v", err)
+		}
+		if !bdb.closed.Load() {
+			t.Error("Source was not closed by Shutdown")
+		}
+
+		// The audit events were delivered before Shutdown returned.
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		var ends int
+		for _, e := range sink.events {
+			if e.Kind == tailsql.AuditQueryEnd {
+				ends++
+			}
+		}
+		if ends != 1 {
+			t.Errorf("Got %d query-end events, want 1: %+v", ends, sink.events)
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		sdb := &stallDB{sqlDB: sqlDB{DB: db}, started: make(chan struct{})}
+		s, _ := start(t, sdb)
+
+		done := make(chan int)
+		go func() { done <- query(s) }()
+		<-sdb.started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Shutdown: got %v, want %v", err, context.DeadlineExceeded)
+		}
+		if code := <-done; code == http.StatusOK {
+			t.Error("Canceled query succeeded")
+		}
+	})
+}
+
+func TestRoutePrefix(t *testing.T) {
+	s, err := tailsql.NewServer(tailsql.Options{
+		RoutePrefix: "/sub/dir",
+	})
+	if err != nil {
+		t.Fatalf("NewServer: unexpected error: %v", err)
+	}
+	defer s.Close()
+
+	hs := httptest.NewServer(s.NewMux())
+	defer hs.Close()
+	cli := hs.Client()
+
+	t.Run("NotFound", func(t *testing.T) {
+		rsp, err := cli.Get(hs.URL + "/static/logo.svg")
+		if err != nil {
+			t.Fatalf("Get: unexpected error: %v", err)
+		}
+		_, err = io.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if err != nil {
+			t.Errorf("Read body: %v", err)
+		}
+		if code := rsp.StatusCode; code != http.StatusNotFound {
+			t.Errorf("Get: got response %v, want %v", code, http.StatusNotFound)
+		}
+	})
+
+	t.Run("OK", func(t *testing.T) {
+		txt := string(mustGet(t, cli, hs.URL+"/sub/dir/static/logo.svg"))
+		if !strings.HasPrefix(txt, "<svg ") {
+			t.Errorf("Get logo.svg: output missing SVG prefix:\n%s", txt)
+		}
+	})
+
+	t.Run("UI", func(t *testing.T) {
+		txt := string(mustGet(t, cli, hs.URL+"/sub/dir"))
+		if !strings.Contains(txt, "Tailscale SQL Playground") {
+			t.Errorf("Get UI: missing expected title:\n%s", txt)
+		}
+	})
+}
+
+type fakeDriver struct {
+	mu  sync.Mutex
+	url string // the most recently opened URL
+}
+
+func (f *fakeDriver) Open(url string) (driver.Conn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.url = url
+	return fakeConn{}, nil
+}
+
+func (f *fakeDriver) openedURL() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.url
 }
 
 // fakeConn is a fake implementation of driver.Conn to satisfy the interface,
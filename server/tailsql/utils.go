@@ -10,12 +10,12 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"regexp"
 	"strings"
 	"time"
 	"unicode/utf8"
 
 	"github.com/klauspost/compress/zstd"
+	"github.com/tailscale/tailsql/sqllex"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/tsweb"
 	"tailscale.com/version"
@@ -30,13 +30,17 @@ type LocalClient interface {
 
 // uiData is the concrete type of the data value passed to the UI template.
 type uiData struct {
-	Query       string      // the original query
-	Sources     []*dbHandle // the available databases
-	Source      string      // the selected source
-	Output      *dbResult   // query results (may be nil)
-	Error       *string     // error results (may be nil)
-	Links       []UILink    // static UI links
-	RoutePrefix string      // for links to the API and static files
+	Query       string          // the original query
+	Sources     []*dbHandle     // the available databases
+	Patterns    []sourcePattern // source patterns for fan-out queries
+	Source      string          // the selected source
+	Diff        string          // the source to compare with (optional)
+	DiffKey     string          // key columns for the comparison (optional)
+	Output      *dbResult       // query results (may be nil)
+	Error       *string         // error results (may be nil)
+	RequestID   string          // the ID of the request, reported with errors
+	Links       []UILink        // static UI links
+	RoutePrefix string          // for links to the API and static files
 }
 
 // Version reports the version string of the currently running binary.
@@ -53,6 +57,28 @@ type dbResult struct {
 	NumRows int           // total number of rows reported
 	Trunc   bool          // whether the display was truncated
 	More    bool          // whether there are more results in the database
+	Limit   int           // if positive, the LIMIT added to the query
+	Failed  int           // for a fan-out query, the number of sources that failed
+	Bytes   int           // the approximate size of the values read (see valueSize)
+
+	// For a diff query, the change type of each row, and which cells of each
+	// row differ between the sources.
+	changes []string
+	marks   [][]bool
+}
+
+// RowClass returns the CSS class for row i of the UI output.
+func (r *dbResult) RowClass(i int) string {
+	if i < len(r.changes) {
+		return "diff-" + r.changes[i]
+	}
+	return ""
+}
+
+// Marked reports whether the cell in row i, column j of the UI output should
+// be highlighted.
+func (r *dbResult) Marked(i, j int) bool {
+	return i < len(r.marks) && j < len(r.marks[i]) && r.marks[i][j]
 }
 
 // uiOutput modifies the column values of r in-place to render the values as
@@ -132,6 +158,26 @@ func valueToString(v any, null string) string {
 	}
 }
 
+// valueSize returns the approximate size in bytes of v, a value scanned from
+// a query result. Strings and byte slices count their length, and other
+// values a fixed size, so that counting does not format them.
+func valueSize(v any) int {
+	switch t := v.(type) {
+	case nil:
+		return 0
+	case []byte:
+		return len(t)
+	case string:
+		return len(t)
+	case bool:
+		return 1
+	case int32, uint32, float32:
+		return 4
+	default:
+		return 8 // int64, float64, time.Time, etc.
+	}
+}
+
 // isBinaryData reports whether data contains byte values outside the ASCII
 // range, or non-printable controls.
 func isBinaryData(data []byte) bool {
@@ -212,39 +258,32 @@ func errorCode(err error) int {
 	return http.StatusInternalServerError
 }
 
-// checkQuerySyntax reports whether query is safe to send to the database.
+// checkQuerySyntax reports whether query is safe to send to a database whose
+// lexical rules are given by d.
 //
 // A read-only SQLite database will correctly report errors for operations that
 // modify the database or its schema if it is opened read-only. However, the
 // ATTACH and DETACH verbs modify only the connection, permitting the caller to
 // mention any database accessible from the filesystem. Similarly, VACUUM INTO
 // can be run even on a read-only database, so don't allow it in any form.
-func checkQuerySyntax(query string) error {
-	for _, tok := range sqlTokens(query) {
-		switch tok {
-		case "ATTACH", "DETACH", "TEMP", "TEMPORARY", "VACUUM":
-			return fmt.Errorf("statement %q is not allowed", tok)
+//
+// Queries that cannot be scanned, such as those with an unterminated string
+// or comment, are rejected, since the database might not agree about where
+// the malformed text ends. If d is sqllex.Generic, the query must pass when
+// scanned by the rules of every known dialect, since any of them may apply.
+func checkQuerySyntax(d sqllex.Dialect, query string) error {
+	for _, cd := range d.Candidates() {
+		for _, tok := range sqllex.Scan(cd, query) {
+			switch tok.Kind {
+			case sqllex.Invalid:
+				return fmt.Errorf("at %v: unterminated quote or comment", tok.Pos)
+			case sqllex.Word:
+				switch w := strings.ToUpper(tok.Text); w {
+				case "ATTACH", "DETACH", "TEMP", "TEMPORARY", "VACUUM":
+					return fmt.Errorf("at %v: statement %q is not allowed", tok.Pos, w)
+				}
+			}
 		}
 	}
 	return nil
 }
-
-// sqlRE is a very approximate lexical matcher for SQL tokens.
-var sqlRE = regexp.MustCompile(`(?m)\w+|('([^\']|'')*')|("([^\"]|"")*")|(--.*(\n|$))|\S+`)
-
-// sqlTokens performs a lightweight and approximate lexical analysis of query
-// as an SQL input. It discards string literals and comments, and returns the
-// remaining "tokens" normalized to uppercase.
-func sqlTokens(query string) []string {
-	var tok []string
-	ms := sqlRE.FindAllStringSubmatch(query, -1)
-	for _, m := range ms {
-		if strings.HasPrefix(m[0], "--") ||
-			strings.HasPrefix(m[0], "'") ||
-			strings.HasPrefix(m[0], `"`) {
-			continue
-		}
-		tok = append(tok, strings.ToUpper(m[0]))
-	}
-	return tok
-}
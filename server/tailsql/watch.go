@@ -0,0 +1,158 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tailsql
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+)
+
+// watchPaths returns the paths of the files to watch for changes to the source
+// defined by d, given its current connection string. The key file path is
+// empty if d does not use a key file, and the database path is empty if d is
+// not a SQLite database stored in a file.
+func (d *DBSpec) watchPaths(connString string) (keyPath, dbPath string) {
+	if d.KeyFile != "" {
+		keyPath = os.ExpandEnv(d.KeyFile)
+	}
+	return keyPath, sqliteFilePath(d.Driver, connString)
+}
+
+// sqliteFilePath returns the filesystem path of the SQLite database named by
+// connString, or "" if driver is not a SQLite driver or the database is not
+// stored in a file.
+func sqliteFilePath(driver, connString string) string {
+	if driver != "sqlite" && driver != "sqlite3" {
+		return ""
+	}
+	path, _, _ := strings.Cut(strings.TrimPrefix(connString, "file:"), "?")
+	if path == "" || strings.HasPrefix(path, ":") { // e.g., ":memory:"
+		return ""
+	}
+	return path
+}
+
+// fileState records the state of a watched file.
+type fileState struct {
+	info os.FileInfo // nil if the file does not exist
+}
+
+func statFile(path string) fileState {
+	if path == "" {
+		return fileState{}
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{info: fi}
+}
+
+// replaced reports whether f and g refer to different files.
+func (f fileState) replaced(g fileState) bool {
+	if f.info == nil || g.info == nil {
+		return f.info != g.info
+	}
+	return !os.SameFile(f.info, g.info)
+}
+
+// modified reports whether f and g differ in identity, size, or modification
+// time.
+func (f fileState) modified(g fileState) bool {
+	if f.replaced(g) {
+		return true
+	} else if f.info == nil {
+		return false
+	}
+	return f.info.Size() != g.info.Size() || !f.info.ModTime().Equal(g.info.ModTime())
+}
+
+// watchSource checks the files for the source defined by spec at the interval
+// given by its WatchInterval, until ctx ends. If the key file changes so that
+// the connection string is different, or if the SQLite database file is
+// replaced, watchSource opens a new connection and swaps it in to the handle
+// for the source. As with any other update, the swap is deferred until the
+// queries in flight on the old connection have finished.
+func (s *Server) watchSource(ctx context.Context, spec DBSpec) {
+	t := time.NewTicker(spec.WatchInterval.Duration())
+	defer t.Stop()
+
+	// If the connection string cannot be read yet, we will still notice when
+	// the key file appears.
+	connString, _ := spec.connString()
+	keyPath, dbPath := spec.watchPaths(connString)
+	keyState, dbState := statFile(keyPath), statFile(dbPath)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		newKey := statFile(keyPath)
+		keyChanged := newKey.modified(keyState)
+		keyState = newKey
+		if keyChanged {
+			cs, err := spec.connString()
+			if err != nil {
+				s.log.Warn("watch: invalid source", "source", spec.Source, "error", err)
+				continue
+			}
+			connString = cs
+			_, dbPath = spec.watchPaths(connString)
+		}
+		newDB := statFile(dbPath)
+		dbReplaced := newDB.replaced(dbState)
+		dbState = newDB
+
+		h := s.dbs.lookup(spec.Source)
+		if h == nil {
+			return // the source was removed
+		}
+		conf := spec.connKey(connString)
+		if conf == h.Conf() && !dbReplaced {
+			continue // nothing relevant has changed
+		}
+
+		db, err := openAndPing(ctx, spec.Driver, connString, spec.PoolOptions)
+		if err != nil {
+			s.log.Warn("watch: reopening source failed", "source", spec.Source, "error", err)
+			continue
+		}
+		if err := h.post(&dbUpdate{
+			newDB:  newSQLDB(db, spec.Driver, spec.SessionOptions),
+			driver: spec.Driver,
+			conf:   conf,
+			label:  h.Label(),
+			named:  h.Named(),
+		}); err != nil {
+			return // the handle was closed
+		}
+		s.log.Info("watch: reopened source after a file change", "source", spec.Source)
+	}
+}
+
+// startWatch starts a goroutine to watch the files for the source defined by
+// spec, if it requests that, replacing any existing watcher for that source.
+// If spec == nil, startWatch stops the existing watcher for the source, if
+// any.
+func (s *Server) startWatch(source string, spec *DBSpec) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stop, ok := s.watchers[source]; ok {
+		stop()
+		delete(s.watchers, source)
+	}
+	if spec == nil || spec.WatchInterval <= 0 {
+		return
+	}
+	ctx, stop := context.WithCancel(s.ctx)
+	if s.watchers == nil {
+		s.watchers = make(map[string]context.CancelFunc)
+	}
+	s.watchers[source] = stop
+	go s.watchSource(ctx, *spec)
+}
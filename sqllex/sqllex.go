@@ -0,0 +1,487 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package sqllex implements a lexical scanner for SQL text.
+//
+// The scanner understands the quoting and comment rules of several dialects,
+// so that tools can reliably tell which parts of a query are keywords and
+// identifiers, and which are literals or comments. It does not parse the
+// structure of statements.
+package sqllex
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A Dialect selects the lexical rules of a particular database.
+type Dialect int
+
+const (
+	// Generic is the dialect of databases not otherwise known. It recognizes
+	// only standard SQL strings, quoted identifiers, and comments. Since the
+	// database may quote text by other means, which can hide text from the
+	// scanner, a check that must be conservative should scan the input with
+	// each of Generic.Candidates().
+	Generic Dialect = iota
+
+	SQLite     // SQLite
+	PostgreSQL // PostgreSQL
+	MySQL      // MySQL and MariaDB
+)
+
+var dialectNames = [...]string{
+	Generic:    "generic",
+	SQLite:     "sqlite",
+	PostgreSQL: "postgres",
+	MySQL:      "mysql",
+}
+
+func (d Dialect) String() string {
+	if int(d) >= 0 && int(d) < len(dialectNames) {
+		return dialectNames[d]
+	}
+	return fmt.Sprintf("Dialect(%d)", int(d))
+}
+
+// Candidates returns the dialects whose lexical rules a database of dialect d
+// may follow: d itself if it is known, or Generic and every known dialect if
+// d is Generic.
+func (d Dialect) Candidates() []Dialect {
+	if d == Generic {
+		return []Dialect{Generic, SQLite, PostgreSQL, MySQL}
+	}
+	return []Dialect{d}
+}
+
+// ForDriver returns the dialect for the named database/sql driver.
+// It returns Generic for drivers it does not recognize.
+func ForDriver(driver string) Dialect {
+	switch strings.ToLower(driver) {
+	case "sqlite", "sqlite3":
+		return SQLite
+	case "postgres", "postgresql", "pgx", "pq", "cloudsqlpostgres":
+		return PostgreSQL
+	case "mysql", "mariadb":
+		return MySQL
+	default:
+		return Generic
+	}
+}
+
+// A Kind identifies the lexical type of a token.
+type Kind int
+
+const (
+	Invalid     Kind = iota // malformed input, such as an unterminated string
+	Space                   // whitespace
+	Comment                 // a line or block comment
+	Word                    // a keyword or unquoted identifier
+	QuotedIdent             // a quoted identifier, e.g., "name" or `name`
+	String                  // a string or blob literal
+	Number                  // a numeric literal
+	Param                   // a parameter or variable, e.g., ?, $1, :name
+	Punct                   // an operator or punctuation
+)
+
+var kindNames = [...]string{
+	Invalid:     "invalid",
+	Space:       "space",
+	Comment:     "comment",
+	Word:        "word",
+	QuotedIdent: "quoted identifier",
+	String:      "string",
+	Number:      "number",
+	Param:       "parameter",
+	Punct:       "punctuation",
+}
+
+func (k Kind) String() string {
+	if int(k) >= 0 && int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// A Position is a location in the input. Line and Column are 1-based, and
+// Column counts bytes.
+type Position struct {
+	Offset int // byte offset from the start of input
+	Line   int
+	Column int
+}
+
+func (p Position) String() string { return fmt.Sprintf("%d:%d", p.Line, p.Column) }
+
+// A Token is a lexical token of an SQL input.
+type Token struct {
+	Kind Kind
+	Text string   // the source text of the token, including quotes
+	Pos  Position // the location of the start of the token
+}
+
+// Is reports whether t is a word equal to w, ignoring case.
+func (t Token) Is(w string) bool {
+	return t.Kind == Word && strings.EqualFold(t.Text, w)
+}
+
+// Significant reports whether t is meaningful to the database, that is,
+// whether it is not whitespace or a comment.
+func (t Token) Significant() bool { return t.Kind != Space && t.Kind != Comment }
+
+func (t Token) String() string { return fmt.Sprintf("%v %s %q", t.Pos, t.Kind, t.Text) }
+
+// Scan returns the tokens of input according to the rules of d, in order.
+// The concatenated text of the tokens is equal to input. If the input is
+// malformed, the last token has kind Invalid and extends to the end of input.
+func Scan(d Dialect, input string) []Token {
+	s := &scanner{d: d, input: input, line: 1, col: 1}
+	var out []Token
+	for s.pos < len(s.input) {
+		out = append(out, s.next())
+	}
+	return out
+}
+
+// Statements splits the significant tokens of toks into statements separated
+// by semicolons. Empty statements are omitted, and the semicolons are not
+// included in the result.
+func Statements(toks []Token) [][]Token {
+	var out [][]Token
+	var cur []Token
+	for _, t := range toks {
+		if !t.Significant() {
+			continue
+		} else if t.Kind == Punct && t.Text == ";" {
+			if len(cur) != 0 {
+				out = append(out, cur)
+				cur = nil
+			}
+			continue
+		}
+		cur = append(cur, t)
+	}
+	if len(cur) != 0 {
+		out = append(out, cur)
+	}
+	return out
+}
+
+type scanner struct {
+	d     Dialect
+	input string
+	pos   int
+
+	line, col int  // position of s.pos
+	inExec    bool // inside a MySQL executable comment /*! ... */
+}
+
+// next scans the next token. Precondition: s.pos < len(s.input).
+func (s *scanner) next() Token {
+	start := Position{Offset: s.pos, Line: s.line, Column: s.col}
+	kind := s.scan()
+	text := s.input[start.Offset:s.pos]
+	for _, c := range []byte(text) {
+		if c == '\n' {
+			s.line++
+			s.col = 1
+		} else {
+			s.col++
+		}
+	}
+	return Token{Kind: kind, Text: text, Pos: start}
+}
+
+func (s *scanner) peek(i int) byte {
+	if s.pos+i < len(s.input) {
+		return s.input[s.pos+i]
+	}
+	return 0
+}
+
+func (s *scanner) hasPrefix(p string) bool { return strings.HasPrefix(s.input[s.pos:], p) }
+
+// scan advances s.pos past the next token and reports its kind.
+func (s *scanner) scan() Kind {
+	c := s.input[s.pos]
+	switch {
+	case isSpace(c):
+		for s.pos < len(s.input) && isSpace(s.input[s.pos]) {
+			s.pos++
+		}
+		return Space
+
+	case s.hasPrefix("--") && (s.d != MySQL || isSpace(s.peek(2)) || s.peek(2) == 0):
+		return s.lineComment()
+	case c == '#' && s.d == MySQL:
+		return s.lineComment()
+	case s.hasPrefix("/*"):
+		return s.blockComment()
+	case s.inExec && s.hasPrefix("*/"):
+		s.pos += 2
+		s.inExec = false
+		return Comment
+
+	case c == '\'':
+		return s.quoted('\'', String)
+	case c == '"':
+		if s.d == MySQL {
+			return s.quoted('"', String)
+		}
+		return s.quoted('"', QuotedIdent)
+	case c == '`' && (s.d == SQLite || s.d == MySQL):
+		return s.quoted('`', QuotedIdent)
+	case c == '[' && s.d == SQLite:
+		if i := strings.IndexByte(s.input[s.pos:], ']'); i >= 0 {
+			s.pos += i + 1
+			return QuotedIdent
+		}
+		s.pos = len(s.input)
+		return Invalid
+
+	case c == '$' && s.d == PostgreSQL:
+		return s.dollar()
+	case isDigit(c) || (c == '.' && isDigit(s.peek(1))):
+		return s.number()
+	case (c == '?' || c == ':' || c == '@' || c == '$') && s.d != PostgreSQL && s.d != Generic:
+		if k, ok := s.param(); ok {
+			return k
+		}
+	case c == '?':
+		s.pos++
+		return Param
+	}
+
+	if k, ok := s.prefixedString(); ok {
+		return k
+	}
+	if r, n := utf8.DecodeRuneInString(s.input[s.pos:]); isIdentStart(r) {
+		s.pos += n
+		s.identRest()
+		return Word
+	}
+	return s.punct()
+}
+
+func (s *scanner) lineComment() Kind {
+	if i := strings.IndexByte(s.input[s.pos:], '\n'); i >= 0 {
+		s.pos += i // the newline is whitespace
+	} else {
+		s.pos = len(s.input)
+	}
+	return Comment
+}
+
+func (s *scanner) blockComment() Kind {
+	if s.d == MySQL && s.hasPrefix("/*!") {
+		// MySQL executes the contents of a comment beginning with "/*!",
+		// optionally followed by a version number, so only the markers are
+		// comments. The contents are scanned as ordinary tokens.
+		s.pos += 3
+		for s.pos < len(s.input) && isDigit(s.input[s.pos]) {
+			s.pos++
+		}
+		s.inExec = true
+		return Comment
+	}
+	depth := 0
+	for s.pos < len(s.input) {
+		switch {
+		case s.hasPrefix("/*") && (depth == 0 || s.d == PostgreSQL):
+			depth++
+			s.pos += 2
+		case s.hasPrefix("*/"):
+			depth--
+			s.pos += 2
+			if depth == 0 {
+				return Comment
+			}
+		default:
+			s.pos++
+		}
+	}
+	if s.d == SQLite {
+		return Comment // SQLite allows an unterminated comment at the end of input
+	}
+	return Invalid
+}
+
+// quoted scans a literal delimited by q. A doubled delimiter stands for
+// itself; in MySQL strings, a backslash also escapes the next character.
+func (s *scanner) quoted(q byte, kind Kind) Kind {
+	s.pos++ // opening delimiter
+	backslash := s.d == MySQL && kind == String
+	return s.quotedRest(q, kind, backslash)
+}
+
+func (s *scanner) quotedRest(q byte, kind Kind, backslash bool) Kind {
+	for s.pos < len(s.input) {
+		c := s.input[s.pos]
+		switch {
+		case backslash && c == '\\':
+			s.pos += 2
+		case c == q && s.peek(1) == q:
+			s.pos += 2
+		case c == q:
+			s.pos++
+			return kind
+		default:
+			s.pos++
+		}
+	}
+	s.pos = len(s.input)
+	return Invalid
+}
+
+// prefixedString scans a string literal with a prefix, such as X'00ff' or
+// E'line\n', if one begins at the current position.
+func (s *scanner) prefixedString() (Kind, bool) {
+	rest := s.input[s.pos:]
+	n := 0
+	switch {
+	case len(rest) > 3 && (rest[0] == 'u' || rest[0] == 'U') && rest[1] == '&' && rest[2] == '\'' && s.d == PostgreSQL:
+		n = 2
+	case len(rest) > 2 && rest[1] == '\'':
+		switch rest[0] {
+		case 'x', 'X':
+			n = 1
+		case 'b', 'B', 'e', 'E', 'n', 'N':
+			if s.d == PostgreSQL || (s.d == MySQL && rest[0] != 'e' && rest[0] != 'E') {
+				n = 1
+			}
+		}
+	}
+	if n == 0 {
+		return 0, false
+	}
+	escapes := s.d == MySQL || rest[0] == 'e' || rest[0] == 'E'
+	s.pos += n + 1
+	return s.quotedRest('\'', String, escapes), true
+}
+
+// dollar scans a PostgreSQL token beginning with "$": a positional parameter
+// such as $1, or a dollar-quoted string such as $$text$$ or $tag$text$tag$.
+func (s *scanner) dollar() Kind {
+	if isDigit(s.peek(1)) {
+		s.pos++
+		for s.pos < len(s.input) && isDigit(s.input[s.pos]) {
+			s.pos++
+		}
+		return Param
+	}
+	end := s.pos + 1
+	for end < len(s.input) && s.input[end] != '$' {
+		r, n := utf8.DecodeRuneInString(s.input[end:])
+		if !isIdentPart(r) || (end == s.pos+1 && isDigit(s.input[end])) {
+			s.pos++
+			return Punct // a lone "$"
+		}
+		end += n
+	}
+	if end >= len(s.input) {
+		s.pos++
+		return Punct
+	}
+	tag := s.input[s.pos : end+1]
+	if i := strings.Index(s.input[end+1:], tag); i >= 0 {
+		s.pos = end + 1 + i + len(tag)
+		return String
+	}
+	s.pos = len(s.input)
+	return Invalid
+}
+
+// param scans a SQLite or MySQL parameter or variable, such as ?1, :name,
+// @name, or $name. It reports false if there is none at the current position.
+func (s *scanner) param() (Kind, bool) {
+	c := s.input[s.pos]
+	if c == '?' {
+		s.pos++
+		for s.pos < len(s.input) && isDigit(s.input[s.pos]) {
+			s.pos++
+		}
+		return Param, true
+	}
+	if s.d == MySQL && c != '@' {
+		return 0, false
+	}
+	i := 1
+	if s.d == MySQL && s.peek(1) == '@' {
+		i++ // system variable, @@name
+	}
+	r, n := utf8.DecodeRuneInString(s.input[s.pos+i:])
+	if !isIdentStart(r) && !(c != ':' && isDigit(s.peek(i))) {
+		return 0, false
+	}
+	s.pos += i + n
+	s.identRest()
+	return Param, true
+}
+
+func (s *scanner) number() Kind {
+	if s.input[s.pos] == '0' && (s.peek(1) == 'x' || s.peek(1) == 'X') {
+		s.pos += 2
+		for s.pos < len(s.input) && isHex(s.input[s.pos]) {
+			s.pos++
+		}
+		return Number
+	}
+	for s.pos < len(s.input) {
+		c := s.input[s.pos]
+		switch {
+		case isDigit(c) || c == '.' || c == '_':
+			s.pos++
+		case (c == 'e' || c == 'E') && (isDigit(s.peek(1)) ||
+			((s.peek(1) == '+' || s.peek(1) == '-') && isDigit(s.peek(2)))):
+			s.pos += 2
+		default:
+			return Number
+		}
+	}
+	return Number
+}
+
+func (s *scanner) identRest() {
+	for s.pos < len(s.input) {
+		r, n := utf8.DecodeRuneInString(s.input[s.pos:])
+		if !isIdentPart(r) {
+			return
+		}
+		s.pos += n
+	}
+}
+
+// operators are the multi-character operators, longest first.
+var operators = []string{
+	"->>", "<=>", "::", "||", "<=", ">=", "<>", "!=", "==", "->", "<<", ">>", ":=",
+}
+
+func (s *scanner) punct() Kind {
+	for _, op := range operators {
+		if s.hasPrefix(op) {
+			s.pos += len(op)
+			return Punct
+		}
+	}
+	_, n := utf8.DecodeRuneInString(s.input[s.pos:])
+	s.pos += n
+	return Punct
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+func isHex(c byte) bool {
+	return isDigit(c) || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || (r >= utf8.RuneSelf && r != utf8.RuneError)
+}
+
+func isIdentPart(r rune) bool {
+	return isIdentStart(r) || unicode.IsDigit(r) || r == '$'
+}
@@ -0,0 +1,168 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package sqllex_test
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/tailscale/tailsql/sqllex"
+)
+
+// tok is a compact representation of a token for comparison.
+type tok struct {
+	Kind sqllex.Kind
+	Text string
+}
+
+func significant(d sqllex.Dialect, input string) []tok {
+	var out []tok
+	for _, t := range sqllex.Scan(d, input) {
+		if t.Significant() {
+			out = append(out, tok{t.Kind, t.Text})
+		}
+	}
+	return out
+}
+
+func TestScan(t *testing.T) {
+	const (
+		W = sqllex.Word
+		Q = sqllex.QuotedIdent
+		S = sqllex.String
+		N = sqllex.Number
+		A = sqllex.Param
+		P = sqllex.Punct
+		X = sqllex.Invalid
+	)
+	tests := []struct {
+		dialect sqllex.Dialect
+		input   string
+		want    []tok
+	}{
+		{sqllex.SQLite, "", nil},
+		{sqllex.SQLite, "  \n\t", nil},
+		{sqllex.SQLite, `select a, "b""c" from t where x = 'it''s' -- tail`, []tok{
+			{W, "select"}, {W, "a"}, {P, ","}, {Q, `"b""c"`}, {W, "from"}, {W, "t"},
+			{W, "where"}, {W, "x"}, {P, "="}, {S, `'it''s'`},
+		}},
+		{sqllex.SQLite, "select `a`, [b c], x'00ff', ?1, :n, @m, $o /* open", []tok{
+			{W, "select"}, {Q, "`a`"}, {P, ","}, {Q, "[b c]"}, {P, ","}, {S, "x'00ff'"}, {P, ","},
+			{A, "?1"}, {P, ","}, {A, ":n"}, {P, ","}, {A, "@m"}, {P, ","}, {A, "$o"},
+		}},
+		{sqllex.SQLite, "select 'open", []tok{{W, "select"}, {X, "'open"}}},
+		{sqllex.SQLite, "select 1.5e-3, .5, 0x1F, 10", []tok{
+			{W, "select"}, {N, "1.5e-3"}, {P, ","}, {N, ".5"}, {P, ","}, {N, "0x1F"}, {P, ","}, {N, "10"},
+		}},
+		{sqllex.SQLite, "a||b <= c <> d", []tok{
+			{W, "a"}, {P, "||"}, {W, "b"}, {P, "<="}, {W, "c"}, {P, "<>"}, {W, "d"},
+		}},
+
+		{sqllex.PostgreSQL, "select $$it's $1$$, $a$ x $$ y $a$, $1::int", []tok{
+			{W, "select"}, {S, "$$it's $1$$"}, {P, ","}, {S, "$a$ x $$ y $a$"}, {P, ","},
+			{A, "$1"}, {P, "::"}, {W, "int"},
+		}},
+		{sqllex.PostgreSQL, "select /* a /* nested */ comment */ E'\\'x', U&'d', b'01'", []tok{
+			{W, "select"}, {S, `E'\'x'`}, {P, ","}, {S, "U&'d'"}, {P, ","}, {S, "b'01'"},
+		}},
+		{sqllex.PostgreSQL, "select `a`", []tok{{W, "select"}, {P, "`"}, {W, "a"}, {P, "`"}}},
+		{sqllex.PostgreSQL, "select $tag$ open", []tok{{W, "select"}, {X, "$tag$ open"}}},
+		{sqllex.PostgreSQL, "select /* open /* */", []tok{{W, "select"}, {X, "/* open /* */"}}},
+
+		{sqllex.MySQL, `select "a\"b", 'c\'d', ` + "`e``f`" + ` # comment`, []tok{
+			{W, "select"}, {S, `"a\"b"`}, {P, ","}, {S, `'c\'d'`}, {P, ","}, {Q, "`e``f`"},
+		}},
+		{sqllex.MySQL, "select 1--2, @@version, @v", []tok{
+			{W, "select"}, {N, "1"}, {P, "-"}, {P, "-"}, {N, "2"}, {P, ","},
+			{A, "@@version"}, {P, ","}, {A, "@v"},
+		}},
+		{sqllex.MySQL, "select /*!50001 sleep(1) */ 2 /* plain */", []tok{
+			{W, "select"}, {W, "sleep"}, {P, "("}, {N, "1"}, {P, ")"}, {N, "2"},
+		}},
+
+		{sqllex.Generic, "select `a` from [b] where c = $$d$$", []tok{
+			{W, "select"}, {P, "`"}, {W, "a"}, {P, "`"}, {W, "from"}, {P, "["}, {W, "b"}, {P, "]"},
+			{W, "where"}, {W, "c"}, {P, "="}, {P, "$"}, {P, "$"}, {W, "d$$"},
+		}},
+	}
+	for _, tc := range tests {
+		got := significant(tc.dialect, tc.input)
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("Scan %v %q (-want, +got):\n%s", tc.dialect, tc.input, diff)
+		}
+
+		// The tokens must cover the input exactly.
+		var sb strings.Builder
+		for _, t := range sqllex.Scan(tc.dialect, tc.input) {
+			sb.WriteString(t.Text)
+		}
+		if sb.String() != tc.input {
+			t.Errorf("Scan %v %q: tokens reassemble to %q", tc.dialect, tc.input, sb.String())
+		}
+	}
+}
+
+func TestPositions(t *testing.T) {
+	const input = "select 1;\n  -- note\n  attach 'x'"
+	var got []string
+	for _, t := range sqllex.Scan(sqllex.SQLite, input) {
+		if t.Significant() {
+			got = append(got, t.Pos.String()+" "+t.Text)
+		}
+	}
+	want := []string{"1:1 select", "1:8 1", "1:9 ;", "3:3 attach", "3:10 'x'"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Positions (-want, +got):\n%s", diff)
+	}
+}
+
+func TestStatements(t *testing.T) {
+	const input = "select 1; ; -- empty\n select ';' as x;\nattach 'y'"
+	var got []string
+	for _, stmt := range sqllex.Statements(sqllex.Scan(sqllex.SQLite, input)) {
+		var words []string
+		for _, t := range stmt {
+			words = append(words, t.Text)
+		}
+		got = append(got, strings.Join(words, " "))
+	}
+	want := []string{"select 1", "select ';' as x", "attach 'y'"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Statements (-want, +got):\n%s", diff)
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	if got := sqllex.SQLite.Candidates(); !slices.Equal(got, []sqllex.Dialect{sqllex.SQLite}) {
+		t.Errorf("SQLite candidates: got %v, want only sqlite", got)
+	}
+	got := sqllex.Generic.Candidates()
+	for _, d := range []sqllex.Dialect{sqllex.Generic, sqllex.SQLite, sqllex.PostgreSQL, sqllex.MySQL} {
+		if !slices.Contains(got, d) {
+			t.Errorf("Generic candidates: got %v, missing %v", got, d)
+		}
+	}
+}
+
+func TestForDriver(t *testing.T) {
+	tests := []struct {
+		driver string
+		want   sqllex.Dialect
+	}{
+		{"sqlite", sqllex.SQLite},
+		{"sqlite3", sqllex.SQLite},
+		{"postgres", sqllex.PostgreSQL},
+		{"pgx", sqllex.PostgreSQL},
+		{"mysql", sqllex.MySQL},
+		{"snowflake", sqllex.Generic},
+		{"", sqllex.Generic},
+	}
+	for _, tc := range tests {
+		if got := sqllex.ForDriver(tc.driver); got != tc.want {
+			t.Errorf("ForDriver(%q): got %v, want %v", tc.driver, got, tc.want)
+		}
+	}
+}